@@ -0,0 +1,24 @@
+package console
+
+import (
+	"embed"
+	"github.com/gorilla/mux"
+	"io/fs"
+	"net/http"
+)
+
+// テスター向けの操作画面。/pjf/api/以下のAPIを使って、カードのタッチやネットワーク状態の変化などを発生させる。
+// ファイルはバイナリに埋め込むので、実行時にファイルを配置する必要はない。
+//
+//go:embed static
+var static embed.FS
+
+// /sim/ で操作画面をserveする
+func Setup(mux *mux.Router) {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("/sim", http.RedirectHandler("/sim/", http.StatusMovedPermanently))
+	mux.PathPrefix("/sim/").Handler(http.StripPrefix("/sim/", http.FileServer(http.FS(files))))
+}
@@ -0,0 +1,338 @@
+"use strict";
+// pro3simの操作画面。/pjf/api/以下のAPIを呼び出す。
+
+// キーパッドのボタンと、startKeypadListen()のeventCodeとして送るキーコード
+const KEYS = [
+    {label: "1", code: 0x31}, {label: "2", code: 0x32}, {label: "3", code: 0x33},
+    {label: "4", code: 0x34}, {label: "5", code: 0x35}, {label: "6", code: 0x36},
+    {label: "7", code: 0x37}, {label: "8", code: 0x38}, {label: "9", code: 0x39},
+    {label: "*", code: 0x2A}, {label: "0", code: 0x30}, {label: "#", code: 0x23},
+];
+
+// 状態を更新する間隔(ms)
+const POLL_INTERVAL = 1000;
+
+const $ = (id) => document.getElementById(id);
+
+// 選択中の端末を付けたAPIのURL
+function apiUrl(path) {
+    const terminal = $("terminal").value;
+    if (!terminal) {
+        return path;
+    }
+    return path + (path.includes("?") ? "&" : "?") + "terminal=" + encodeURIComponent(terminal);
+}
+
+async function api(method, path, body) {
+    const init = {method: method};
+    if (body !== undefined) {
+        init.headers = {"Content-Type": "application/json"};
+        init.body = JSON.stringify(body);
+    }
+    const resp = await fetch(apiUrl(path), init);
+    const text = await resp.text();
+    let json = null;
+    try {
+        json = text ? JSON.parse(text) : null;
+    } catch (e) {
+    }
+    if (!resp.ok) {
+        const message = json?.error?.message ?? resp.statusText;
+        throw new Error(`${method} ${path}: ${resp.status} ${message}`);
+    }
+    return json;
+}
+
+function log(message, isError) {
+    const li = document.createElement("li");
+    li.textContent = `${new Date().toLocaleTimeString()} ${message}`;
+    if (isError) {
+        li.className = "error";
+    }
+    $("log").prepend(li);
+    while ($("log").children.length > 200) {
+        $("log").lastChild.remove();
+    }
+}
+
+// eventTriggerでイベントを発生させ、配送結果をログに出す
+async function trigger(event) {
+    try {
+        const result = await api("POST", "/pjf/api/eventTrigger", event);
+        log(`${event.api} eventCode=${event.eventCode} → ${result.delivered}/${result.clients}クライアントに配送`);
+    } catch (e) {
+        log(e.message, true);
+    }
+}
+
+function button(label, onClick) {
+    const b = document.createElement("button");
+    b.textContent = label;
+    b.addEventListener("click", onClick);
+    return b;
+}
+
+async function loadTerminals() {
+    const terminals = await api("GET", "/pjf/api/terminals");
+    const select = $("terminal");
+    const selected = select.value;
+    select.textContent = "";
+    for (const t of terminals) {
+        const option = document.createElement("option");
+        option.value = t.id;
+        option.textContent = t.id;
+        select.append(option);
+    }
+    if (terminals.some((t) => t.id === selected)) {
+        select.value = selected;
+    }
+    select.parentElement.hidden = terminals.length <= 1;
+    updateWebSQLLink();
+}
+
+// WebSQLの画面は、選択中の端末のdatabaseを表示する
+function updateWebSQLLink() {
+    const terminal = $("terminal").value;
+    $("websql-link").href = "websql.html" + (terminal ? "?terminal=" + encodeURIComponent(terminal) : "");
+}
+
+async function loadCards() {
+    const cards = await api("GET", "/pjf/api/cards");
+    const div = $("cards");
+    div.textContent = "";
+    if (cards.length === 0) {
+        div.textContent = "登録済みのカードはありません。";
+        return;
+    }
+    for (const c of cards) {
+        div.append(button(c.label || c.name, async () => {
+            try {
+                await api("POST", `/pjf/api/cards/${encodeURIComponent(c.name)}/touch`);
+                log(`カード ${c.name} (${c.idm}) をタッチ`);
+            } catch (e) {
+                log(e.message, true);
+            }
+        }));
+    }
+}
+
+function setupTouchIdm() {
+    $("touch-idm").addEventListener("submit", async (e) => {
+        e.preventDefault();
+        const form = e.target;
+        const idm = form.idm.value.toUpperCase();
+        await trigger({
+            api: "startCommunication",
+            eventCode: 1,
+            responseObject: {category: Number(form.category.value), paramResult: 1, idm: idm},
+        });
+        const hold = parseInt(form.hold.value, 10) || 0;
+        setTimeout(() => {
+            trigger({api: "startCommunication", eventCode: 0, responseObject: {idm: idm}});
+        }, hold);
+    });
+}
+
+function setupNetwork() {
+    for (const b of document.querySelectorAll("[data-network]")) {
+        b.addEventListener("click", () => {
+            trigger({api: "startEventListen", eventCode: Number(b.dataset.network)});
+        });
+    }
+    for (const b of document.querySelectorAll("[data-network-pattern]")) {
+        b.addEventListener("click", async () => {
+            try {
+                await api("POST", "/pjf/api/network/pattern", JSON.parse(b.dataset.networkPattern));
+                log(`ネットワークのパターンを開始しました: ${b.textContent}`);
+            } catch (e) {
+                log(e.message, true);
+            }
+        });
+    }
+    $("network-pattern-stop").addEventListener("click", () => api("DELETE", "/pjf/api/network/pattern"));
+}
+
+function setupKeypad() {
+    for (const key of KEYS) {
+        const b = button(key.label, () => {
+            trigger({api: "startKeypadListen", eventCode: key.code});
+        });
+        b.title = "キーコード " + key.code;
+        $("keys").append(b);
+    }
+    $("key-code").addEventListener("submit", (e) => {
+        e.preventDefault();
+        trigger({api: "startKeypadListen", eventCode: Number(e.target.code.value)});
+    });
+    $("keypad-toggle-connected").addEventListener("click", async () => {
+        try {
+            const keypad = await api("GET", "/pjf/api/keypad");
+            await api("POST", "/pjf/api/keypad/connected", {connected: !keypad.connected});
+            await refresh();
+        } catch (e) {
+            log(e.message, true);
+        }
+    });
+}
+
+// 端末の識別情報をフォームに表示する。編集中の値を上書きしないよう、定期的には取得しない。
+async function loadDevice() {
+    const info = await api("GET", "/pjf/api/device/info");
+    const form = $("device-info");
+    const profiles = await api("GET", "/pjf/api/firmware/profiles");
+    form.firmwareProfile.textContent = "";
+    form.firmwareProfile.append(new Option("(なし)", ""));
+    for (const p of profiles) {
+        form.firmwareProfile.append(new Option(`${p.name} (${p.firmwareVersion})`, p.name));
+    }
+    for (const name of ["terminalId", "firmwareVersion", "contentsSetVersion", "productType", "firmwareProfile"]) {
+        form[name].value = info[name];
+    }
+}
+
+function setupDevice() {
+    $("device-info").addEventListener("submit", async (e) => {
+        e.preventDefault();
+        const form = e.target;
+        try {
+            const current = await api("GET", "/pjf/api/device/info");
+            const req = {
+                terminalId: form.terminalId.value,
+                contentsSetVersion: form.contentsSetVersion.value,
+                productType: form.productType.value,
+                firmwareProfile: form.firmwareProfile.value,
+            };
+            // プロファイルだけを変更した場合は、プロファイルのfirmwareVersionにする
+            if (form.firmwareProfile.value === current.firmwareProfile || form.firmwareVersion.value !== current.firmwareVersion) {
+                req.firmwareVersion = form.firmwareVersion.value;
+            }
+            const info = await api("POST", "/pjf/api/device/info", req);
+            await loadDevice();
+            log(`識別情報を変更しました: ${info.terminalId} ${info.firmwareVersion} ${info.firmwareProfile}`);
+        } catch (e) {
+            log(e.message, true);
+        }
+    });
+    $("device-reset").addEventListener("click", async () => {
+        await api("POST", "/pjf/api/device/info/reset");
+        await loadDevice();
+    });
+}
+
+// 定期的に端末、ネットワーク、キーパッド、電源、時計、音声、プロバイダ設定の状態を取得して表示する
+async function refresh() {
+    const terminals = await api("GET", "/pjf/api/terminals");
+    const t = terminals.find((t) => t.id === $("terminal").value) ?? terminals[0];
+    $("clients").textContent = `接続中のクライアント: ${t.clients}`;
+
+    const keypad = await api("GET", "/pjf/api/keypad");
+    const lines = $("keypad-display").children;
+    lines[0].textContent = keypad.display.firstLine;
+    lines[1].textContent = keypad.display.secondLine;
+    $("keypad-led").textContent = JSON.stringify(keypad.led);
+    $("keypad-connected").textContent = keypad.connected ? "接続中" : "未接続";
+
+    const network = await api("GET", "/pjf/api/network");
+    $("network-state").textContent = network.name + (network.profile ? ` (遅延 ${network.profile.latency}, 帯域 ${network.profile.bandwidth || "制限なし"})` : "") +
+        (network.pattern ? ` パターン: ${network.pattern.pattern.type}` : "");
+
+    const lifecycle = await api("GET", "/pjf/api/lifecycle");
+    $("power-state").textContent = lifecycle.poweredOn ? "ON" : "OFF";
+
+    const clock = await api("GET", "/pjf/api/clock");
+    $("clock-now").textContent = new Date(clock.now).toLocaleString() + (clock.virtual ? ` (${clock.offset})` : "");
+
+    const sound = await api("GET", "/pjf/api/sound");
+    const ul = $("sounds");
+    ul.textContent = "";
+    for (const s of sound.log.slice().reverse()) {
+        const li = document.createElement("li");
+        const time = new Date(s.startedAt).toLocaleTimeString();
+        if (s.error) {
+            li.className = "error";
+            li.textContent = `${time} ${s.error}`;
+        } else {
+            li.textContent = `${time} #${s.id} ${s.filePath}` + (s.stoppedAt ? " (停止)" : "");
+        }
+        ul.append(li);
+    }
+
+    const setting = await api("GET", "/pjf/api/providersetting");
+    $("provider-state").textContent = `${setting.path} ` + (setting.wellFormed ? "XMLとして正常" : `エラー ${setting.errors.length}件`);
+    const errors = $("provider-errors");
+    errors.textContent = "";
+    for (const e of setting.errors) {
+        const li = document.createElement("li");
+        li.className = "error";
+        li.textContent = `${e.line}行目: ${e.message}`;
+        errors.append(li);
+    }
+    const accesses = await api("GET", "/pjf/api/firmware/accesses");
+    const fw = $("firmware-accesses");
+    fw.textContent = "";
+    for (const a of accesses.slice().reverse()) {
+        const li = document.createElement("li");
+        li.className = "error";
+        const time = new Date(a.time).toLocaleTimeString();
+        li.textContent = `${time} ${a.api} ` + (a.kind === "missing" ? "(存在しないAPI)" : "(エラーを返すAPI)");
+        fw.append(li);
+    }
+
+    $("provider-values").textContent = setting.values ? JSON.stringify(setting.values, null, 2) : "";
+}
+
+async function poll() {
+    try {
+        await refresh();
+    } catch (e) {
+        $("clients").textContent = "サーバーに接続できません";
+    }
+    setTimeout(poll, POLL_INTERVAL);
+}
+
+async function main() {
+    setupTouchIdm();
+    setupNetwork();
+    setupKeypad();
+    setupDevice();
+    $("terminal").addEventListener("change", () => {
+        updateWebSQLLink();
+        refresh();
+        loadDevice();
+    });
+    for (const b of document.querySelectorAll("[data-lifecycle]")) {
+        b.addEventListener("click", async () => {
+            try {
+                const entry = await api("POST", "/pjf/api/lifecycle/" + b.dataset.lifecycle);
+                log(`${entry.type} (rollbackしたtransaction: ${entry.rolledBack})`);
+                await refresh();
+            } catch (e) {
+                log(e.message, true);
+            }
+        });
+    }
+    for (const b of document.querySelectorAll("[data-advance]")) {
+        b.addEventListener("click", async () => {
+            await api("POST", "/pjf/api/clock/advance", {duration: b.dataset.advance});
+            await refresh();
+        });
+    }
+    $("clock-reset").addEventListener("click", async () => {
+        await api("POST", "/pjf/api/clock/reset");
+        await refresh();
+    });
+    $("sounds-clear").addEventListener("click", async () => {
+        await api("DELETE", "/pjf/api/sound");
+        await refresh();
+    });
+    try {
+        await loadTerminals();
+        await loadCards();
+        await loadDevice();
+    } catch (e) {
+        log(e.message, true);
+    }
+    poll();
+}
+
+main();
@@ -0,0 +1,167 @@
+"use strict";
+// WebSQLのdatabaseの中身を確認する画面。/pjf/api/websql/databases などの管理用APIを使う。読み取り専用。
+
+// 1ページに表示する行数
+const PAGE_ROWS = 50;
+
+const $ = (id) => document.getElementById(id);
+
+// 操作画面から ?terminal=端末ID を付けて開く
+const terminal = new URLSearchParams(location.search).get("terminal");
+
+let database = null; // 選択中のdatabaseの名前
+let table = null; // 選択中のテーブル
+let offset = 0;
+
+async function api(method, path, params, body) {
+    const query = new URLSearchParams(params);
+    if (terminal) {
+        query.set("terminal", terminal);
+    }
+    const init = {method: method};
+    if (body !== undefined) {
+        init.headers = {"Content-Type": "application/json"};
+        init.body = JSON.stringify(body);
+    }
+    const resp = await fetch(path + "?" + query, init);
+    const json = await resp.json().catch(() => null);
+    if (!resp.ok) {
+        throw new Error(json?.error?.message ?? resp.statusText);
+    }
+    return json;
+}
+
+function listItem(label, onClick) {
+    const li = document.createElement("li");
+    const a = document.createElement("a");
+    a.href = "#";
+    a.textContent = label;
+    a.addEventListener("click", (e) => {
+        e.preventDefault();
+        onClick();
+    });
+    li.append(a);
+    return li;
+}
+
+function formatValue(v) {
+    if (v === null) {
+        return "NULL";
+    }
+    if (typeof v === "object" && "blob" in v) {
+        return `x'${v.blob}'`;
+    }
+    return String(v);
+}
+
+// QueryResultを表にする
+function renderRows(div, result) {
+    div.textContent = "";
+    const t = document.createElement("table");
+    const head = t.createTHead().insertRow();
+    for (const c of result.columns) {
+        const th = document.createElement("th");
+        th.textContent = c;
+        head.append(th);
+    }
+    const body = t.createTBody();
+    for (const row of result.rows) {
+        const tr = body.insertRow();
+        for (const v of row) {
+            const td = tr.insertCell();
+            td.textContent = formatValue(v);
+            if (v === null) {
+                td.className = "null";
+            }
+        }
+    }
+    div.append(t);
+}
+
+// 制限があれば「使用量 / 制限」にする
+function formatUsage(size, limit) {
+    return limit ? `${size} / ${limit} bytes` : `${size} bytes`;
+}
+
+async function loadDatabases() {
+    const list = await api("GET", "/pjf/api/websql/databases");
+    const usage = await api("GET", "/pjf/api/websql/usage");
+    const ul = $("databases");
+    ul.textContent = "";
+    if (list.length === 0) {
+        ul.textContent = "databaseはありません。";
+    }
+    for (const db of list) {
+        const limit = usage.databases.find((d) => d.name === db.name)?.limit;
+        ul.append(listItem(`${db.name} (${formatUsage(db.size, limit)})`, () => selectDatabase(db.name)));
+    }
+    $("usage-total").textContent = "合計: " + formatUsage(usage.total, usage.quota.total);
+}
+
+async function selectDatabase(name) {
+    const detail = await api("GET", "/pjf/api/websql/database", {name: name});
+    database = name;
+    $("database-name").textContent = name;
+    $("database-version").textContent = `version: "${detail.version}" ファイル: ${detail.file}`;
+    const ul = $("tables");
+    ul.textContent = "";
+    for (const t of detail.tables) {
+        ul.append(listItem(`${t.name} (${t.type === "view" ? "view, " : ""}${t.rows}行)`, () => selectTable(t.name)));
+    }
+    $("schema").textContent = [...detail.tables, ...detail.indexes, ...detail.triggers].map((item) => item.sql + ";").join("\n\n");
+    table = null;
+    $("table-name").textContent = "";
+    $("rows").textContent = "";
+    $("rows-range").textContent = "";
+}
+
+async function selectTable(name) {
+    table = name;
+    offset = 0;
+    await loadRows();
+}
+
+async function loadRows() {
+    const page = await api("GET", "/pjf/api/websql/database/rows", {name: database, table: table, offset: offset, limit: PAGE_ROWS});
+    $("table-name").textContent = table;
+    $("rows-range").textContent = page.total === 0 ? "0行" : `${offset + 1}〜${offset + page.rows.length}行目 / ${page.total}行`;
+    $("rows-prev").disabled = offset === 0;
+    $("rows-next").disabled = !page.truncated;
+    renderRows($("rows"), page);
+}
+
+function setup() {
+    $("terminal-id").textContent = terminal ? `端末 ${terminal}` : "";
+    $("databases-reload").addEventListener("click", loadDatabases);
+    $("rows-prev").addEventListener("click", () => {
+        offset = Math.max(0, offset - PAGE_ROWS);
+        loadRows();
+    });
+    $("rows-next").addEventListener("click", () => {
+        offset += PAGE_ROWS;
+        loadRows();
+    });
+    $("query").addEventListener("submit", async (e) => {
+        e.preventDefault();
+        $("query-error").textContent = "";
+        $("query-result").textContent = "";
+        if (!database) {
+            $("query-error").textContent = "databaseを選択してください。";
+            return;
+        }
+        try {
+            const result = await api("POST", "/pjf/api/websql/database/query", {name: database}, {sql: e.target.sql.value});
+            renderRows($("query-result"), result);
+            if (result.truncated) {
+                $("query-error").textContent = `最初の${result.rows.length}行だけを表示しています。`;
+            }
+        } catch (err) {
+            $("query-error").textContent = err.message;
+        }
+    });
+    loadDatabases().catch((e) => {
+        $("databases").textContent = e.message;
+    });
+}
+
+setup();
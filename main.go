@@ -7,57 +7,173 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"pro3sim/console"
 	"pro3sim/prooperate"
 	"pro3sim/websql"
 	"strings"
+	"time"
 )
 
+type config struct {
+	ctsDir         string
+	pjfDir         string
+	port           int
+	providerPath   string
+	dbDir          string
+	fileOperateDir string
+	simDir         string
+	scenarioPath   string
+	terminals      string
+	httpListenPort int
+	httpTimeout    time.Duration
+	device         prooperate.DeviceInfo
+	firmwarePath   string
+	proxy          string
+	forwardProxy   int
+	mockDir        string
+	resetState     bool
+	fixtureDir     string
+	quota          websql.Quota
+}
+
 func main() {
-	flagCtsDir := flag.String("ctsDir", "cts", "コンテンツセットのトップディレクトリ(index.htmlが存在するディレクトリ)。")
-	flagPort := flag.Int("port", 8889, "サーバーのhttpポート番号。")
-	flagPjfDir := flag.String("pjfDir", "pjf", "サーバーの/pjf/へのアクセス時に参照するディレクトリ。")
-	flagDbDir := flag.String("dbDir", "db", "websqlのデータベースファイルを保存するディレクトリ。")
-	flagProviderSetting := flag.String("providersetting", "providersetting.xml", "プロバイダ設定ファイルのパス")
-	flagFileOperateDir := flag.String("fileOperateDir", "fileOperateDir", "ProFileOperateのAPIで読み書きするディレクトリ")
+	var c config
+	flag.StringVar(&c.ctsDir, "ctsDir", "cts", "コンテンツセットのトップディレクトリ(index.htmlが存在するディレクトリ)。")
+	flag.IntVar(&c.port, "port", 8889, "サーバーのhttpポート番号。")
+	flag.StringVar(&c.pjfDir, "pjfDir", "pjf", "サーバーの/pjf/へのアクセス時に参照するディレクトリ。")
+	flag.StringVar(&c.dbDir, "dbDir", "db", "websqlのデータベースファイルを保存するディレクトリ。")
+	flag.StringVar(&c.providerPath, "providersetting", "providersetting.xml", "プロバイダ設定ファイルのパス")
+	flag.StringVar(&c.fileOperateDir, "fileOperateDir", "fileOperateDir", "ProFileOperateのAPIで読み書きするディレクトリ")
+	flag.StringVar(&c.simDir, "simDir", "sim", "仮想カードなど、シミュレーターのデータを保存するディレクトリ")
+	flag.StringVar(&c.scenarioPath, "scenario", "", "起動後、ブラウザが接続したら実行するシナリオファイルのパス")
+	flag.StringVar(&c.terminals, "terminals", "00000000", "シミュレートする端末の端末ID。複数の端末をシミュレートする場合はカンマで区切る。")
+	flag.IntVar(&c.httpListenPort, "httpListenPort", 0, "startHttpRequestListen()で外部からのHTTPリクエストを受けるポート番号。複数の端末をシミュレートする場合は、端末ごとに1つずつ増やしたポートを使う。0なら受けない。")
+	flag.DurationVar(&c.httpTimeout, "httpResponseTimeout", 30*time.Second, "外部からのHTTPリクエストに対して、sendHttpResponse()を待つ時間")
+	flag.StringVar(&c.device.FirmwareVersion, "firmwareVersion", "5.00r000000", "getFirmwareVersion()が返すファームウェアのバージョン")
+	flag.StringVar(&c.device.ContentsSetVersion, "contentsSetVersion", "000", "getContentsSetVersion()が返すコンテンツセットのバージョン")
+	flag.StringVar(&c.device.ProductType, "productType", "pro3", "productTypeの値")
+	flag.StringVar(&c.firmwarePath, "firmwareProfiles", "", "ファームウェアプロファイルを定義したJSONファイルのパス")
+	flag.StringVar(&c.device.FirmwareProfile, "firmwareProfile", "", "使用するファームウェアプロファイルの名前。指定しなければ全てのAPIが使える")
+	flag.StringVar(&c.proxy, "proxy", "", "/pjf/proxy/{名前}/ 以下へのリクエストの転送先。名前=URL の形式で、複数指定する場合はカンマで区切る。")
+	flag.IntVar(&c.forwardProxy, "forwardProxyPort", 0, "ネットワーク状態に従って通信を中継するフォワードプロキシのポート番号。複数の端末をシミュレートする場合は、端末ごとに1つずつ増やしたポートを使う。0なら起動しない。")
+	flag.StringVar(&c.mockDir, "mockDir", "mock", "/pjf/mock/ 以下へのリクエストに返すモックの、routes.jsonとファイルを置くディレクトリ")
+	flag.BoolVar(&c.resetState, "resetState", false, "保存した端末の状態(ネットワーク、キーパッドなど)を読み込まずに、初期状態から始める")
+	flag.StringVar(&c.fixtureDir, "fixtureDir", "fixtures", "WebSQLのdatabaseを作る時に入れるフィクスチャの、fixtures.jsonとファイルを置くディレクトリ")
+	flag.Int64Var(&c.quota.Database, "websqlDatabaseQuota", 0, "WebSQLの1つのdatabaseの最大サイズ(byte)。0なら制限しない")
+	flag.Int64Var(&c.quota.Total, "websqlTotalQuota", 0, "WebSQLの全てのdatabaseの合計の最大サイズ(byte)。端末ごとに制限する。0なら制限しない")
+	flag.BoolVar(&c.quota.EstimatedSize, "websqlEstimatedSizeQuota", false, "openDatabase()のestimatedSizeを、databaseの最大サイズにする")
 	flag.Parse()
 
-	err := run(*flagCtsDir, *flagPjfDir, *flagPort, *flagProviderSetting, *flagDbDir, *flagFileOperateDir)
+	err := run(&c)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctsDir, pjfDir string, port int, providerPath string, dbDir string, fileOperateDir string) error {
+func run(c *config) error {
 
-	st, err := os.Stat(ctsDir)
+	st, err := os.Stat(c.ctsDir)
 	if err != nil {
 		return fmt.Errorf("コンテンツセットのトップディレクトリをオープンできません: %v", err)
 	}
 	if !st.IsDir() {
-		return fmt.Errorf("コンテンツセットのトップディレクトリがディレクトリではありません: %v", ctsDir)
+		return fmt.Errorf("コンテンツセットのトップディレクトリがディレクトリではありません: %v", c.ctsDir)
 	}
 
-	st, err = os.Stat(filepath.Join(pjfDir, "prooperate.js"))
+	st, err = os.Stat(filepath.Join(c.pjfDir, "prooperate.js"))
 	if err != nil {
 		return fmt.Errorf("pjfディレクトリにprooperate.jsが存在しません: %v", err)
 	}
 
 	m := mux.NewRouter()
-	websql.SetDBDir(dbDir)
+	websql.SetDBDir(c.dbDir)
+	if err := websql.SetQuota(c.quota); err != nil {
+		return err
+	}
+	websql.SetBeginHook(websql.QuotaBeginHook)
 	websql.Setup(m, nil)
-	prooperate.Setup(m, dbDir, fileOperateDir)
+	terminalIds := strings.Split(c.terminals, ",")
+	if err := prooperate.Setup(m, terminalIds, c.ctsDir, c.dbDir, c.fileOperateDir, c.simDir); err != nil {
+		return fmt.Errorf("端末の設定が不正です: %v", err)
+	}
+	if c.firmwarePath != "" {
+		if err := prooperate.LoadFirmwareProfiles(c.firmwarePath); err != nil {
+			return fmt.Errorf("ファームウェアプロファイルを読み込めません: %v", err)
+		}
+	}
+	if err := prooperate.SetDefaultDeviceInfo(c.device); err != nil {
+		return fmt.Errorf("端末の識別情報が不正です: %v", err)
+	}
+	proxyTargets := map[string]string{}
+	if c.proxy != "" {
+		for _, s := range strings.Split(c.proxy, ",") {
+			name, target, _ := strings.Cut(s, "=")
+			proxyTargets[name] = target
+		}
+	}
+	if err := prooperate.SetProxyTargets(proxyTargets); err != nil {
+		return fmt.Errorf("プロキシの設定が不正です: %v", err)
+	}
+	if err := prooperate.RestoreState(c.resetState); err != nil {
+		return fmt.Errorf("端末の状態を読み込めません: %v", err)
+	}
+	if n, err := websql.SetFixtureDir(c.fixtureDir); err != nil {
+		return fmt.Errorf("フィクスチャを読み込めません: %v", err)
+	} else if n > 0 {
+		fmt.Printf("WebSQLのフィクスチャを%v件読み込みました。\n", n)
+	}
+	if err := prooperate.SetMockDir(c.mockDir); err != nil {
+		fmt.Printf("モックのルートを読み込めません: %v\n", err)
+	}
+	for name, target := range proxyTargets {
+		fmt.Printf("/pjf/proxy/%v/ へのリクエストを %v に転送します。\n", name, target)
+	}
+	// /t/{端末ID}/ 以下へのアクセスは、その端末へのアクセスとして扱う。
+	m.PathPrefix("/t/{terminal}/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveTerminal(w, r, m)
+	})
 	m.PathPrefix("/pjf/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		servePjfFile(w, r, pjfDir)
+		servePjfFile(w, r, c.pjfDir)
 	})
+	// テスター向けの操作画面
+	console.Setup(m)
+	prooperate.WatchProviderSetting(c.providerPath)
 	m.HandleFunc("/providersetting.xml", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, providerPath)
+		http.ServeFile(w, r, c.providerPath)
 	})
-	m.PathPrefix("/").Handler(http.FileServer(http.Dir(ctsDir)))
+	m.PathPrefix("/").Handler(http.FileServer(http.Dir(c.ctsDir)))
 
-	fmt.Printf("ポート%vでサーバーを開始します。ブラウザで http://localhost:%v/ にアクセスしてください。\n", port, port)
+	if c.httpListenPort != 0 {
+		if err := prooperate.StartHttpRequestListeners(c.httpListenPort, c.httpTimeout); err != nil {
+			return fmt.Errorf("HTTPリクエストを受けるサーバーを開始できません: %v", err)
+		}
+		fmt.Printf("ポート%vで外部からのHTTPリクエストを受けます。\n", c.httpListenPort)
+	}
+
+	if c.forwardProxy != 0 {
+		if err := prooperate.StartForwardProxies(c.forwardProxy); err != nil {
+			return fmt.Errorf("フォワードプロキシを開始できません: %v", err)
+		}
+		fmt.Printf("ポート%vでフォワードプロキシを開始します。\n", c.forwardProxy)
+	}
+
+	if c.scenarioPath != "" {
+		if err := prooperate.RunScenarioFile(c.scenarioPath); err != nil {
+			return fmt.Errorf("シナリオファイルを読み込めません: %v", err)
+		}
+		fmt.Printf("ブラウザが接続したらシナリオ %v を実行します。\n", c.scenarioPath)
+	}
 
-	err = http.ListenAndServe(fmt.Sprintf(":%v", port), m)
+	fmt.Printf("ポート%vでサーバーを開始します。ブラウザで http://localhost:%v/ にアクセスしてください。\n", c.port, c.port)
+	fmt.Printf("操作画面は http://localhost:%v/sim/ です。\n", c.port)
+	if len(terminalIds) > 1 {
+		for _, id := range terminalIds {
+			fmt.Printf("端末%vは http://localhost:%v/t/%v/ でアクセスできます。\n", id, c.port, id)
+		}
+	}
+
+	err = http.ListenAndServe(fmt.Sprintf(":%v", c.port), m)
 	if err != nil {
 		return fmt.Errorf("httpサーバーを開始できません: %v", err)
 	}
@@ -78,3 +194,21 @@ func servePjfFile(w http.ResponseWriter, r *http.Request, pjfDir string) {
 	}
 	http.ServeFile(w, r, path)
 }
+
+// /t/{端末ID}/ を取り除き、クエリにterminalを付けて処理する
+func serveTerminal(w http.ResponseWriter, r *http.Request, m *mux.Router) {
+	id := mux.Vars(r)["terminal"]
+	if !prooperate.HasTerminal(id) {
+		http.NotFound(w, r)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, "/t/"+id)
+	r2.URL.RawPath = ""
+	q := r2.URL.Query()
+	if q.Get("terminal") == "" {
+		q.Set("terminal", id)
+		r2.URL.RawQuery = q.Encode()
+	}
+	m.ServeHTTP(w, r2)
+}
@@ -0,0 +1,16 @@
+// prooperate.js、profileoperate.js、websql.jsで共通に使う関数。
+// 各ファイルは、この関数が定義されていなければ、このファイルを同期で読み込んで使う。
+
+// /pjf/api/のURLに、このページの端末IDを付ける。
+// /t/{端末ID}/ 以下のページ、または ?terminal={端末ID} を付けたページでは、その端末として動作する。
+function pjfApiUrl(path) {
+    let terminal = new URLSearchParams(location.search).get("terminal");
+    const m = location.pathname.match(/^\/t\/([^\/]+)\//);
+    if (m) {
+        terminal = decodeURIComponent(m[1]);
+    }
+    if (!terminal) {
+        return path;
+    }
+    return path + (path.includes("?") ? "&" : "?") + "terminal=" + encodeURIComponent(terminal);
+}
@@ -2,6 +2,14 @@ function ProFileOperate() {
     return ProFileOperateImpl.getInstance();
 }
 
+// pjfApiUrl()はpjfapi.jsで定義する。まだ読み込まれていなければ、同期で読み込む。
+if (typeof pjfApiUrl !== "function") {
+    const xhr = new XMLHttpRequest();
+    xhr.open("GET", "/pjf/pjfapi.js", false);
+    xhr.send();
+    (0, eval)(xhr.responseText);
+}
+
 class ProFileOperateImpl {
     constructor() {
         this.write = this.write.bind(this);
@@ -22,7 +30,7 @@ class ProFileOperateImpl {
             isAppend: param.isAppend ?? false,
         }
         const xhr = new XMLHttpRequest();
-        xhr.open("POST", "/pjf/api/writeFile", false);
+        xhr.open("POST", pjfApiUrl("/pjf/api/writeFile"), false);
         xhr.setRequestHeader("Content-Type", "application/json");
         xhr.send(JSON.stringify(req));
 
@@ -34,7 +42,7 @@ class ProFileOperateImpl {
             fileName: param.fileName,
         }
         const xhr = new XMLHttpRequest();
-        xhr.open("POST", "/pjf/api/readFile", false);
+        xhr.open("POST", pjfApiUrl("/pjf/api/readFile"), false);
         xhr.setRequestHeader("Content-Type", "application/json");
         xhr.send(JSON.stringify(req));
 
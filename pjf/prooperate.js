@@ -2,9 +2,94 @@ function ProOperate() {
     return ProOperateImpl.getInstance();
 }
 
+// pjfApiUrl()はpjfapi.jsで定義する。まだ読み込まれていなければ、同期で読み込む。
+if (typeof pjfApiUrl !== "function") {
+    const xhr = new XMLHttpRequest();
+    xhr.open("GET", "/pjf/pjfapi.js", false);
+    xhr.send();
+    (0, eval)(xhr.responseText);
+}
+
+// シミュレーターの時計。setDate()や/pjf/api/clockで設定した時刻を、new Date()とDate.now()が返すようにする。
+const pro3simClock = (() => {
+    const RealDate = Date;
+    let state = null; // 時刻が設定されていなければnull
+
+    function now() {
+        if (!state) {
+            return RealDate.now();
+        }
+        if (state.frozen) {
+            return state.virtual;
+        }
+        return state.virtual + (RealDate.now() - state.real) * state.speed;
+    }
+
+    function SimDate(...args) {
+        if (!new.target) {
+            return new RealDate(now()).toString();
+        }
+        return args.length === 0 ? new RealDate(now()) : new RealDate(...args);
+    }
+    SimDate.prototype = RealDate.prototype;
+    SimDate.now = now;
+    SimDate.parse = RealDate.parse;
+    SimDate.UTC = RealDate.UTC;
+    window.Date = SimDate;
+
+    // サーバーの時計の状態(/pjf/api/clockのレスポンス)に合わせる
+    function sync(s) {
+        state = s["virtual"] ? {
+            virtual: RealDate.parse(s["now"]),
+            real: RealDate.now(),
+            speed: s["speed"],
+            frozen: s["frozen"],
+        } : null;
+    }
+
+    const xhr = new XMLHttpRequest();
+    xhr.open("GET", pjfApiUrl("/pjf/api/clock"), false);
+    xhr.send(null);
+    if (xhr.status === 200) {
+        sync(JSON.parse(xhr.responseText));
+    }
+    return {sync: sync};
+})();
+
+// startEventListenのeventCodeを、getNetworkStat()の値にする。不明なeventCodeならcurrentを返す。
+function pro3simNetworkStat(eventCode, current) {
+    switch (eventCode) {
+        case 0: // disconnected
+            return 0;
+        case 1: // mobile
+            return 1;
+        case 2: // LAN
+            return 2;
+        case 6: // WLAN
+            return 3;
+    }
+    return current;
+}
+
+// シャットダウン、電源断のあとは、電源OFFの画面でページを覆う
+function pro3simShowPowerOff() {
+    if (!document.body) {
+        document.addEventListener("DOMContentLoaded", pro3simShowPowerOff);
+        return;
+    }
+    if (document.getElementById("pro3sim-power-off")) {
+        return;
+    }
+    const div = document.createElement("div");
+    div.id = "pro3sim-power-off";
+    div.style.cssText = "position:fixed; inset:0; z-index:2147483647; background:#000; color:#666;" +
+        "display:flex; align-items:center; justify-content:center; font-size:24px;";
+    div.textContent = "電源OFF";
+    document.body.append(div);
+}
+
 class ProOperateImpl {
     constructor() {
-        this.productType = "pro3";
         this.startKeypadListen = this.startKeypadListen.bind(this);
         this.stopKeypadListen = this.stopKeypadListen.bind(this);
         this.setKeypadDisplay = this.setKeypadDisplay.bind(this);
@@ -33,12 +118,30 @@ class ProOperateImpl {
         this.getDisplayBrightness = this.getDisplayBrightness.bind(this);
         this.clearSettingPassword = this.clearSettingPassword.bind(this);
 
-        this.networkStat = 2; // LAN
+        const deviceInfo = this.getDeviceInfo();
+        this.productType = deviceInfo?.productType ?? "pro3";
+        this.firmwareOverridden = [];
+        this.applyFirmwareProfile(deviceInfo);
+        // ネットワークなどの状態はサーバーで保持し、リロードしても変わらない。
+        // getNetworkStat()とgetDisplayBrightness()は、ここで読み込んでeventNotificationで更新する値を返す。
+        this.networkStat = 2;
+        this.brightness = 0;
+        this.applyState(this.getState());
         this.startCommunicationOnEvent = undefined;
         this.startEventListenOnEvent = undefined;
         this.startKeypadListenOnEvent = undefined;
+        this.startHttpRequestListenOnEvent = undefined;
+        this.lastHttpRequestId = undefined;
 
         this.connectWebSocket();
+
+        // 電源OFFの状態でページを開いた場合
+        const xhr = new XMLHttpRequest();
+        xhr.open("GET", pjfApiUrl("/pjf/api/lifecycle"), false);
+        xhr.send(null);
+        if (xhr.status === 200 && !JSON.parse(xhr.responseText)["poweredOn"]) {
+            pro3simShowPowerOff();
+        }
     }
 
 
@@ -50,11 +153,16 @@ class ProOperateImpl {
     }
 
     connectWebSocket() {
-        const webSocket = new WebSocket(`ws://${location.host}/pjf/api/eventNotification`);
+        const webSocket = new WebSocket(`ws://${location.host}` + pjfApiUrl("/pjf/api/eventNotification"));
         webSocket.onopen = (event) => {
             window.addEventListener("beforeunload", (event) => {
                 webSocket.close();
             });
+            // 接続が切れている間の変更を取り込む
+            fetch(pjfApiUrl("/pjf/api/state"))
+                .then((res) => res.ok ? res.json() : undefined)
+                .then((state) => this.applyState(state))
+                .catch(() => {});
         };
         webSocket.onmessage = (event) => {
             this.handleEvent(event.data);
@@ -88,23 +196,37 @@ class ProOperateImpl {
                 }
                 break;
             case "startEventListen":
+                this.networkStat = pro3simNetworkStat(json["eventCode"], this.networkStat);
                 if (this.startEventListenOnEvent) {
-                    let eventCode = json["eventCode"];
-                    switch (eventCode) {
-                        case 0: // disconnected
-                            this.networkStat = 0;
-                            break;
-                        case 1: // mobile
-                            this.networkStat = 1;
-                            break;
-                        case 2: // LAN
-                            this.networkStat = 2;
-                            break;
-                        case 6: // WLAN
-                            this.networkStat = 3;
-                            break;
-                    }
-                    this.startEventListenOnEvent(eventCode);
+                    this.startEventListenOnEvent(json["eventCode"]);
+                }
+                break;
+            case "lifecycle":
+                switch (json["responseObject"]["type"]) {
+                    case "reboot":
+                    case "powerOn":
+                        location.reload();
+                        break;
+                    case "shutdown":
+                    case "powerCut":
+                        pro3simShowPowerOff();
+                        break;
+                }
+                break;
+            case "clock":
+                pro3simClock.sync(json["responseObject"]);
+                break;
+            case "brightness":
+                this.brightness = json["responseObject"]["brightness"];
+                break;
+            case "device":
+                this.productType = json["responseObject"]["productType"];
+                this.applyFirmwareProfile(json["responseObject"]);
+                break;
+            case "startHttpRequestListen":
+                if (this.startHttpRequestListenOnEvent) {
+                    this.lastHttpRequestId = json["responseObject"]["requestId"];
+                    this.startHttpRequestListenOnEvent(json["eventCode"], json["responseObject"]);
                 }
                 break;
         }
@@ -123,34 +245,76 @@ class ProOperateImpl {
         return 0;
     }
 
+    // キーパッドの状態はサーバーで保持する。/pjf/api/keypad で確認できる。
     setKeypadDisplay(param) {
+        const req = {
+            firstLine: "" + (param?.firstLine ?? ""),
+            secondLine: "" + (param?.secondLine ?? ""),
+        };
+        this.postKeypad("display", req);
         return 0;
     }
 
     getKeypadDisplay() {
+        const keypad = this.getKeypad();
         return {
-            firstList: "",
-            secondLine: "",
+            firstLine: keypad ? keypad["display"]["firstLine"] : "",
+            secondLine: keypad ? keypad["display"]["secondLine"] : "",
         };
     }
 
     setKeypadLed(param) {
+        this.postKeypad("led", param ?? null);
         return 0;
     }
 
     getKeypadLed() {
-        return "000000";
+        const keypad = this.getKeypad();
+        return keypad ? keypad["led"] : "000000";
     }
 
     getKeypadConnected() {
-        return 1; // 接続中
+        const keypad = this.getKeypad();
+        return !keypad || keypad["connected"] ? 1 : 0; // 1:接続中, 0:未接続
     }
 
+    getKeypad() {
+        const xhr = new XMLHttpRequest();
+        xhr.open("GET", pjfApiUrl("/pjf/api/keypad"), false);
+        xhr.send(null);
+        if (xhr.status !== 200) {
+            return undefined;
+        }
+        return JSON.parse(xhr.responseText);
+    }
+
+    postKeypad(name, req) {
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/keypad/" + name), false);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.send(JSON.stringify(req));
+    }
+
+    // 再生した音声はサーバーで記録する。/pjf/api/sound で確認できる。
     playSound(param) {
-        return 9999; // 音声のID
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/sound/play"), false);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.send(JSON.stringify(param instanceof Object ? param : {}));
+        if (xhr.status !== 200) {
+            console.error("playSound failed: " + xhr.responseText);
+            return -1;
+        }
+        return JSON.parse(xhr.responseText)["id"]; // 音声のID
     }
 
     stopSound(param) {
+        // paramには音声のIDか、{id: 音声のID}を指定する。省略すると全ての音声を停止する。
+        let id = param instanceof Object ? param["id"] : param;
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/sound/stop"), false);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.send(JSON.stringify({id: Number(id) || 0}));
         return 0;
     }
 
@@ -158,11 +322,19 @@ class ProOperateImpl {
         if (param instanceof Object && param["onEvent"] instanceof Function) {
             this.startCommunicationOnEvent = param["onEvent"];
         }
+        // FeliCaの読み書きをサーバーでシミュレートするため、paramを送っておく。(onEventはJSONに含まれない)
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/communication/start"), false);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.send(JSON.stringify(param instanceof Object ? param : {}));
         return 0;
     }
 
     stopCommunication() {
         this.startCommunicationOnEvent = undefined;
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/communication/stop"), false);
+        xhr.send(null);
         return 0;
     }
 
@@ -182,54 +354,167 @@ class ProOperateImpl {
         return this.networkStat;
     }
 
+    applyState(state) {
+        if (!state) {
+            return;
+        }
+        this.networkStat = pro3simNetworkStat(state.network, this.networkStat);
+        if (typeof state.brightness === "number") {
+            this.brightness = state.brightness;
+        }
+    }
+
+    getState() {
+        const xhr = new XMLHttpRequest();
+        xhr.open("GET", pjfApiUrl("/pjf/api/state"), false);
+        xhr.send(null);
+        if (xhr.status !== 200) {
+            return undefined;
+        }
+        return JSON.parse(xhr.responseText);
+    }
+
+    // 外部からのHTTPリクエストは、サーバーの-httpListenPortで受けてeventNotificationで送られてくる。
     startHttpRequestListen(param) {
+        if (param instanceof Object && param["onEvent"] instanceof Function) {
+            this.startHttpRequestListenOnEvent = param["onEvent"];
+        }
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/httpRequestListen/start"), false);
+        xhr.send(null);
         return 0;
     }
 
     stopHttpRequestListen() {
+        this.startHttpRequestListenOnEvent = undefined;
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/httpRequestListen/stop"), false);
+        xhr.send(null);
         return 0;
     }
 
+    // paramは {requestId, statusCode, contentType, headers, body}。
+    // requestIdを省略すると、最後に受けたリクエストへのレスポンスになる。
     sendHttpResponse(param) {
-        return 0;
+        const req = Object.assign({requestId: this.lastHttpRequestId}, param instanceof Object ? param : {});
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/httpResponse"), false);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.send(JSON.stringify(req));
+        return xhr.status === 200 ? 0 : -1;
+    }
+
+    // 端末の識別情報はサーバーで保持する。/pjf/api/device/info で変更できる。
+    getDeviceInfo() {
+        const xhr = new XMLHttpRequest();
+        xhr.open("GET", pjfApiUrl("/pjf/api/device/info"), false);
+        xhr.send(null);
+        if (xhr.status === 200) {
+            return JSON.parse(xhr.responseText);
+        }
+        return undefined;
+    }
+
+    // ファームウェアプロファイル(/pjf/api/device/info のmissingApis,errorApis)に合わせて、
+    // 存在しないAPIはundefinedにし、エラーを返すAPIは常にその値を返すようにする。
+    // どちらも使われたらサーバーに記録する。
+    applyFirmwareProfile(info) {
+        for (const name of this.firmwareOverridden) {
+            delete this[name];
+            this[name] = ProOperateImpl.prototype[name].bind(this);
+        }
+        this.firmwareOverridden = [];
+        for (const name of info?.missingApis ?? []) {
+            Object.defineProperty(this, name, {
+                configurable: true,
+                enumerable: true,
+                get: () => {
+                    this.reportFirmwareAccess(name, "missing");
+                    return undefined;
+                },
+            });
+            this.firmwareOverridden.push(name);
+        }
+        for (const [name, code] of Object.entries(info?.errorApis ?? {})) {
+            this[name] = () => {
+                this.reportFirmwareAccess(name, "error");
+                return code;
+            };
+            this.firmwareOverridden.push(name);
+        }
+    }
+
+    reportFirmwareAccess(name, kind) {
+        fetch(pjfApiUrl("/pjf/api/firmware/accesses"), {
+            method: "POST",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify({api: name, kind: kind}),
+        }).catch(() => {
+        });
     }
 
     getTerminalID() {
-        return "00000000"
+        return this.getDeviceInfo()?.terminalId ?? "00000000";
     }
 
     getFirmwareVersion() {
-        return "5.00r000000"
+        return this.getDeviceInfo()?.firmwareVersion ?? "5.00r000000";
     }
 
     getContentsSetVersion() {
-        return "000"
+        return this.getDeviceInfo()?.contentsSetVersion ?? "000";
     }
 
     removeAllWebSQLDB() {
         const xhr = new XMLHttpRequest();
-        xhr.open("GET", "/pjf/api/removeAllWebSQLDB", false);
+        xhr.open("GET", pjfApiUrl("/pjf/api/removeAllWebSQLDB"), false);
         xhr.send(null);
     }
 
     setDate(year, month, day, hour, minute, second) {
+        const date = new Date(year, month - 1, day, hour, minute, second);
+        if (isNaN(date.getTime())) {
+            return -1;
+        }
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", pjfApiUrl("/pjf/api/clock"), false);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.send(JSON.stringify({time: date.toISOString()}));
+        if (xhr.status !== 200) {
+            return -1;
+        }
+        pro3simClock.sync(JSON.parse(xhr.responseText));
         return 0;
     }
 
+    // サーバーは実行中のtransactionが終わるのを待つので、syncで呼ぶとページが止まってしまう。asyncで呼ぶ。
     reboot() {
+        fetch(pjfApiUrl("/pjf/api/lifecycle/reboot?source=prooperate"), {method: "POST"});
         return 0;
     }
 
     shutdown() {
+        fetch(pjfApiUrl("/pjf/api/lifecycle/shutdown?source=prooperate"), {method: "POST"});
         return 0;
     }
 
+    // 画面の明るさはサーバーで保持する。引数は数値か、{brightness: 数値}。
     setDisplayBrightness(param) {
+        const brightness = typeof param === "number" ? param : param?.brightness;
+        if (typeof brightness !== "number") {
+            return -1;
+        }
+        this.brightness = brightness;
+        fetch(pjfApiUrl("/pjf/api/brightness"), {
+            method: "POST",
+            headers: {"Content-Type": "application/json"},
+            body: JSON.stringify(brightness),
+        });
         return 0;
     }
 
     getDisplayBrightness() {
-        return 0;
+        return this.brightness;
     }
 
     clearSettingPassword() {
@@ -2,6 +2,15 @@
 // WebSQL互換API
 // web APIと連携して、WebSQLの機能を提供する。
 // https://www.w3.org/TR/webdatabase/
+
+// pjfApiUrl()はpjfapi.jsで定義する。まだ読み込まれていなければ、同期で読み込む。
+if (typeof pjfApiUrl !== "function") {
+    const xhr = new XMLHttpRequest();
+    xhr.open("GET", "/pjf/pjfapi.js", false);
+    xhr.send();
+    (0, eval)(xhr.responseText);
+}
+
 class DB {
     // DBをオープンする。
     constructor(arglen, name, version, displayName, estimatedSize, creationCallback) {
@@ -11,8 +20,6 @@ class DB {
         // その挙動に合わせるためのフラグ。
         this.changeVersionForceFail = false;
         this.ws = null;
-        // XXX webkitのWebSQLと違い、write操作(insert,updateなど)も成功する。
-        this.readTransaction = this.transaction;
         // 引数チェック
         if (arglen < 4) {
             throw TypeError("Failed to execute 'openDatabase' on 'Window': 4 arguments required, but only " + arglen + " present.");
@@ -116,9 +123,26 @@ class DB {
         if (onSuccess != null && typeof onSuccess !== 'function') {
             throw new TypeError("Failed to execute 'transaction' on 'Window': The callback provided as parameter 3 is not a function.");
         }
-        this.transactionAsync(null, transactionCb, onError, onSuccess);
+        this.transactionAsync(null, transactionCb, onError, onSuccess, false);
+    }
+    // 読み取り専用のtransaction。write操作(insert,updateなど)は、webkitと同様にSYNTAX_ERRになる。
+    readTransaction(transactionCb, onError, onSuccess) {
+        // 引数チェック
+        if (arguments.length < 1) {
+            throw TypeError("Failed to execute 'readTransaction' on 'Database': 1 argument required, but only 0 present.");
+        }
+        if (typeof transactionCb !== "function") {
+            throw new TypeError("Failed to execute 'readTransaction' on 'Database': The callback provided as parameter 1 is not a function.");
+        }
+        if (onError != null && typeof onError !== 'function') {
+            throw new TypeError("Failed to execute 'readTransaction' on 'Database': The callback provided as parameter 2 is not a function.");
+        }
+        if (onSuccess != null && typeof onSuccess !== 'function') {
+            throw new TypeError("Failed to execute 'readTransaction' on 'Database': The callback provided as parameter 3 is not a function.");
+        }
+        this.transactionAsync(null, transactionCb, onError, onSuccess, true);
     }
-    transactionAsync(changeVersion, transactionCb, onError, onSuccess) {
+    transactionAsync(changeVersion, transactionCb, onError, onSuccess, readOnly) {
         this.schedule(async () => {
             let ws = null;
             try {
@@ -126,7 +150,7 @@ class DB {
                 if (ws == null) {
                     throw new Error("cannot begin transaction");
                 }
-                await ws.begin();
+                await ws.begin(readOnly);
                 if (changeVersion != null) {
                     await ws.changeVersion(changeVersion[0], changeVersion[1]);
                 }
@@ -236,7 +260,7 @@ class DB {
             });
             return;
         }
-        this.transactionAsync([oldVersion, newVersion], cb, onError, onSuccess);
+        this.transactionAsync([oldVersion, newVersion], cb, onError, onSuccess, false);
     }
     /**
      * sync呼び出しでserverにアクセスする
@@ -244,7 +268,7 @@ class DB {
      */
     accessSync(path, reqBody) {
         let xhr = new XMLHttpRequest();
-        xhr.open("POST", path, false);
+        xhr.open("POST", pjfApiUrl(path), false);
         xhr.setRequestHeader("Content-Type", "application/json");
         //xhr.timeout = 1000; // int ms
         try {
@@ -253,6 +277,10 @@ class DB {
         catch (e) {
             return new Error("AJAX failed " + e); // TODO exceptionにする？
         }
+        if (xhr.status == 404) {
+            // 存在しない端末が指定された
+            return DB.convertResponse(xhr.response);
+        }
         if (xhr.status != 200) {
             // TODO
             return new Error("server down"); // TODO exceptionにする？
@@ -263,7 +291,7 @@ class DB {
      * async呼び出しでserverにアクセスする
      */
     async accessAsync(path, reqBody) {
-        let resp = await fetch(path, {
+        let resp = await fetch(pjfApiUrl(path), {
             method: "POST",
             headers: {
                 "Content-Type": "application/json"
@@ -312,7 +340,7 @@ class WsConn {
     }
     static async connect(dbId) {
         return new Promise(function (resolve, reject) {
-            const webSocket = new WebSocket(`ws://${location.host}/pjf/api/websql/transaction?dbId=` + dbId);
+            const webSocket = new WebSocket(`ws://${location.host}` + pjfApiUrl("/pjf/api/websql/transaction?dbId=" + dbId));
             webSocket.onopen = (event) => {
                 resolve(new WsConn(webSocket));
             };
@@ -366,9 +394,10 @@ class WsConn {
             this.ws.send(JSON.stringify(msg));
         });
     }
-    async begin() {
+    async begin(readOnly) {
         return this.sendMessage({
             "cmd": "begin",
+            "readOnly": readOnly,
         });
     }
     async changeVersion(oldVersion, newVersion) {
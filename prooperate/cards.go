@@ -0,0 +1,272 @@
+package prooperate
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 仮想カード。
+// 名前を付けて登録しておき、/pjf/api/cards/{name}/touch でタッチを発生させる。
+type Card struct {
+	Name        string `json:"name"`
+	Label       string `json:"label"`
+	Idm         string `json:"idm"`
+	Category    int    `json:"category"`
+	ParamResult int    `json:"paramResult"`
+}
+
+const cardsFileName = "cards.json"
+
+var cards = map[string]*Card{}
+var cardsMutex sync.Mutex
+
+func setupCards(mux *mux.Router) {
+	loadCards()
+
+	mux.HandleFunc("/pjf/api/cards", listCardsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/cards", addCardHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/cards/{name}", getCardHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/cards/{name}", putCardHandler).Methods("PUT")
+	mux.HandleFunc("/pjf/api/cards/{name}", deleteCardHandler).Methods("DELETE")
+	mux.HandleFunc("/pjf/api/cards/{name}/touch", touchCardHandler).Methods("POST")
+}
+
+func cardsFilePath() string {
+	return filepath.Join(conf.simDir, cardsFileName)
+}
+
+func loadCards() {
+	var list []*Card
+	if err := readJSONFile(cardsFilePath(), &list); err != nil {
+		return
+	}
+	cardsMutex.Lock()
+	defer cardsMutex.Unlock()
+	cards = map[string]*Card{}
+	for _, c := range list {
+		cards[c.Name] = c
+	}
+}
+
+// cardsMutexをlockした状態で呼ぶこと
+func saveCardsLocked() error {
+	return writeJSONFile(cardsFilePath(), sortedCardsLocked())
+}
+
+// cardsMutexをlockした状態で呼ぶこと
+func sortedCardsLocked() []*Card {
+	list := make([]*Card, 0, len(cards))
+	for _, c := range cards {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func findCard(name string) *Card {
+	cardsMutex.Lock()
+	defer cardsMutex.Unlock()
+	c := cards[name]
+	if c == nil {
+		return nil
+	}
+	copied := *c
+	return &copied
+}
+
+func validateCard(c *Card) error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if strings.ContainsAny(c.Name, "/?#") {
+		return fmt.Errorf("name must not contain '/', '?' or '#'")
+	}
+	if c.Category < 0 {
+		return fmt.Errorf("category must be a non-negative integer")
+	}
+	return validateCategoryIdm(c.Category, c.Idm)
+}
+
+// IDmは8バイトを16進数で表した16文字
+func validateIdm(idm string) error {
+	b, err := hex.DecodeString(idm)
+	if err != nil || len(b) != 8 {
+		return fmt.Errorf("idm must be 16 hex digits: %q", idm)
+	}
+	return nil
+}
+
+func decodeCard(w http.ResponseWriter, r *http.Request) (*Card, bool) {
+	var c Card
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return nil, false
+	}
+	c.Idm = strings.ToUpper(c.Idm)
+	return &c, true
+}
+
+func listCardsHandler(w http.ResponseWriter, r *http.Request) {
+	cardsMutex.Lock()
+	list := sortedCardsLocked()
+	cardsMutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func addCardHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := decodeCard(w, r)
+	if !ok {
+		return
+	}
+	if err := validateCard(c); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cardsMutex.Lock()
+	defer cardsMutex.Unlock()
+	if cards[c.Name] != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("card %q already exists", c.Name))
+		return
+	}
+	cards[c.Name] = c
+	if err := saveCardsLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+func getCardHandler(w http.ResponseWriter, r *http.Request) {
+	c := findCard(mux.Vars(r)["name"])
+	if c == nil {
+		writeError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// 登録または上書きする。URLの{name}がbodyのnameより優先される。
+func putCardHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := decodeCard(w, r)
+	if !ok {
+		return
+	}
+	c.Name = mux.Vars(r)["name"]
+	if err := validateCard(c); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cardsMutex.Lock()
+	defer cardsMutex.Unlock()
+	cards[c.Name] = c
+	if err := saveCardsLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func deleteCardHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	cardsMutex.Lock()
+	defer cardsMutex.Unlock()
+	if cards[name] == nil {
+		writeError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	delete(cards, name)
+	if err := saveCardsLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type touchResp struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+// カードのタッチ(eventCode=1)と離脱(eventCode=0)のstartCommunicationイベントを発生させる。
+// クエリのholdに"500ms"のような時間を指定すると、その時間だけ待ってから離脱のイベントを送る。
+// クエリのterminalでタッチする端末を指定できる。
+func touchCardHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	c := findCard(mux.Vars(r)["name"])
+	if c == nil {
+		writeError(w, http.StatusNotFound, "card not found")
+		return
+	}
+	var hold time.Duration
+	if s := r.URL.Query().Get("hold"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid hold: %q", s))
+			return
+		}
+		hold = d
+	}
+
+	// クライアントが切断したら、holdの途中でも離脱のイベントを送って終わる
+	events, _ := touchCard(t, c, hold, "card", func(d time.Duration) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	})
+	writeJSON(w, http.StatusOK, &touchResp{Events: events})
+}
+
+// カードのタッチと離脱のイベントを、eventTriggerと同じ経路で端末tに配送し、配送したイベントを返す。
+// holdの間はsleepで待つ。sleepがエラーを返したら(中断されたら)、すぐに離脱のイベントを送ってそのエラーを返す。
+// (カードを置いたままの状態にしないように、離脱のイベントは必ず送る)
+func touchCard(t *terminal, c *Card, hold time.Duration, source string, sleep func(time.Duration) error) ([]json.RawMessage, error) {
+	touch, release := touchEvents(c)
+	touchData, _ := json.Marshal(touch)
+	touchData, _ = triggerEvent(t, touchData, source)
+	var err error
+	if hold > 0 {
+		err = sleep(hold)
+	}
+	releaseData, _ := json.Marshal(release)
+	releaseData, _ = triggerEvent(t, releaseData, source)
+	return []json.RawMessage{touchData, releaseData}, err
+}
+
+// カードに対応するstartCommunicationイベントの組を作る
+func touchEvents(c *Card) (*event, *event) {
+	touch := &event{
+		Api:       "startCommunication",
+		EventCode: communicationEventTouch,
+		ResponseObject: map[string]interface{}{
+			"category":    c.Category,
+			"paramResult": c.ParamResult,
+			"idm":         c.Idm,
+		},
+	}
+	release := &event{
+		Api:       "startCommunication",
+		EventCode: communicationEventRelease,
+		ResponseObject: map[string]interface{}{
+			"idm": c.Idm,
+		},
+	}
+	return touch, release
+}
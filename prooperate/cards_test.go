@@ -0,0 +1,171 @@
+package prooperate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupCardsTest(t *testing.T) *mux.Router {
+	t.Helper()
+	conf.simDir = t.TempDir()
+	if err := setupTerminals([]string{"A"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	cardsMutex.Lock()
+	cards = map[string]*Card{}
+	cardsMutex.Unlock()
+	t.Cleanup(func() {
+		cardsMutex.Lock()
+		cards = map[string]*Card{}
+		cardsMutex.Unlock()
+	})
+	m := mux.NewRouter()
+	setupCards(m)
+	return m
+}
+
+func serveCards(m *mux.Router, method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestCardsCRUD(t *testing.T) {
+	m := setupCardsTest(t)
+
+	w := serveCards(m, "POST", "/pjf/api/cards", `{"name":"member1","label":"会員1","idm":"0011aabbccddeeff","category":0,"paramResult":1}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: %v %v", w.Code, w.Body.String())
+	}
+	// IDmは大文字で保存される
+	var c Card
+	json.Unmarshal(w.Body.Bytes(), &c)
+	if c.Idm != "0011AABBCCDDEEFF" {
+		t.Fatalf("idm %v", c.Idm)
+	}
+	if w := serveCards(m, "POST", "/pjf/api/cards", `{"name":"member1","idm":"0011223344556677"}`); w.Code != http.StatusConflict {
+		t.Fatalf("duplicated add: %v", w.Code)
+	}
+
+	// PUTではURLの名前が優先される
+	if w := serveCards(m, "PUT", "/pjf/api/cards/member1", `{"name":"other","idm":"8877665544332211","paramResult":2}`); w.Code != http.StatusOK {
+		t.Fatalf("put: %v %v", w.Code, w.Body.String())
+	}
+	if w := serveCards(m, "PUT", "/pjf/api/cards/member2", `{"idm":"1111111111111111"}`); w.Code != http.StatusOK {
+		t.Fatalf("put: %v %v", w.Code, w.Body.String())
+	}
+	w = serveCards(m, "GET", "/pjf/api/cards/member1", "")
+	c = Card{}
+	json.Unmarshal(w.Body.Bytes(), &c)
+	if w.Code != http.StatusOK || c.Name != "member1" || c.Idm != "8877665544332211" || c.ParamResult != 2 {
+		t.Fatalf("get: %v %+v", w.Code, c)
+	}
+
+	if w := serveCards(m, "DELETE", "/pjf/api/cards/member2", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %v", w.Code)
+	}
+	if w := serveCards(m, "DELETE", "/pjf/api/cards/member2", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("delete of deleted card: %v", w.Code)
+	}
+	if w := serveCards(m, "GET", "/pjf/api/cards/member2", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get of deleted card: %v", w.Code)
+	}
+
+	// ファイルから読み直しても同じカードがある
+	cardsMutex.Lock()
+	cards = map[string]*Card{}
+	cardsMutex.Unlock()
+	loadCards()
+	var list []*Card
+	json.Unmarshal(serveCards(m, "GET", "/pjf/api/cards", "").Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Name != "member1" || list[0].Idm != "8877665544332211" {
+		t.Fatalf("reloaded cards %+v", list)
+	}
+}
+
+func TestInvalidCard(t *testing.T) {
+	m := setupCardsTest(t)
+
+	for _, body := range []string{
+		`{"name":"a","idm":"0011"}`,
+		`{"name":"a","idm":"00112233445566zz"}`,
+		`{"name":"a","category":0}`,
+		`{"idm":"0011223344556677"}`,
+		`{"name":"a/b","idm":"0011223344556677"}`,
+		`{"name":"a","idm":"0011223344556677","category":-1}`,
+		`{"name":`,
+	} {
+		if w := serveCards(m, "POST", "/pjf/api/cards", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: %v %v", body, w.Code, w.Body.String())
+		}
+	}
+	// FeliCa以外のカテゴリでは、idmは16桁の16進数でなくてもよい
+	if w := serveCards(m, "POST", "/pjf/api/cards", `{"name":"a","category":1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("category 1 without idm: %v %v", w.Code, w.Body.String())
+	}
+	if w := serveCards(m, "POST", "/pjf/api/cards", `{"name":"a","idm":"04a1b2c3","category":1}`); w.Code != http.StatusCreated {
+		t.Errorf("category 1: %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestTouchCard(t *testing.T) {
+	m := setupCardsTest(t)
+	serveCards(m, "PUT", "/pjf/api/cards/member1", `{"idm":"0011223344556677","paramResult":1}`)
+	s := defaultTerminal().events.subscribe("test")
+
+	if w := serveCards(m, "POST", "/pjf/api/cards/nobody/touch", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("touch of unknown card: %v", w.Code)
+	}
+	if w := serveCards(m, "POST", "/pjf/api/cards/member1/touch?hold=x", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid hold: %v", w.Code)
+	}
+	if w := serveCards(m, "POST", "/pjf/api/cards/member1/touch?terminal=X", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown terminal: %v", w.Code)
+	}
+
+	w := serveCards(m, "POST", "/pjf/api/cards/member1/touch", "")
+	var resp struct {
+		Events []event `json:"events"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Events) != 2 {
+		t.Fatalf("touch: %v %v", w.Code, w.Body.String())
+	}
+	if got := receiveEvent(t, s); got != "startCommunication:1" {
+		t.Fatalf("got %v", got)
+	}
+	if got := receiveEvent(t, s); got != "startCommunication:0" {
+		t.Fatalf("got %v", got)
+	}
+	touch := resp.Events[0].ResponseObject.(map[string]interface{})
+	if touch["idm"] != "0011223344556677" || touch["paramResult"] != float64(1) {
+		t.Fatalf("touch event %+v", touch)
+	}
+
+	// クライアントが切断したら、holdの途中でも離脱のイベントを送って終わる
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("POST", "/pjf/api/cards/member1/touch?hold=10s", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		m.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	if got := receiveEvent(t, s); got != "startCommunication:1" {
+		t.Fatalf("got %v", got)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("touch handler did not return")
+	}
+	if got := receiveEvent(t, s); got != "startCommunication:0" {
+		t.Fatalf("got %v", got)
+	}
+}
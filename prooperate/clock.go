@@ -0,0 +1,237 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 端末の時計。setDate()や/pjf/api/clockで変更でき、ページのDateとWebSQLの'now'はこの時刻になる。
+// 端末ごとに持つ。/pjf/api/clockでは、クエリのterminalで端末を指定する。
+//
+// 時刻を設定すると、設定した時点からspeed倍の速さで進む。frozenなら止まったままになる。
+type virtualClock struct {
+	mutex       sync.Mutex
+	virtual     bool      // 時刻が設定されているか。falseなら実際の時刻
+	baseReal    time.Time // 時刻を設定した時点の実際の時刻
+	baseVirtual time.Time // 設定した時刻
+	speed       float64
+	frozen      bool
+}
+
+func newVirtualClock() *virtualClock {
+	return &virtualClock{speed: 1}
+}
+
+// 時計の状態。ブラウザにはstartEventListenなどと同じ形式で {"api":"clock","eventCode":0,"responseObject":clockState} を送る。
+type clockState struct {
+	Now     time.Time `json:"now"`
+	RealNow time.Time `json:"realNow"`
+	Offset  string    `json:"offset"` // 実際の時刻との差
+	Virtual bool      `json:"virtual"`
+	Speed   float64   `json:"speed"`
+	Frozen  bool      `json:"frozen"`
+}
+
+// /pjf/api/clockへのPOSTで変更する項目。指定したものだけ変更する。
+type clockSetRequest struct {
+	Time   *time.Time `json:"time"`
+	Speed  *float64   `json:"speed"`
+	Frozen *bool      `json:"frozen"`
+}
+
+func setupClock(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/clock", getClockHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/clock", setClockHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/clock/advance", advanceClockHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/clock/reset", resetClockHandler).Methods("POST")
+}
+
+func (c *virtualClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nowLocked(time.Now())
+}
+
+// 現在の時刻と、時刻が設定されているかを返す。WebSQLの'now'の置き換えに使う。
+func (c *virtualClock) virtualNow() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nowLocked(time.Now()), c.virtual
+}
+
+// c.mutexをlockした状態で呼ぶこと
+func (c *virtualClock) nowLocked(real time.Time) time.Time {
+	if !c.virtual {
+		return real
+	}
+	if c.frozen {
+		return c.baseVirtual
+	}
+	elapsed := real.Sub(c.baseReal)
+	return c.baseVirtual.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+// 現在の時刻を基準にし直してからfで変更する
+func (c *virtualClock) update(f func(now time.Time)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	real := time.Now()
+	now := c.nowLocked(real)
+	c.virtual = true
+	c.baseReal = real
+	c.baseVirtual = now
+	f(now)
+}
+
+func (c *virtualClock) set(req *clockSetRequest) {
+	c.update(func(now time.Time) {
+		if req.Time != nil {
+			c.baseVirtual = *req.Time
+		}
+		if req.Speed != nil {
+			c.speed = *req.Speed
+		}
+		if req.Frozen != nil {
+			c.frozen = *req.Frozen
+		}
+	})
+}
+
+func (c *virtualClock) advance(d time.Duration) {
+	c.update(func(now time.Time) {
+		c.baseVirtual = now.Add(d)
+	})
+}
+
+func (c *virtualClock) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.virtual = false
+	c.speed = 1
+	c.frozen = false
+}
+
+// state.jsonに保存する時計の状態。
+// 保存した時点からの実際の経過時間も進むので、シミュレーターを止めている間も時計は進む。
+type clockSnapshot struct {
+	Virtual     bool      `json:"virtual"`
+	BaseReal    time.Time `json:"baseReal"`
+	BaseVirtual time.Time `json:"baseVirtual"`
+	Speed       float64   `json:"speed"`
+	Frozen      bool      `json:"frozen"`
+}
+
+func (c *virtualClock) snapshot() *clockSnapshot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return &clockSnapshot{Virtual: c.virtual, BaseReal: c.baseReal, BaseVirtual: c.baseVirtual, Speed: c.speed, Frozen: c.frozen}
+}
+
+func (c *virtualClock) restore(s *clockSnapshot) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.virtual = s.Virtual
+	c.baseReal = s.BaseReal
+	c.baseVirtual = s.BaseVirtual
+	c.speed = s.Speed
+	c.frozen = s.Frozen
+}
+
+func (c *virtualClock) state() *clockState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	real := time.Now()
+	now := c.nowLocked(real)
+	return &clockState{
+		Now:     now,
+		RealNow: real,
+		Offset:  now.Sub(real).Round(time.Millisecond).String(),
+		Virtual: c.virtual,
+		Speed:   c.speed,
+		Frozen:  c.frozen,
+	}
+}
+
+// websql.SetNowFunc()に登録する。dirがdbDirの端末の時計の時刻を返す。
+func virtualNowForDBDir(dir string) (time.Time, bool) {
+	for _, t := range terminals {
+		if t.dbDir == dir {
+			return t.clock.virtualNow()
+		}
+	}
+	return time.Now(), false
+}
+
+// 時計の変更を端末tのブラウザに送り、状態をレスポンスとして返す
+func notifyClock(w http.ResponseWriter, t *terminal) {
+	state := t.clock.state()
+	data, _ := json.Marshal(&event{Api: "clock", EventCode: 0, ResponseObject: state})
+	broadcast(t, data)
+	fmt.Printf("端末%v: 時計を変更しました。now=%v speed=%v frozen=%v\n", t.id, state.Now.Format(time.RFC3339), state.Speed, state.Frozen)
+	writeJSON(w, http.StatusOK, state)
+}
+
+func getClockHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.clock.state())
+}
+
+// 時計を設定する。prooperate.jsのsetDate()からも呼ばれる。
+//
+//	{"time":"2025-04-01T09:00:00+09:00", "speed":60, "frozen":false}
+func setClockHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var req clockSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if req.Speed != nil && *req.Speed < 0 {
+		writeError(w, http.StatusBadRequest, "speed must not be negative")
+		return
+	}
+	t.clock.set(&req)
+	notifyClock(w, t)
+}
+
+// 時計を進める。{"duration":"24h"} のように指定する。負の値なら戻す。
+func advanceClockHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var req struct {
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid duration: %q", req.Duration))
+		return
+	}
+	t.clock.advance(d)
+	notifyClock(w, t)
+}
+
+// 時計を実際の時刻に戻す
+func resetClockHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	t.clock.reset()
+	notifyClock(w, t)
+}
@@ -0,0 +1,107 @@
+package prooperate
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	c := &virtualClock{speed: 1}
+	if _, virtual := c.virtualNow(); virtual {
+		t.Fatal("clock is virtual before set")
+	}
+
+	// frozenなら設定した時刻のまま止まる
+	base := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	frozen := true
+	c.set(&clockSetRequest{Time: &base, Frozen: &frozen})
+	time.Sleep(20 * time.Millisecond)
+	if now, virtual := c.virtualNow(); !virtual || !now.Equal(base) {
+		t.Fatalf("frozen clock: %v %v", now, virtual)
+	}
+
+	// advanceは止まっていても進める
+	c.advance(24 * time.Hour)
+	if now := c.now(); !now.Equal(base.Add(24 * time.Hour)) {
+		t.Fatalf("advanced clock: %v", now)
+	}
+	c.advance(-time.Hour)
+	if now := c.now(); !now.Equal(base.Add(23 * time.Hour)) {
+		t.Fatalf("clock moved back: %v", now)
+	}
+
+	// speed倍の速さで進む
+	speed := 1000.0
+	frozen = false
+	c.set(&clockSetRequest{Time: &base, Speed: &speed, Frozen: &frozen})
+	realStart := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	elapsed := c.now().Sub(base)
+	realElapsed := time.Since(realStart)
+	if elapsed < 20*time.Second || elapsed > time.Duration(float64(realElapsed)*speed)+time.Second {
+		t.Fatalf("elapsed %v in %v", elapsed, realElapsed)
+	}
+	if s := c.state(); !s.Virtual || s.Speed != speed || s.Frozen {
+		t.Fatalf("state %+v", s)
+	}
+
+	// 時刻を変えずにspeedだけ変えると、その時点の時刻から進む
+	before := c.now()
+	zero := 0.0
+	c.set(&clockSetRequest{Speed: &zero})
+	if now := c.now(); now.Before(before) || now.Sub(before) > time.Second {
+		t.Fatalf("clock jumped: %v -> %v", before, now)
+	}
+
+	c.reset()
+	if s := c.state(); s.Virtual || s.Speed != 1 || s.Frozen || !s.Now.Equal(s.RealNow) {
+		t.Fatalf("reset clock %+v", s)
+	}
+}
+
+func TestClockPerTerminal(t *testing.T) {
+	if err := setupTerminals([]string{"A", "B"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	m := mux.NewRouter()
+	setupClock(m)
+	a := findTerminal("A").events.subscribe("a")
+	b := findTerminal("B").events.subscribe("b")
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("POST", "/pjf/api/clock?terminal=B", strings.NewReader(`{"time":"2030-01-02T03:04:05Z","frozen":true}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set: %v %v", w.Code, w.Body.String())
+	}
+	// 設定した端末のブラウザだけに送る
+	if got := receiveEvent(t, b); got != "clock:0" {
+		t.Fatalf("B: got %v", got)
+	}
+	select {
+	case data := <-a.ch:
+		t.Fatalf("A received %s", data)
+	default:
+	}
+
+	// WebSQLの'now'は、databaseのある端末の時計になる
+	base := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if now, virtual := virtualNowForDBDir(findTerminal("B").dbDir); !virtual || !now.Equal(base) {
+		t.Fatalf("B: %v %v", now, virtual)
+	}
+	if _, virtual := virtualNowForDBDir(findTerminal("A").dbDir); virtual {
+		t.Fatal("A clock is changed")
+	}
+	if _, virtual := virtualNowForDBDir(t.TempDir()); virtual {
+		t.Fatal("unknown dir uses a virtual clock")
+	}
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/pjf/api/clock?terminal=X", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown terminal: %v", w.Code)
+	}
+}
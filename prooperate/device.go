@@ -0,0 +1,196 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+)
+
+// 端末の識別情報。getTerminalID()、getFirmwareVersion()、getContentsSetVersion()、productTypeが返す値。
+// 端末ごとに持ち、/pjf/api/device/infoで実行中に変更できる。
+type DeviceInfo struct {
+	TerminalId         string `json:"terminalId"`
+	FirmwareVersion    string `json:"firmwareVersion"`
+	ContentsSetVersion string `json:"contentsSetVersion"`
+	ProductType        string `json:"productType"`
+	FirmwareProfile    string `json:"firmwareProfile"` // ファームウェアプロファイルの名前。空なら全てのAPIが使える
+}
+
+type device struct {
+	mutex    sync.Mutex
+	info     DeviceInfo
+	accesses []*firmwareAccess // 存在しないAPIなどが使われた記録
+}
+
+// /pjf/api/device/infoのレスポンス。prooperate.jsは、ファームウェアプロファイルに合わせてAPIを消したり置き換えたりする。
+type deviceInfoResp struct {
+	DeviceInfo
+	MissingApis []string       `json:"missingApis"`
+	ErrorApis   map[string]int `json:"errorApis"`
+}
+
+// 全ての端末の識別情報の初期値。TerminalIdは端末IDになる。
+var defaultDeviceInfo = DeviceInfo{
+	FirmwareVersion:    "5.00r000000",
+	ContentsSetVersion: "000",
+	ProductType:        "pro3",
+}
+
+// /pjf/api/device/infoへのPOSTで変更する項目。指定したものだけ変更する。
+type deviceInfoSetRequest struct {
+	TerminalId         *string `json:"terminalId"`
+	FirmwareVersion    *string `json:"firmwareVersion"`
+	ContentsSetVersion *string `json:"contentsSetVersion"`
+	ProductType        *string `json:"productType"`
+	FirmwareProfile    *string `json:"firmwareProfile"` // firmwareVersionを指定しなければ、プロファイルのfirmwareVersionになる
+}
+
+func newDevice(terminalId string) *device {
+	d := &device{accesses: []*firmwareAccess{}}
+	d.reset(terminalId)
+	return d
+}
+
+func setupDevice(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/device/info", getDeviceInfoHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/device/info", setDeviceInfoHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/device/info/reset", resetDeviceInfoHandler).Methods("POST")
+}
+
+// 全ての端末の識別情報の初期値を設定する。info.TerminalIdは使わない。
+// info.FirmwareProfileを指定した場合、FirmwareVersionはプロファイルのfirmwareVersionになる。
+// Setup()とLoadFirmwareProfiles()の後に呼ぶこと。
+func SetDefaultDeviceInfo(info DeviceInfo) error {
+	if _, err := findFirmwareProfile(info.FirmwareProfile); err != nil {
+		return err
+	}
+	defaultDeviceInfo = info
+	for _, t := range terminals {
+		t.device.reset(t.id)
+	}
+	return nil
+}
+
+func (d *device) get() DeviceInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.info
+}
+
+// 識別情報と、ファームウェアプロファイルで使えないAPIを返す
+func (d *device) resp() *deviceInfoResp {
+	info := d.get()
+	resp := &deviceInfoResp{DeviceInfo: info, MissingApis: []string{}, ErrorApis: map[string]int{}}
+	if p, _ := findFirmwareProfile(info.FirmwareProfile); p != nil {
+		resp.MissingApis = p.MissingApis
+		resp.ErrorApis = p.ErrorApis
+	}
+	return resp
+}
+
+// プロファイルを設定する。pのfirmwareVersionが空でなければ、それをFirmwareVersionにする。
+func (info *DeviceInfo) setFirmwareProfile(p *firmwareProfile) {
+	info.FirmwareProfile = ""
+	if p != nil {
+		info.FirmwareProfile = p.Name
+		if p.FirmwareVersion != "" {
+			info.FirmwareVersion = p.FirmwareVersion
+		}
+	}
+}
+
+// reqのfirmwareProfileは、存在することを確認してから呼ぶこと
+func (d *device) set(req *deviceInfoSetRequest) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if req.FirmwareProfile != nil {
+		p, _ := findFirmwareProfile(*req.FirmwareProfile)
+		d.info.setFirmwareProfile(p)
+	}
+	if req.TerminalId != nil {
+		d.info.TerminalId = *req.TerminalId
+	}
+	if req.FirmwareVersion != nil {
+		d.info.FirmwareVersion = *req.FirmwareVersion
+	}
+	if req.ContentsSetVersion != nil {
+		d.info.ContentsSetVersion = *req.ContentsSetVersion
+	}
+	if req.ProductType != nil {
+		d.info.ProductType = *req.ProductType
+	}
+}
+
+func (d *device) reset(terminalId string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.info = defaultDeviceInfo
+	d.info.TerminalId = terminalId
+	p, _ := findFirmwareProfile(d.info.FirmwareProfile)
+	d.info.setFirmwareProfile(p)
+}
+
+// 識別情報の変更をブラウザに送り、レスポンスとして返す。
+// ブラウザには {"api":"device","eventCode":0,"responseObject":deviceInfoResp} を送り、productTypeとAPIを更新させる。
+func notifyDeviceInfo(w http.ResponseWriter, t *terminal) {
+	resp := t.device.resp()
+	data, _ := json.Marshal(&event{Api: "device", EventCode: 0, ResponseObject: resp})
+	broadcast(t, data)
+	fmt.Printf("端末%v: 識別情報を変更しました。terminalId=%v firmwareVersion=%v contentsSetVersion=%v productType=%v firmwareProfile=%v\n",
+		t.id, resp.TerminalId, resp.FirmwareVersion, resp.ContentsSetVersion, resp.ProductType, resp.FirmwareProfile)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// prooperate.jsのgetTerminalID()などから呼ばれる
+func getDeviceInfoHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.device.resp())
+}
+
+// 識別情報を変更する。
+//
+//	{"terminalId":"12345678", "firmwareVersion":"5.10r000000", "contentsSetVersion":"001", "productType":"pro3", "firmwareProfile":"5.10"}
+//
+// terminalIdを変更しても、/t/{端末ID}/ やクエリのterminalで指定する端末IDは変わらない。
+func setDeviceInfoHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var req deviceInfoSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if req.TerminalId != nil && *req.TerminalId == "" {
+		writeError(w, http.StatusBadRequest, "terminalId must not be empty")
+		return
+	}
+	if req.ProductType != nil && *req.ProductType == "" {
+		writeError(w, http.StatusBadRequest, "productType must not be empty")
+		return
+	}
+	if req.FirmwareProfile != nil {
+		if _, err := findFirmwareProfile(*req.FirmwareProfile); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	t.device.set(&req)
+	notifyDeviceInfo(w, t)
+}
+
+// 識別情報を起動時の値に戻す
+func resetDeviceInfoHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	t.device.reset(t.id)
+	notifyDeviceInfo(w, t)
+}
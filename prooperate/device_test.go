@@ -0,0 +1,23 @@
+package prooperate
+
+import (
+	"testing"
+)
+
+func TestDeviceInfo(t *testing.T) {
+	d := newDevice("00000001")
+	if info := d.get(); info.TerminalId != "00000001" || info.FirmwareVersion != defaultDeviceInfo.FirmwareVersion {
+		t.Fatalf("unexpected initial info %+v", info)
+	}
+
+	firmware := "5.10r000001"
+	d.set(&deviceInfoSetRequest{FirmwareVersion: &firmware})
+	if info := d.get(); info.FirmwareVersion != firmware || info.TerminalId != "00000001" || info.ProductType != "pro3" {
+		t.Fatalf("unexpected info after set %+v", info)
+	}
+
+	d.reset("00000001")
+	if info := d.get(); info.FirmwareVersion != defaultDeviceInfo.FirmwareVersion {
+		t.Fatalf("unexpected info after reset %+v", info)
+	}
+}
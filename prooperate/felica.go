@@ -0,0 +1,390 @@
+package prooperate
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FeliCaカードのメモリ。IDmごとに simDir/felica/{IDm}.json に保存する。
+type FelicaCard struct {
+	Idm     string          `json:"idm"`
+	Systems []*FelicaSystem `json:"systems"`
+}
+
+type FelicaSystem struct {
+	SystemCode string           `json:"systemCode"` // "FE00" のような4桁の16進数
+	Services   []*FelicaService `json:"services"`
+}
+
+type FelicaService struct {
+	ServiceCode string   `json:"serviceCode"` // "090F" のような4桁の16進数
+	Blocks      []string `json:"blocks"`      // 1ブロック16バイトを32桁の16進数で表したもの
+}
+
+const felicaBlockSize = 16
+
+// FeliCaのステータスフラグ2
+const (
+	felicaStatusOK             = 0x00
+	felicaStatusIllegalService = 0xA6
+	felicaStatusIllegalBlock   = 0xA8
+)
+
+// startCommunication()に渡されたparamのうち、FeliCaの読み書きに関する部分。
+//
+//	felicaParam: {
+//	    systemCode: "FE00",
+//	    read: [{serviceCode: "000B", block: 0}, ...],
+//	    write: [{serviceCode: "0009", block: 0, data: "00112233445566778899AABBCCDDEEFF"}, ...],
+//	}
+type felicaParam struct {
+	SystemCode string              `json:"systemCode"`
+	Read       []felicaBlockAccess `json:"read"`
+	Write      []felicaBlockAccess `json:"write"`
+}
+
+type felicaBlockAccess struct {
+	ServiceCode string `json:"serviceCode"`
+	Block       int    `json:"block"`
+	Data        string `json:"data,omitempty"`
+}
+
+type communicationParam struct {
+	FelicaParam *felicaParam `json:"felicaParam"`
+}
+
+// FeliCaメモリのファイルの読み書きと、各端末のcommunicationParamを保護する
+var felicaMutex sync.Mutex
+
+func setupFelica(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/communication/start", startCommunicationHandler)
+	mux.HandleFunc("/pjf/api/communication/stop", stopCommunicationHandler)
+
+	mux.HandleFunc("/pjf/api/felica", listFelicaHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/felica/{idm}", getFelicaHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/felica/{idm}", putFelicaHandler).Methods("PUT")
+	mux.HandleFunc("/pjf/api/felica/{idm}", deleteFelicaHandler).Methods("DELETE")
+}
+
+func felicaDir() string {
+	return filepath.Join(conf.simDir, "felica")
+}
+
+func felicaFilePath(idm string) string {
+	return filepath.Join(felicaDir(), strings.ToUpper(idm)+".json")
+}
+
+// prooperate.jsのstartCommunication()から呼ばれ、paramを覚えておく
+func startCommunicationHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var param communicationParam
+	if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	felicaMutex.Lock()
+	t.communicationParam = &param
+	felicaMutex.Unlock()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func stopCommunicationHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	felicaMutex.Lock()
+	t.communicationParam = nil
+	felicaMutex.Unlock()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func listFelicaHandler(w http.ResponseWriter, r *http.Request) {
+	idms := []string{}
+	files, _ := os.ReadDir(felicaDir())
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			idms = append(idms, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	sort.Strings(idms)
+	writeJSON(w, http.StatusOK, idms)
+}
+
+func getFelicaHandler(w http.ResponseWriter, r *http.Request) {
+	idm := mux.Vars(r)["idm"]
+	if err := validateIdm(idm); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	felicaMutex.Lock()
+	card, err := loadFelicaCard(idm)
+	felicaMutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusNotFound, "felica card not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, card)
+}
+
+func putFelicaHandler(w http.ResponseWriter, r *http.Request) {
+	idm := mux.Vars(r)["idm"]
+	if err := validateIdm(idm); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var card FelicaCard
+	if err := json.NewDecoder(r.Body).Decode(&card); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	card.Idm = strings.ToUpper(idm)
+	if err := validateFelicaCard(&card); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	felicaMutex.Lock()
+	err := writeJSONFile(felicaFilePath(idm), &card)
+	felicaMutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &card)
+}
+
+func deleteFelicaHandler(w http.ResponseWriter, r *http.Request) {
+	idm := mux.Vars(r)["idm"]
+	if err := validateIdm(idm); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	felicaMutex.Lock()
+	err := os.Remove(felicaFilePath(idm))
+	felicaMutex.Unlock()
+	if err != nil {
+		writeError(w, http.StatusNotFound, "felica card not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// felicaMutexをlockした状態で呼ぶこと
+func loadFelicaCard(idm string) (*FelicaCard, error) {
+	var card FelicaCard
+	if err := readJSONFile(felicaFilePath(idm), &card); err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+func validateFelicaCard(card *FelicaCard) error {
+	for _, sys := range card.Systems {
+		if _, err := parseFelicaCode(sys.SystemCode); err != nil {
+			return fmt.Errorf("invalid systemCode: %v", err)
+		}
+		for _, svc := range sys.Services {
+			if _, err := parseFelicaCode(svc.ServiceCode); err != nil {
+				return fmt.Errorf("invalid serviceCode: %v", err)
+			}
+			for i, b := range svc.Blocks {
+				if _, err := parseFelicaBlock(b); err != nil {
+					return fmt.Errorf("service %v block %v: %v", svc.ServiceCode, i, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// "FE00"のような4桁の16進数をparseする
+func parseFelicaCode(s string) (uint16, error) {
+	if len(s) != 4 {
+		return 0, fmt.Errorf("code must be 4 hex digits: %q", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("code must be 4 hex digits: %q", s)
+	}
+	return uint16(v), nil
+}
+
+func parseFelicaBlock(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != felicaBlockSize {
+		return nil, fmt.Errorf("block must be %v hex digits: %q", felicaBlockSize*2, s)
+	}
+	return b, nil
+}
+
+// サービスコードの下位6bitはサービスの属性を表す。
+// 鍵なしでアクセスできる属性(bit0が1)だけをシミュレートする。
+func felicaAccessAttr(code uint16) uint16 {
+	return code & 0x3F
+}
+
+func isCyclicService(code uint16) bool {
+	attr := felicaAccessAttr(code)
+	return attr == 0x0C || attr == 0x0D || attr == 0x0E || attr == 0x0F
+}
+
+// 同じサービス番号で種類(ランダム/サイクリック/パース)も同じなら、読み書き用と読み出し専用のコードは同じサービスを指す
+func sameFelicaService(a, b uint16) bool {
+	return a>>6 == b>>6 && felicaAccessAttr(a)&0x3C == felicaAccessAttr(b)&0x3C
+}
+
+func (sys *FelicaSystem) findService(code uint16) *FelicaService {
+	for _, svc := range sys.Services {
+		c, err := parseFelicaCode(svc.ServiceCode)
+		if err != nil {
+			continue
+		}
+		if sameFelicaService(c, code) {
+			return svc
+		}
+	}
+	return nil
+}
+
+func (card *FelicaCard) findSystem(systemCode string) *FelicaSystem {
+	if len(card.Systems) == 0 {
+		return nil
+	}
+	code, err := parseFelicaCode(systemCode)
+	if err != nil || code == 0xFFFF {
+		// ワイルドカードは最初のシステムにマッチさせる
+		return card.Systems[0]
+	}
+	for _, sys := range card.Systems {
+		c, err := parseFelicaCode(sys.SystemCode)
+		if err == nil && c == code {
+			return sys
+		}
+	}
+	return nil
+}
+
+// ブロックを読み出す。読み出せない場合はステータスフラグ2を返す。
+func (sys *FelicaSystem) readBlock(a felicaBlockAccess) (string, int) {
+	code, err := parseFelicaCode(a.ServiceCode)
+	if err != nil || code&0x01 == 0 {
+		return "", felicaStatusIllegalService
+	}
+	svc := sys.findService(code)
+	if svc == nil {
+		return "", felicaStatusIllegalService
+	}
+	if a.Block < 0 || a.Block >= len(svc.Blocks) {
+		return "", felicaStatusIllegalBlock
+	}
+	return strings.ToUpper(svc.Blocks[a.Block]), felicaStatusOK
+}
+
+// ブロックに書き込む。書き込めない場合はステータスフラグ2を返す。
+// サイクリックサービスへの書き込みは、最新のデータをブロック0に入れて古いものを後ろへずらす。
+func (sys *FelicaSystem) writeBlock(a felicaBlockAccess) int {
+	code, err := parseFelicaCode(a.ServiceCode)
+	if err != nil {
+		return felicaStatusIllegalService
+	}
+	// 書き込みできるのは鍵なしの読み書き属性(ランダム:0x09, サイクリック:0x0D)のみ
+	if attr := felicaAccessAttr(code); attr != 0x09 && attr != 0x0D {
+		return felicaStatusIllegalService
+	}
+	svc := sys.findService(code)
+	if svc == nil {
+		return felicaStatusIllegalService
+	}
+	if a.Block < 0 || a.Block >= len(svc.Blocks) {
+		return felicaStatusIllegalBlock
+	}
+	data, err := parseFelicaBlock(a.Data)
+	if err != nil {
+		return felicaStatusIllegalBlock
+	}
+	hexData := strings.ToUpper(hex.EncodeToString(data))
+	if isCyclicService(code) {
+		copy(svc.Blocks[1:], svc.Blocks[:len(svc.Blocks)-1])
+		svc.Blocks[0] = hexData
+	} else {
+		svc.Blocks[a.Block] = hexData
+	}
+	return felicaStatusOK
+}
+
+// startCommunicationのタッチ(eventCode=1)のresponseObjectに、
+// 端末tのstartCommunication()で指定された読み書きの結果を反映する。
+// felicaParamが指定されていないか、IDmのメモリが登録されていなければ、注入されたresponseObjectのまま何もしない。
+//
+// 読み出したデータはresponseObjectのdataに、要求された順に32桁の16進数で入れる。
+// paramResultは全ての読み書きが成功すれば1、失敗すれば0にする。
+func applyFelicaParam(t *terminal, resp map[string]interface{}) {
+	felicaMutex.Lock()
+	defer felicaMutex.Unlock()
+
+	if t.communicationParam == nil || t.communicationParam.FelicaParam == nil {
+		return
+	}
+	param := t.communicationParam.FelicaParam
+
+	idm, _ := resp["idm"].(string)
+	setResult := func(status int, data []string) {
+		if status == felicaStatusOK {
+			resp["paramResult"] = 1
+			resp["statusFlag1"] = 0
+		} else {
+			resp["paramResult"] = 0
+			resp["statusFlag1"] = 0xFF
+		}
+		resp["statusFlag2"] = status
+		resp["data"] = data
+	}
+
+	card, err := loadFelicaCard(idm)
+	if err != nil {
+		return
+	}
+	sys := card.findSystem(param.SystemCode)
+	if sys == nil {
+		setResult(felicaStatusIllegalService, []string{})
+		return
+	}
+
+	// 書き込んだ結果を読み出せるよう、書き込みを先に行う。
+	for _, a := range param.Write {
+		if status := sys.writeBlock(a); status != felicaStatusOK {
+			setResult(status, []string{})
+			return
+		}
+	}
+	if len(param.Write) > 0 {
+		if err := writeJSONFile(felicaFilePath(idm), card); err != nil {
+			setResult(felicaStatusIllegalBlock, []string{})
+			return
+		}
+	}
+
+	data := []string{}
+	for _, a := range param.Read {
+		block, status := sys.readBlock(a)
+		if status != felicaStatusOK {
+			setResult(status, []string{})
+			return
+		}
+		data = append(data, block)
+	}
+	setResult(felicaStatusOK, data)
+}
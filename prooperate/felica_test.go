@@ -0,0 +1,173 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testFelicaIdm = "0011223344556677"
+
+func testFelicaCard() *FelicaCard {
+	return &FelicaCard{
+		Idm: testFelicaIdm,
+		Systems: []*FelicaSystem{{
+			SystemCode: "FE00",
+			Services: []*FelicaService{
+				{ServiceCode: "0009", Blocks: []string{
+					"00000000000000000000000000000000",
+					"11111111111111111111111111111111",
+				}},
+				{ServiceCode: "000D", Blocks: []string{
+					"AA000000000000000000000000000000",
+					"BB000000000000000000000000000000",
+					"CC000000000000000000000000000000",
+				}},
+			},
+		}},
+	}
+}
+
+func TestApplyFelicaParam(t *testing.T) {
+	const newBlock = "0123456789ABCDEF0123456789ABCDEF"
+	tests := []struct {
+		name  string
+		idm   string
+		param felicaParam
+		want  map[string]interface{}
+		// 読み書きした後のカードのブロック。nilならメモリを調べない。
+		blocks map[string][]string
+	}{
+		{
+			name:  "read",
+			idm:   testFelicaIdm,
+			param: felicaParam{SystemCode: "FE00", Read: []felicaBlockAccess{{ServiceCode: "000B", Block: 1}, {ServiceCode: "000F", Block: 0}}},
+			want: map[string]interface{}{
+				"paramResult": 1, "statusFlag1": 0, "statusFlag2": felicaStatusOK,
+				"data": []string{"11111111111111111111111111111111", "AA000000000000000000000000000000"},
+			},
+		},
+		{
+			name: "write",
+			idm:  testFelicaIdm,
+			param: felicaParam{
+				SystemCode: "FE00",
+				Write:      []felicaBlockAccess{{ServiceCode: "0009", Block: 1, Data: newBlock}},
+				Read:       []felicaBlockAccess{{ServiceCode: "000B", Block: 1}},
+			},
+			want: map[string]interface{}{
+				"paramResult": 1, "statusFlag1": 0, "statusFlag2": felicaStatusOK,
+				"data": []string{newBlock},
+			},
+			blocks: map[string][]string{
+				"0009": {"00000000000000000000000000000000", newBlock},
+			},
+		},
+		{
+			// サイクリックサービスは最新のデータがブロック0に入り、一番古いものが捨てられる
+			name:  "cyclic write",
+			idm:   testFelicaIdm,
+			param: felicaParam{SystemCode: "FE00", Write: []felicaBlockAccess{{ServiceCode: "000D", Block: 0, Data: newBlock}}},
+			want: map[string]interface{}{
+				"paramResult": 1, "statusFlag1": 0, "statusFlag2": felicaStatusOK,
+				"data": []string{},
+			},
+			blocks: map[string][]string{
+				"000D": {newBlock, "AA000000000000000000000000000000", "BB000000000000000000000000000000"},
+			},
+		},
+		{
+			name:  "out of range block",
+			idm:   testFelicaIdm,
+			param: felicaParam{SystemCode: "FE00", Read: []felicaBlockAccess{{ServiceCode: "000B", Block: 2}}},
+			want: map[string]interface{}{
+				"paramResult": 0, "statusFlag1": 0xFF, "statusFlag2": felicaStatusIllegalBlock,
+				"data": []string{},
+			},
+		},
+		{
+			name:  "out of range write",
+			idm:   testFelicaIdm,
+			param: felicaParam{SystemCode: "FE00", Write: []felicaBlockAccess{{ServiceCode: "0009", Block: -1, Data: newBlock}}},
+			want: map[string]interface{}{
+				"paramResult": 0, "statusFlag1": 0xFF, "statusFlag2": felicaStatusIllegalBlock,
+				"data": []string{},
+			},
+			blocks: map[string][]string{
+				"0009": testFelicaCard().Systems[0].Services[0].Blocks,
+			},
+		},
+		{
+			// メモリが登録されていなければ、注入されたresponseObjectのまま
+			name:  "missing card",
+			idm:   "FFEEDDCCBBAA9988",
+			param: felicaParam{SystemCode: "FE00", Read: []felicaBlockAccess{{ServiceCode: "000B", Block: 0}}},
+			want:  map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.simDir = t.TempDir()
+			if err := writeJSONFile(felicaFilePath(testFelicaIdm), testFelicaCard()); err != nil {
+				t.Fatal(err)
+			}
+			param := tt.param
+			term := &terminal{communicationParam: &communicationParam{FelicaParam: &param}}
+			resp := map[string]interface{}{"category": 0, "paramResult": 1, "idm": tt.idm}
+			applyFelicaParam(term, resp)
+
+			want := map[string]interface{}{"category": 0, "paramResult": 1, "idm": tt.idm}
+			for k, v := range tt.want {
+				want[k] = v
+			}
+			if !reflect.DeepEqual(resp, want) {
+				t.Errorf("got %v, want %v", resp, want)
+			}
+
+			if tt.blocks == nil {
+				return
+			}
+			card, err := loadFelicaCard(testFelicaIdm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, svc := range card.Systems[0].Services {
+				if blocks, ok := tt.blocks[svc.ServiceCode]; ok && !reflect.DeepEqual(svc.Blocks, blocks) {
+					t.Errorf("service %v: got %v, want %v", svc.ServiceCode, svc.Blocks, blocks)
+				}
+			}
+		})
+	}
+}
+
+// FeliCa以外のカードのタッチには、felicaParamを反映しない
+func TestApplyFelicaParamToRawCategory(t *testing.T) {
+	conf.simDir = t.TempDir()
+	if err := writeJSONFile(felicaFilePath(testFelicaIdm), testFelicaCard()); err != nil {
+		t.Fatal(err)
+	}
+	param := felicaParam{SystemCode: "FE00", Read: []felicaBlockAccess{{ServiceCode: "000B", Block: 0}}}
+	term := &terminal{communicationParam: &communicationParam{FelicaParam: &param}}
+
+	touch := func(category int) map[string]interface{} {
+		data, _ := json.Marshal(map[string]interface{}{
+			"api":            "startCommunication",
+			"eventCode":      communicationEventTouch,
+			"responseObject": map[string]interface{}{"category": category, "paramResult": 1, "idm": testFelicaIdm},
+		})
+		var ev struct {
+			ResponseObject map[string]interface{} `json:"responseObject"`
+		}
+		if err := json.Unmarshal(applyFelicaParamToRaw(term, data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		return ev.ResponseObject
+	}
+	if resp := touch(communicationCategoryFelica); resp["data"] == nil {
+		t.Errorf("felica: data expected: %v", resp)
+	}
+	if resp := touch(1); resp["data"] != nil || resp["statusFlag2"] != nil {
+		t.Errorf("category 1: unexpected %v", resp)
+	}
+}
@@ -0,0 +1,195 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// ファームウェアプロファイル。ファームウェアのバージョンごとに、存在しないAPIと、エラーを返すAPIを決める。
+// JSONファイルで定義し、端末の識別情報のfirmwareProfileで選ぶ。
+//
+//	[{"name":"4.xx", "firmwareVersion":"4.00r000000", "missingApis":["startHttpRequestListen"], "errorApis":{"setDisplayBrightness":-1}}]
+type firmwareProfile struct {
+	Name            string         `json:"name"`
+	Description     string         `json:"description,omitempty"`
+	FirmwareVersion string         `json:"firmwareVersion,omitempty"` // getFirmwareVersion()が返す値。空なら変更しない
+	MissingApis     []string       `json:"missingApis"`               // ProOperate()に存在しないAPI
+	ErrorApis       map[string]int `json:"errorApis"`                 // 呼ぶと常にこの値を返すAPI
+}
+
+// 存在しないAPI、エラーを返すAPIが使われた記録
+type firmwareAccess struct {
+	Time    time.Time `json:"time"`
+	Api     string    `json:"api"`
+	Kind    string    `json:"kind"` // missing: 存在しないAPIを参照した、error: エラーを返すAPIを呼んだ
+	Profile string    `json:"profile"`
+}
+
+const (
+	firmwareAccessMissing = "missing"
+	firmwareAccessError   = "error"
+)
+
+// 保持する記録の最大数
+const firmwareAccessMax = 100
+
+// prooperate.jsのProOperate()が持つAPI
+var proOperateApis = map[string]bool{
+	"startKeypadListen": true, "stopKeypadListen": true, "setKeypadDisplay": true, "getKeypadDisplay": true,
+	"setKeypadLed": true, "getKeypadLed": true, "getKeypadConnected": true,
+	"playSound": true, "stopSound": true,
+	"startCommunication": true, "stopCommunication": true,
+	"startEventListen": true, "stopEventListen": true, "getNetworkStat": true,
+	"startHttpRequestListen": true, "stopHttpRequestListen": true, "sendHttpResponse": true,
+	"getTerminalID": true, "getFirmwareVersion": true, "getContentsSetVersion": true,
+	"removeAllWebSQLDB": true, "setDate": true, "reboot": true, "shutdown": true,
+	"setDisplayBrightness": true, "getDisplayBrightness": true, "clearSettingPassword": true,
+}
+
+// 名前をキーにした、読み込んだプロファイル
+var firmwareProfiles = map[string]*firmwareProfile{}
+
+func setupFirmware(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/firmware/profiles", listFirmwareProfilesHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/firmware/accesses", getFirmwareAccessesHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/firmware/accesses", addFirmwareAccessHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/firmware/accesses", clearFirmwareAccessesHandler).Methods("DELETE")
+}
+
+// pathのJSONファイルからファームウェアプロファイルを読み込む。
+func LoadFirmwareProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list []*firmwareProfile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	profiles := map[string]*firmwareProfile{}
+	for i, p := range list {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("%v: profiles[%v]: %v", path, i, err)
+		}
+		if profiles[p.Name] != nil {
+			return fmt.Errorf("%v: duplicated profile name: %q", path, p.Name)
+		}
+		profiles[p.Name] = p
+	}
+	firmwareProfiles = profiles
+	return nil
+}
+
+func (p *firmwareProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if p.MissingApis == nil {
+		p.MissingApis = []string{}
+	}
+	if p.ErrorApis == nil {
+		p.ErrorApis = map[string]int{}
+	}
+	for _, api := range p.MissingApis {
+		if !proOperateApis[api] {
+			return fmt.Errorf("unknown api in missingApis: %q", api)
+		}
+	}
+	for api := range p.ErrorApis {
+		if !proOperateApis[api] {
+			return fmt.Errorf("unknown api in errorApis: %q", api)
+		}
+		for _, missing := range p.MissingApis {
+			if api == missing {
+				return fmt.Errorf("%q is in both missingApis and errorApis", api)
+			}
+		}
+	}
+	return nil
+}
+
+// nameのプロファイルを返す。nameが""ならnilを返す。
+func findFirmwareProfile(name string) (*firmwareProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	p := firmwareProfiles[name]
+	if p == nil {
+		return nil, fmt.Errorf("firmware profile %q not found", name)
+	}
+	return p, nil
+}
+
+func (d *device) addFirmwareAccess(a *firmwareAccess) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	a.Time = time.Now()
+	a.Profile = d.info.FirmwareProfile
+	d.accesses = append(d.accesses, a)
+	if len(d.accesses) > firmwareAccessMax {
+		d.accesses = d.accesses[len(d.accesses)-firmwareAccessMax:]
+	}
+}
+
+// 読み込んだプロファイルの一覧を、名前の順に返す
+func listFirmwareProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	list := []*firmwareProfile{}
+	for _, p := range firmwareProfiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getFirmwareAccessesHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	t.device.mutex.Lock()
+	list := append([]*firmwareAccess{}, t.device.accesses...)
+	t.device.mutex.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// prooperate.jsから、存在しないAPIを参照したとき、エラーを返すAPIを呼んだときに呼ばれる。
+//
+//	{"api":"startHttpRequestListen", "kind":"missing"}
+func addFirmwareAccessHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var a firmwareAccess
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if a.Kind != firmwareAccessMissing && a.Kind != firmwareAccessError {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid kind: %q", a.Kind))
+		return
+	}
+	t.device.addFirmwareAccess(&a)
+	if a.Kind == firmwareAccessMissing {
+		fmt.Printf("端末%v: ファームウェアプロファイル%vに存在しないAPI %vが参照されました。\n", t.id, a.Profile, a.Api)
+	} else {
+		fmt.Printf("端末%v: ファームウェアプロファイル%vでエラーを返すAPI %vが呼ばれました。\n", t.id, a.Profile, a.Api)
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func clearFirmwareAccessesHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	t.device.mutex.Lock()
+	t.device.accesses = []*firmwareAccess{}
+	t.device.mutex.Unlock()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,40 @@
+package prooperate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFirmwareProfiles(t *testing.T) {
+	defer func() { firmwareProfiles = map[string]*firmwareProfile{} }()
+	path := filepath.Join(t.TempDir(), "firmwareprofiles.json")
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`[{"name":"a", "firmwareVersion":"4.00r000000", "missingApis":["startHttpRequestListen"], "errorApis":{"reboot":-1}}]`, true},
+		{`[{"name":""}]`, false},
+		{`[{"name":"a"}, {"name":"a"}]`, false},
+		{`[{"name":"a", "missingApis":["noSuchApi"]}]`, false},
+		{`[{"name":"a", "missingApis":["reboot"], "errorApis":{"reboot":-1}}]`, false},
+	}
+	for _, tt := range tests {
+		_ = os.WriteFile(path, []byte(tt.data), 0644)
+		err := LoadFirmwareProfiles(path)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: got error %v", tt.data, err)
+		}
+	}
+
+	_ = os.WriteFile(path, []byte(tests[0].data), 0644)
+	if err := LoadFirmwareProfiles(path); err != nil {
+		t.Fatal(err)
+	}
+	d := newDevice("00000001")
+	name := "a"
+	d.set(&deviceInfoSetRequest{FirmwareProfile: &name})
+	if resp := d.resp(); resp.FirmwareVersion != "4.00r000000" || len(resp.MissingApis) != 1 || resp.ErrorApis["reboot"] != -1 {
+		t.Fatalf("unexpected resp %+v", resp)
+	}
+}
@@ -0,0 +1,210 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// startHttpRequestListen()のシミュレーション。
+// 端末ごとにHTTPサーバーを起動し、外部(POSなど)から受けたリクエストをeventNotificationでブラウザに送る。
+// ブラウザがsendHttpResponse()で返したレスポンスを、外部のクライアントに返す。
+type httpListener struct {
+	mutex     sync.Mutex
+	port      int
+	listening bool // startHttpRequestListen()中
+	nextId    int
+	pending   map[string]chan *httpResponseParam // レスポンス待ちのリクエスト
+}
+
+// ブラウザに送るリクエストのイベント。
+//
+//	{"api":"startHttpRequestListen","eventCode":0,"responseObject":{"requestId":"1","method":"POST","path":"/order","query":"","headers":{...},"body":"..."}}
+type httpRequestEvent struct {
+	RequestId string              `json:"requestId"`
+	Method    string              `json:"method"`
+	Path      string              `json:"path"`
+	Query     string              `json:"query"`
+	Headers   map[string][]string `json:"headers"`
+	Body      string              `json:"body"`
+}
+
+// startHttpRequestListenのeventCode
+const httpRequestEventReceived = 0 // リクエストを受けた
+
+// sendHttpResponse()で返すレスポンス
+type httpResponseParam struct {
+	RequestId   string            `json:"requestId"`
+	StatusCode  int               `json:"statusCode"`
+	ContentType string            `json:"contentType"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+}
+
+// リクエストのbodyの最大サイズ
+const httpRequestMaxBody = 10 * 1024 * 1024
+
+var httpResponseTimeout = 30 * time.Second
+
+func newHttpListener() *httpListener {
+	return &httpListener{pending: map[string]chan *httpResponseParam{}}
+}
+
+func setupHttpListener(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/httpRequestListen/start", startHttpRequestListenHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/httpRequestListen/stop", stopHttpRequestListenHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/httpResponse", sendHttpResponseHandler).Methods("POST")
+}
+
+// 端末ごとに、basePortから順に1つずつ増やしたポートでHTTPサーバーを起動する。
+// timeoutはsendHttpResponse()を待つ時間。
+func StartHttpRequestListeners(basePort int, timeout time.Duration) error {
+	httpResponseTimeout = timeout
+	for i, t := range terminals {
+		t.httpListener.port = basePort + i
+		server := &http.Server{
+			Addr:    fmt.Sprintf(":%v", t.httpListener.port),
+			Handler: t.httpListener.handler(t),
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- server.ListenAndServe()
+		}()
+		// Listenに失敗した場合はすぐにエラーが返るので、少しだけ待って確認する
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("port %v: %v", t.httpListener.port, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// 外部からのリクエストをブラウザに送り、sendHttpResponse()を待ってレスポンスを返すhandler
+func (l *httpListener) handler(t *terminal) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, httpRequestMaxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		l.mutex.Lock()
+		if !l.listening {
+			l.mutex.Unlock()
+			http.Error(w, "startHttpRequestListen() is not called", http.StatusServiceUnavailable)
+			return
+		}
+		l.nextId++
+		id := strconv.Itoa(l.nextId)
+		ch := make(chan *httpResponseParam, 1)
+		l.pending[id] = ch
+		l.mutex.Unlock()
+		defer func() {
+			l.mutex.Lock()
+			delete(l.pending, id)
+			l.mutex.Unlock()
+		}()
+
+		data, _ := json.Marshal(&event{
+			Api:       "startHttpRequestListen",
+			EventCode: httpRequestEventReceived,
+			ResponseObject: &httpRequestEvent{
+				RequestId: id,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Query:     r.URL.RawQuery,
+				Headers:   r.Header,
+				Body:      string(body),
+			},
+		})
+		if result := broadcast(t, data); result.Delivered == 0 {
+			http.Error(w, "no browser is connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		timer := time.NewTimer(httpResponseTimeout)
+		defer timer.Stop()
+		select {
+		case resp := <-ch:
+			for k, v := range resp.Headers {
+				w.Header().Set(k, v)
+			}
+			if resp.ContentType != "" {
+				w.Header().Set("Content-Type", resp.ContentType)
+			}
+			status := resp.StatusCode
+			if status == 0 {
+				status = http.StatusOK
+			}
+			w.WriteHeader(status)
+			io.WriteString(w, resp.Body)
+		case <-timer.C:
+			fmt.Printf("sendHttpResponse()が%vの間呼ばれませんでした。requestId=%v\n", httpResponseTimeout, id)
+			http.Error(w, "sendHttpResponse() timed out", http.StatusGatewayTimeout)
+		case <-r.Context().Done():
+		}
+	})
+}
+
+// prooperate.jsのstartHttpRequestListen()から呼ばれる
+func startHttpRequestListenHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	l := t.httpListener
+	l.mutex.Lock()
+	l.listening = true
+	port := l.port
+	l.mutex.Unlock()
+	writeJSON(w, http.StatusOK, map[string]int{"port": port})
+}
+
+// prooperate.jsのstopHttpRequestListen()から呼ばれる
+func stopHttpRequestListenHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	l := t.httpListener
+	l.mutex.Lock()
+	l.listening = false
+	l.mutex.Unlock()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// prooperate.jsのsendHttpResponse()から呼ばれ、requestIdのリクエストにレスポンスを返す。
+// requestIdのリクエストが無い(タイムアウトした、または他のタブが先に返した)場合は404を返す。
+func sendHttpResponseHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var resp httpResponseParam
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if resp.StatusCode != 0 && (resp.StatusCode < 100 || resp.StatusCode > 999) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid statusCode: %v", resp.StatusCode))
+		return
+	}
+
+	l := t.httpListener
+	l.mutex.Lock()
+	ch := l.pending[resp.RequestId]
+	delete(l.pending, resp.RequestId)
+	l.mutex.Unlock()
+	if ch == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("request %q not found", resp.RequestId))
+		return
+	}
+	ch <- &resp
+	writeJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,136 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpListener(t *testing.T) {
+	if err := setupTerminals([]string{"A"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	term := findTerminal("A")
+	server := httptest.NewServer(term.httpListener.handler(term))
+	defer server.Close()
+	m := mux.NewRouter()
+	setupHttpListener(m)
+	api := func(path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+	sub := term.events.subscribe("browser")
+	defer term.events.unsubscribe(sub)
+
+	// 外部のクライアントからリクエストを送り、レスポンスをchannelで返す
+	type clientResult struct {
+		resp *http.Response
+		body string
+	}
+	request := func() chan clientResult {
+		ch := make(chan clientResult, 1)
+		go func() {
+			resp, err := http.Post(server.URL+"/order?table=3", "text/plain", strings.NewReader("coffee"))
+			if err != nil {
+				t.Error(err)
+				ch <- clientResult{}
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			ch <- clientResult{resp, string(body)}
+		}()
+		return ch
+	}
+	// ブラウザに配送されたstartHttpRequestListenのイベント
+	receive := func() *httpRequestEvent {
+		t.Helper()
+		select {
+		case data := <-sub.ch:
+			var ev struct {
+				Api            string            `json:"api"`
+				EventCode      int               `json:"eventCode"`
+				ResponseObject *httpRequestEvent `json:"responseObject"`
+			}
+			if err := json.Unmarshal(data, &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Api != "startHttpRequestListen" || ev.EventCode != httpRequestEventReceived {
+				t.Fatalf("unexpected event %s", data)
+			}
+			return ev.ResponseObject
+		case <-time.After(time.Second):
+			t.Fatal("no event delivered")
+			return nil
+		}
+	}
+
+	// startHttpRequestListen()の前は受け付けない
+	if res := <-request(); res.resp == nil || res.resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("not listening: %+v", res.resp)
+	}
+	if w := api("/pjf/api/httpRequestListen/start", ""); w.Code != http.StatusOK {
+		t.Fatalf("start: %v %v", w.Code, w.Body.String())
+	}
+
+	// リクエスト → イベント → sendHttpResponse() → レスポンス
+	resCh := request()
+	req := receive()
+	if req.Method != "POST" || req.Path != "/order" || req.Query != "table=3" || req.Body != "coffee" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	body, _ := json.Marshal(&httpResponseParam{
+		RequestId:   req.RequestId,
+		StatusCode:  http.StatusCreated,
+		ContentType: "application/json",
+		Headers:     map[string]string{"X-Order": "1"},
+		Body:        `{"ok":true}`,
+	})
+	if w := api("/pjf/api/httpResponse", string(body)); w.Code != http.StatusOK {
+		t.Fatalf("sendHttpResponse: %v %v", w.Code, w.Body.String())
+	}
+	res := <-resCh
+	if res.resp == nil || res.resp.StatusCode != http.StatusCreated || res.body != `{"ok":true}` ||
+		res.resp.Header.Get("Content-Type") != "application/json" || res.resp.Header.Get("X-Order") != "1" {
+		t.Fatalf("unexpected response %+v %v", res.resp, res.body)
+	}
+	// 同じrequestIdには2度返せない
+	if w := api("/pjf/api/httpResponse", string(body)); w.Code != http.StatusNotFound {
+		t.Fatalf("second sendHttpResponse: %v", w.Code)
+	}
+
+	// sendHttpResponse()が呼ばれなければ504を返し、その後のsendHttpResponse()は404になる
+	saved := httpResponseTimeout
+	httpResponseTimeout = 100 * time.Millisecond
+	defer func() { httpResponseTimeout = saved }()
+	resCh = request()
+	req = receive()
+	if res := <-resCh; res.resp == nil || res.resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("timeout: %+v", res.resp)
+	}
+	body, _ = json.Marshal(&httpResponseParam{RequestId: req.RequestId, Body: "late"})
+	if w := api("/pjf/api/httpResponse", string(body)); w.Code != http.StatusNotFound {
+		t.Fatalf("late sendHttpResponse: %v", w.Code)
+	}
+
+	// stopHttpRequestListen()の後は、リクエストを受け付けず、レスポンスも返せない
+	if w := api("/pjf/api/httpRequestListen/stop", ""); w.Code != http.StatusOK {
+		t.Fatalf("stop: %v", w.Code)
+	}
+	if res := <-request(); res.resp == nil || res.resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("stopped: %+v", res.resp)
+	}
+	body, _ = json.Marshal(&httpResponseParam{RequestId: "1", Body: "stopped"})
+	if w := api("/pjf/api/httpResponse", string(body)); w.Code != http.StatusNotFound {
+		t.Fatalf("sendHttpResponse while not listening: %v", w.Code)
+	}
+	if w := api("/pjf/api/httpResponse", `{"requestId":"1","statusCode":42}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid statusCode: %v", w.Code)
+	}
+}
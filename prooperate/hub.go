@@ -0,0 +1,171 @@
+package prooperate
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// 購読者ごとのqueueの長さ。溢れた場合は古いイベントから捨てる。
+	subscriberQueueSize = 32
+	// websocketへの1回の書き込みにかけられる時間
+	writeWait = 10 * time.Second
+	// pongがこの時間返ってこなければ切断されたとみなす
+	pongWait = 60 * time.Second
+	// pingを送る間隔。pongWaitより短くすること。
+	pingPeriod = pongWait * 9 / 10
+)
+
+// eventNotificationの接続全てにイベントを配送する。
+// 遅い購読者がいても他の購読者やpublish()の呼び出し元が待たされないよう、
+// 購読者ごとにqueueを持ち、queueへの追加はブロックしない。
+type hub struct {
+	mutex       sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	ch          chan []byte
+	remoteAddr  string
+	connectedAt time.Time
+	dropped     int // queueが溢れて捨てたイベントの数。hub.mutexで保護する。
+}
+
+// publish()の結果
+type publishResult struct {
+	Clients   int `json:"clients"`   // 配送時点の購読者の数
+	Delivered int `json:"delivered"` // イベントをqueueに入れた購読者の数
+	Dropped   int `json:"dropped"`   // queueが溢れて捨てたイベントの数
+}
+
+func newHub() *hub {
+	return &hub{subscribers: map[*subscriber]struct{}{}}
+}
+
+func (h *hub) subscribe(remoteAddr string) *subscriber {
+	s := &subscriber{
+		ch:          make(chan []byte, subscriberQueueSize),
+		remoteAddr:  remoteAddr,
+		connectedAt: time.Now(),
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, s)
+	if s.dropped > 0 {
+		fmt.Printf("eventNotification: unsubscribed. remote=%v dropped=%v\n", s.remoteAddr, s.dropped)
+	}
+}
+
+// 購読者の数
+func (h *hub) count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.subscribers)
+}
+
+// 全ての購読者のqueueにdataを入れる。
+// queueが一杯の購読者については、一番古いイベントを捨ててから入れる。
+func (h *hub) publish(data []byte) publishResult {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	result := publishResult{Clients: len(h.subscribers)}
+	for s := range h.subscribers {
+		select {
+		case s.ch <- data:
+			result.Delivered++
+			continue
+		default:
+		}
+
+		// queueが一杯なので、古いものを1つ捨てる
+		first := s.dropped == 0
+		select {
+		case <-s.ch:
+			s.dropped++
+			result.Dropped++
+		default:
+		}
+		select {
+		case s.ch <- data:
+			result.Delivered++
+		default:
+			s.dropped++
+			result.Dropped++
+		}
+		// 止まっている購読者がいると毎回溢れるので、表示するのは最初の1回だけにする。
+		// 捨てた数はunsubscribe()の時に表示する。
+		if first {
+			fmt.Printf("eventNotification: queue overflow. remote=%v\n", s.remoteAddr)
+		}
+	}
+	return result
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// websocketでeventを受け取る
+func eventNotification(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// 切断を検知するためのchannel
+	// pongが返ってこない場合も、ReadMessage()がtimeoutして切断とみなす。
+	disconnectedCh := make(chan struct{}, 1)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	go func() {
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+		}
+		disconnectedCh <- struct{}{}
+	}()
+
+	s := t.events.subscribe(r.RemoteAddr)
+	defer t.events.unsubscribe(s)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-s.ch:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-disconnectedCh:
+			return
+		}
+	}
+}
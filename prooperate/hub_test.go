@@ -0,0 +1,46 @@
+package prooperate
+
+import (
+	"testing"
+)
+
+func TestHubPublishDropsOldest(t *testing.T) {
+	h := newHub()
+	slow := h.subscribe("slow")
+	fast := h.subscribe("fast")
+
+	for i := 0; i < subscriberQueueSize; i++ {
+		h.publish([]byte{byte(i)})
+		<-fast.ch
+	}
+
+	// slowのqueueは一杯なので、一番古いイベントが捨てられる
+	result := h.publish([]byte{0xFF})
+	if result.Clients != 2 || result.Delivered != 2 || result.Dropped != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if got := <-fast.ch; got[0] != 0xFF {
+		t.Fatalf("fast received %v", got)
+	}
+	if got := <-slow.ch; got[0] != 1 {
+		t.Fatalf("oldest event was not dropped. got %v", got)
+	}
+
+	// 溢れ続けても、捨てた数は購読者ごとに数える
+	for i := 0; i < 3; i++ {
+		h.publish([]byte{0})
+		<-fast.ch
+	}
+	h.mutex.Lock()
+	dropped := slow.dropped
+	h.mutex.Unlock()
+	if dropped != 3 {
+		t.Fatalf("dropped %v", dropped)
+	}
+
+	h.unsubscribe(slow)
+	h.unsubscribe(fast)
+	if result := h.publish([]byte{0}); result.Clients != 0 {
+		t.Fatalf("unsubscribed client still receives: %+v", result)
+	}
+}
@@ -0,0 +1,163 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 外付けキーパッドの状態。端末ごとに持つ。
+// prooperate.jsのsetKeypadDisplay()などから書き込まれ、/pjf/api/keypadで現在の状態と変更履歴を取得できる。
+type keypad struct {
+	mutex     sync.Mutex
+	connected bool
+	display   KeypadDisplay
+	led       json.RawMessage
+	history   []*keypadHistoryEntry
+}
+
+// キーパッドの表示。1行目と2行目。
+type KeypadDisplay struct {
+	FirstLine  string `json:"firstLine"`
+	SecondLine string `json:"secondLine"`
+}
+
+// 変更履歴の1件。変更された項目だけが入る。
+type keypadHistoryEntry struct {
+	Time      time.Time       `json:"time"`
+	Connected *bool           `json:"connected,omitempty"`
+	Display   *KeypadDisplay  `json:"display,omitempty"`
+	Led       json.RawMessage `json:"led,omitempty"`
+}
+
+// 保持する変更履歴の最大数。超えたら古いものから捨てる。
+const keypadHistoryMax = 100
+
+// getKeypadLed()の初期値
+var keypadLedOff = json.RawMessage(`"000000"`)
+
+type keypadResp struct {
+	Connected bool                  `json:"connected"`
+	Display   KeypadDisplay         `json:"display"`
+	Led       json.RawMessage       `json:"led"`
+	History   []*keypadHistoryEntry `json:"history"`
+}
+
+func newKeypad() *keypad {
+	return &keypad{
+		connected: true,
+		led:       keypadLedOff,
+		history:   []*keypadHistoryEntry{},
+	}
+}
+
+func setupKeypad(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/keypad", getKeypadHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/keypad/display", setKeypadDisplayHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/keypad/led", setKeypadLedHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/keypad/connected", setKeypadConnectedHandler).Methods("POST")
+}
+
+// k.mutexをlockした状態で呼ぶこと
+func (k *keypad) addHistoryLocked(entry *keypadHistoryEntry) {
+	entry.Time = time.Now()
+	k.history = append(k.history, entry)
+	if len(k.history) > keypadHistoryMax {
+		k.history = k.history[len(k.history)-keypadHistoryMax:]
+	}
+}
+
+func (k *keypad) setDisplay(d KeypadDisplay) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.display = d
+	k.addHistoryLocked(&keypadHistoryEntry{Display: &d})
+}
+
+func (k *keypad) setLed(led json.RawMessage) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.led = led
+	k.addHistoryLocked(&keypadHistoryEntry{Led: led})
+}
+
+func (k *keypad) setConnected(connected bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.connected = connected
+	k.addHistoryLocked(&keypadHistoryEntry{Connected: &connected})
+}
+
+func (k *keypad) resp() *keypadResp {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return &keypadResp{
+		Connected: k.connected,
+		Display:   k.display,
+		Led:       k.led,
+		History:   append([]*keypadHistoryEntry{}, k.history...),
+	}
+}
+
+// キーパッドの現在の状態と変更履歴を返す
+func getKeypadHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.keypad.resp())
+}
+
+// prooperate.jsのsetKeypadDisplay()から呼ばれる
+func setKeypadDisplayHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var d KeypadDisplay
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	t.keypad.setDisplay(d)
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// prooperate.jsのsetKeypadLed()から呼ばれる。LEDのパターンはsetKeypadLed()に渡されたものをそのまま保持する。
+func setKeypadLedHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var led json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&led); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	t.keypad.setLed(compactJSON(led))
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// キーパッドの接続状態を変える。{"connected":false}で未接続になる。
+func setKeypadConnectedHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var req struct {
+		Connected *bool `json:"connected"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if req.Connected == nil {
+		writeError(w, http.StatusBadRequest, "connected is required")
+		return
+	}
+	t.keypad.setConnected(*req.Connected)
+	writeJSON(w, http.StatusOK, t.keypad.resp())
+}
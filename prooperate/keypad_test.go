@@ -0,0 +1,29 @@
+package prooperate
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeypadHistory(t *testing.T) {
+	k := newKeypad()
+	for i := 0; i < keypadHistoryMax+5; i++ {
+		k.setDisplay(KeypadDisplay{FirstLine: fmt.Sprint(i)})
+	}
+	k.setConnected(false)
+
+	resp := k.resp()
+	if resp.Connected || resp.Display.FirstLine != fmt.Sprint(keypadHistoryMax+4) {
+		t.Fatalf("unexpected state %+v", resp)
+	}
+	if len(resp.History) != keypadHistoryMax {
+		t.Fatalf("history length %v", len(resp.History))
+	}
+	// 古い履歴から捨てられる
+	if got := resp.History[0].Display.FirstLine; got != "6" {
+		t.Fatalf("oldest history is %v", got)
+	}
+	if last := resp.History[len(resp.History)-1]; last.Connected == nil || *last.Connected {
+		t.Fatalf("last history %+v", last)
+	}
+}
@@ -0,0 +1,141 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"pro3sim/websql"
+	"sync"
+	"time"
+)
+
+// 端末の再起動、シャットダウン、電源断のシミュレーション。端末ごとに持つ。
+//
+//   - reboot: 実行中のWebSQLのtransactionが終わるのを待ってから接続を閉じ、ページをリロードさせる
+//   - shutdown: rebootと同様に接続を閉じ、ページに電源OFFの画面を表示させる。powerOnで起動する
+//   - powerCut: transactionを待たずにrollbackして接続を閉じ、ページに電源OFFの画面を表示させる
+type lifecycle struct {
+	mutex     sync.Mutex
+	poweredOn bool
+	history   []*lifecycleEntry
+}
+
+// 再起動などの記録
+type lifecycleEntry struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Source     string    `json:"source"`     // prooperate(reboot()などの呼び出し)、api
+	RolledBack int       `json:"rolledBack"` // rollbackしたtransactionの数
+}
+
+const (
+	lifecycleReboot   = "reboot"
+	lifecycleShutdown = "shutdown"
+	lifecyclePowerCut = "powerCut"
+	lifecyclePowerOn  = "powerOn"
+)
+
+// reboot,shutdownで、実行中のtransactionが終わるのを待つ最大時間
+const lifecycleGracefulTimeout = 5 * time.Second
+
+// 保持する記録の最大数
+const lifecycleHistoryMax = 100
+
+type lifecycleResp struct {
+	PoweredOn bool              `json:"poweredOn"`
+	History   []*lifecycleEntry `json:"history"`
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{poweredOn: true, history: []*lifecycleEntry{}}
+}
+
+func setupLifecycle(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/lifecycle", getLifecycleHandler).Methods("GET")
+	for _, typ := range []string{lifecycleReboot, lifecycleShutdown, lifecyclePowerCut, lifecyclePowerOn} {
+		typ := typ
+		mux.HandleFunc("/pjf/api/lifecycle/"+typ, func(w http.ResponseWriter, r *http.Request) {
+			lifecycleHandler(w, r, typ)
+		}).Methods("POST")
+	}
+}
+
+func (l *lifecycle) resp() *lifecycleResp {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return &lifecycleResp{
+		PoweredOn: l.poweredOn,
+		History:   append([]*lifecycleEntry{}, l.history...),
+	}
+}
+
+// 端末tでtypの操作を行い、記録を返す
+func (t *terminal) changeLifecycle(typ string, source string) *lifecycleEntry {
+	entry := &lifecycleEntry{Type: typ, Source: source}
+
+	switch typ {
+	case lifecycleReboot, lifecycleShutdown:
+		if !websql.WaitTransactionsInDir(t.dbDir, lifecycleGracefulTimeout) {
+			fmt.Printf("端末%v: transactionが%v以内に終わらなかったのでrollbackします。\n", t.id, lifecycleGracefulTimeout)
+		}
+		entry.RolledBack = websql.CloseConnectionsInDir(t.dbDir)
+	case lifecyclePowerCut:
+		entry.RolledBack = websql.CloseConnectionsInDir(t.dbDir)
+	}
+	if typ != lifecyclePowerOn {
+		t.resetDevice()
+	}
+
+	l := t.lifecycle
+	l.mutex.Lock()
+	l.poweredOn = typ == lifecycleReboot || typ == lifecyclePowerOn
+	entry.Time = time.Now()
+	l.history = append(l.history, entry)
+	if len(l.history) > lifecycleHistoryMax {
+		l.history = l.history[len(l.history)-lifecycleHistoryMax:]
+	}
+	l.mutex.Unlock()
+
+	fmt.Printf("端末%v: %v (rollbackしたtransaction: %v)\n", t.id, typ, entry.RolledBack)
+	data, _ := json.Marshal(&event{Api: "lifecycle", EventCode: 0, ResponseObject: entry})
+	broadcast(t, data)
+	return entry
+}
+
+// 再起動などで失われる端末の状態を初期化する
+func (t *terminal) resetDevice() {
+	felicaMutex.Lock()
+	t.communicationParam = nil
+	felicaMutex.Unlock()
+
+	t.httpListener.mutex.Lock()
+	t.httpListener.listening = false
+	t.httpListener.mutex.Unlock()
+
+	t.keypad.setDisplay(KeypadDisplay{})
+	t.keypad.setLed(keypadLedOff)
+	t.sound.stop(0)
+}
+
+// 端末の電源の状態と、再起動などの記録を返す
+func getLifecycleHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.lifecycle.resp())
+}
+
+// 再起動などを行う。prooperate.jsのreboot(),shutdown()からはクエリにsource=prooperateを付けて呼ばれる。
+func lifecycleHandler(w http.ResponseWriter, r *http.Request, typ string) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "api"
+	}
+	writeJSON(w, http.StatusOK, t.changeLifecycle(typ, source))
+}
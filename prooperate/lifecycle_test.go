@@ -0,0 +1,38 @@
+package prooperate
+
+import (
+	"pro3sim/websql"
+	"testing"
+	"time"
+)
+
+func TestLifecycleRollback(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	term := defaultTerminal()
+	dbId, _, err := websql.OpenInDir(term.dbDir, "lifecycle", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rebootは実行中のtransactionが終わるのを待つ
+	txId, _ := websql.BeginTransaction(dbId)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		websql.Commit(txId)
+	}()
+	if entry := term.changeLifecycle(lifecycleReboot, "test"); entry.RolledBack != 0 {
+		t.Fatalf("reboot rolled back %v transactions", entry.RolledBack)
+	}
+
+	// 電源断は待たずにrollbackする
+	dbId, _, _ = websql.OpenInDir(term.dbDir, "lifecycle", "", false)
+	websql.BeginTransaction(dbId)
+	if entry := term.changeLifecycle(lifecyclePowerCut, "test"); entry.RolledBack != 1 {
+		t.Fatalf("power cut rolled back %v transactions", entry.RolledBack)
+	}
+	if resp := term.lifecycle.resp(); resp.PoweredOn || len(resp.History) != 2 {
+		t.Fatalf("unexpected lifecycle %+v", resp)
+	}
+}
@@ -0,0 +1,389 @@
+package prooperate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// バックエンドのモック。/pjf/mock/ 以下へのリクエストに、mockDirのroutes.jsonで定義したレスポンスを返す。
+// 受けたリクエストは記録し、/pjf/api/mock/requestsで取得できる。
+//
+//	[
+//	    {"method": "GET", "path": "/v1/members/{id}", "file": "member.json"},
+//	    {"method": "POST", "path": "/v1/orders", "bodyJson": {"type": "cash"}, "status": 201,
+//	     "body": "{\"amount\": {{json (index .Json \"amount\")}}, \"time\": \"{{.Now.Format \"2006-01-02T15:04:05Z07:00\"}}\"}"}
+//	]
+type mockRoute struct {
+	Name         string            `json:"name,omitempty"`
+	Method       string            `json:"method,omitempty"`       // 空なら全てのメソッド
+	Path         string            `json:"path"`                   // {名前}はパスの1つの要素にマッチし、.Varsで参照できる。末尾の/*は残り全てにマッチする
+	Query        map[string]string `json:"query,omitempty"`        // 全て一致するクエリ
+	BodyJson     interface{}       `json:"bodyJson,omitempty"`     // bodyのJSONがこれを含む(オブジェクトは指定したキーだけ比べる)
+	BodyContains string            `json:"bodyContains,omitempty"` // bodyがこの文字列を含む
+	Status       int               `json:"status,omitempty"`       // 省略すると200
+	Headers      map[string]string `json:"headers,omitempty"`
+	ContentType  string            `json:"contentType,omitempty"` // 省略するとfileの拡張子から決める。bodyならapplication/json
+	File         string            `json:"file,omitempty"`        // mockDirからの相対パスのファイルを返す
+	Body         string            `json:"body,omitempty"`        // text/templateとして展開して返す
+	Delay        Duration          `json:"delay,omitempty"`
+
+	template *template.Template
+}
+
+// bodyのテンプレートに渡す値
+type mockTemplateData struct {
+	Method string
+	Path   string
+	Vars   map[string]string
+	Query  map[string]string
+	Body   string
+	Json   interface{} // bodyをJSONとしてparseしたもの。JSONでなければnil
+	Now    time.Time   // リクエストの端末(クエリのterminal。無ければ最初の端末)の時計の時刻
+}
+
+// モックが受けたリクエストの記録
+type mockRequest struct {
+	Time    time.Time           `json:"time"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	Route   string              `json:"route"` // マッチしたルートの名前。名前が無ければ"METHOD path"。マッチしなければ空
+	Status  int                 `json:"status"`
+}
+
+// 保持するリクエストの記録の最大数
+const mockRequestsMax = 1000
+
+const mockRoutesFile = "routes.json"
+
+var mockServer struct {
+	mutex    sync.Mutex
+	dir      string
+	modTime  time.Time // 読み込んだroutes.jsonの更新時刻
+	routes   []*mockRoute
+	err      error // routes.jsonの読み込みエラー
+	requests []*mockRequest
+}
+
+func setupMock(mux *mux.Router) {
+	mux.PathPrefix("/pjf/mock/").HandlerFunc(mockHandler)
+	mux.HandleFunc("/pjf/api/mock/routes", getMockRoutesHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/mock/requests", getMockRequestsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/mock/requests", clearMockRequestsHandler).Methods("DELETE")
+}
+
+// モックのroutes.jsonとファイルを置くディレクトリを設定する。
+// routes.jsonは変更されたら、次のリクエストで読み込み直す。
+func SetMockDir(dir string) error {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.dir = dir
+	mockServer.modTime = time.Time{}
+	mockServer.requests = []*mockRequest{}
+	reloadMockRoutesLocked()
+	return mockServer.err
+}
+
+// routes.jsonが変更されていれば読み込み直す。routes.jsonが無ければルートは無し。
+// 読み込みに失敗した場合は、前のルートのままにする。mockServer.mutexをlockした状態で呼ぶこと。
+func reloadMockRoutesLocked() {
+	path := filepath.Join(mockServer.dir, mockRoutesFile)
+	st, err := os.Stat(path)
+	if err != nil {
+		mockServer.routes = nil
+		mockServer.modTime = time.Time{}
+		mockServer.err = nil
+		if !os.IsNotExist(err) {
+			mockServer.err = err
+		}
+		return
+	}
+	if st.ModTime().Equal(mockServer.modTime) {
+		return
+	}
+	mockServer.modTime = st.ModTime()
+	routes, err := loadMockRoutes(path)
+	mockServer.err = err
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	mockServer.routes = routes
+	fmt.Printf("モックのルートを%vから%v件読み込みました。\n", path, len(routes))
+}
+
+func loadMockRoutes(path string) ([]*mockRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*mockRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for i, route := range routes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("%v: routes[%v]: %v", path, i, err)
+		}
+	}
+	return routes, nil
+}
+
+func (route *mockRoute) validate() error {
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("path must start with /: %q", route.Path)
+	}
+	if route.File != "" && route.Body != "" {
+		return fmt.Errorf("file and body cannot be specified at the same time")
+	}
+	if route.File != "" && (filepath.IsAbs(route.File) || strings.HasPrefix(filepath.Clean(route.File), "..")) {
+		return fmt.Errorf("file must be in the mock directory: %q", route.File)
+	}
+	if route.Status != 0 && (route.Status < 100 || route.Status > 999) {
+		return fmt.Errorf("invalid status: %v", route.Status)
+	}
+	route.Method = strings.ToUpper(route.Method)
+	if route.Name == "" {
+		route.Name = strings.TrimSpace(route.Method + " " + route.Path)
+	}
+	t, err := template.New(route.Name).Funcs(template.FuncMap{"json": mockTemplateJson}).Parse(route.Body)
+	if err != nil {
+		return err
+	}
+	route.template = t
+	return nil
+}
+
+// テンプレートで {{json .Json}} のように値をJSONにする
+func mockTemplateJson(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// pathがroute.Pathにマッチすれば、{名前}の値を返す
+func (route *mockRoute) matchPath(path string) (map[string]string, bool) {
+	pattern := strings.Split(strings.Trim(route.Path, "/"), "/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	vars := map[string]string{}
+	for i, p := range pattern {
+		if p == "*" && i == len(pattern)-1 {
+			return vars, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			vars[p[1:len(p)-1]] = parts[i]
+		} else if p != parts[i] {
+			return nil, false
+		}
+	}
+	return vars, len(parts) == len(pattern)
+}
+
+func (route *mockRoute) match(r *http.Request, path string, body []byte, bodyJson interface{}) (map[string]string, bool) {
+	if route.Method != "" && route.Method != r.Method {
+		return nil, false
+	}
+	vars, ok := route.matchPath(path)
+	if !ok {
+		return nil, false
+	}
+	q := r.URL.Query()
+	for k, v := range route.Query {
+		if q.Get(k) != v {
+			return nil, false
+		}
+	}
+	if route.BodyContains != "" && !bytes.Contains(body, []byte(route.BodyContains)) {
+		return nil, false
+	}
+	if route.BodyJson != nil && !jsonContains(bodyJson, route.BodyJson) {
+		return nil, false
+	}
+	return vars, true
+}
+
+// vがwantを含むか。オブジェクトはwantのキーだけを比べ、それ以外は一致するかを比べる。
+func jsonContains(v interface{}, want interface{}) bool {
+	if wantMap, ok := want.(map[string]interface{}); ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, w := range wantMap {
+			if !jsonContains(m[k], w) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(v, want)
+}
+
+// /pjf/mock/ 以下へのリクエストに、マッチした最初のルートのレスポンスを返す。
+// マッチしなければ404を返す。
+func mockHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	// 途中までのbodyでマッチさせないように、上限を超えたかを1byte多く読んで確かめる
+	body, err := io.ReadAll(io.LimitReader(r.Body, httpRequestMaxBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/pjf/mock")
+	query := r.URL.Query()
+	// /t/{端末ID}/ から付けられた端末の指定は記録しない
+	query.Del("terminal")
+
+	req := &mockRequest{
+		Time:    time.Now(),
+		Method:  r.Method,
+		Path:    path,
+		Query:   query.Encode(),
+		Headers: r.Header,
+	}
+	defer addMockRequest(req)
+
+	// 大きすぎるbodyはマッチさせずに413を返す。記録にもbodyは入れない
+	if len(body) > httpRequestMaxBody {
+		req.Status = http.StatusRequestEntityTooLarge
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %v bytes", httpRequestMaxBody))
+		return
+	}
+	req.Body = string(body)
+	var bodyJson interface{}
+	if json.Unmarshal(body, &bodyJson) != nil {
+		bodyJson = nil
+	}
+
+	mockServer.mutex.Lock()
+	reloadMockRoutesLocked()
+	routes := mockServer.routes
+	dir := mockServer.dir
+	mockServer.mutex.Unlock()
+
+	for _, route := range routes {
+		vars, ok := route.match(r, path, body, bodyJson)
+		if !ok {
+			continue
+		}
+		req.Route = route.Name
+		req.Status = route.respond(w, dir, &mockTemplateData{
+			Method: r.Method,
+			Path:   path,
+			Vars:   vars,
+			Query:  firstValues(query),
+			Body:   string(body),
+			Json:   bodyJson,
+			Now:    t.clock.now(),
+		})
+		return
+	}
+	req.Status = http.StatusNotFound
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no mock route for %v %v", r.Method, path))
+}
+
+func firstValues(values map[string][]string) map[string]string {
+	m := map[string]string{}
+	for k, v := range values {
+		m[k] = v[0]
+	}
+	return m
+}
+
+// レスポンスを書き、ステータスコードを返す
+func (route *mockRoute) respond(w http.ResponseWriter, dir string, data *mockTemplateData) int {
+	time.Sleep(time.Duration(route.Delay))
+
+	var body []byte
+	contentType := route.ContentType
+	if route.File != "" {
+		var err error
+		body, err = os.ReadFile(filepath.Join(dir, route.File))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("mock route %q: %v", route.Name, err))
+			return http.StatusInternalServerError
+		}
+		if contentType == "" {
+			contentType = mime.TypeByExtension(filepath.Ext(route.File))
+		}
+	} else {
+		var b bytes.Buffer
+		if err := route.template.Execute(&b, data); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("mock route %q: %v", route.Name, err))
+			return http.StatusInternalServerError
+		}
+		body = b.Bytes()
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	for k, v := range route.Headers {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", contentType)
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+	return status
+}
+
+func addMockRequest(req *mockRequest) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.requests = append(mockServer.requests, req)
+	if len(mockServer.requests) > mockRequestsMax {
+		mockServer.requests = mockServer.requests[len(mockServer.requests)-mockRequestsMax:]
+	}
+}
+
+// 読み込んだルートと、routes.jsonの読み込みエラーを返す
+func getMockRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	reloadMockRoutesLocked()
+	resp := struct {
+		Dir    string       `json:"dir"`
+		Routes []*mockRoute `json:"routes"`
+		Error  string       `json:"error,omitempty"`
+	}{Dir: mockServer.dir, Routes: append([]*mockRoute{}, mockServer.routes...)}
+	if mockServer.err != nil {
+		resp.Error = mockServer.err.Error()
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+func getMockRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	writeJSON(w, http.StatusOK, append([]*mockRequest{}, mockServer.requests...))
+}
+
+func clearMockRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+	mockServer.requests = []*mockRequest{}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,65 @@
+package prooperate
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMockRoutes(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	routes := `[
+		{"method":"GET", "path":"/v1/members/{idm}", "body":"{\"idm\":\"{{.Vars.idm}}\"}"},
+		{"method":"POST", "path":"/v1/orders", "bodyJson":{"type":"cash"}, "status":201, "body":"{{json (index .Json \"amount\")}}"},
+		{"path":"/v1/files/*", "file":"member.json"}
+	]`
+	_ = os.WriteFile(filepath.Join(dir, "routes.json"), []byte(routes), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "member.json"), []byte(`{"name":"a"}`), 0644)
+	if err := SetMockDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		resp   string
+	}{
+		{"GET", "/pjf/mock/v1/members/0011", "", 200, `{"idm":"0011"}`},
+		{"POST", "/pjf/mock/v1/orders", `{"type":"cash","amount":500}`, 201, `500`},
+		{"POST", "/pjf/mock/v1/orders", `{"type":"card","amount":500}`, 404, ""},
+		{"GET", "/pjf/mock/v1/files/a/b", "", 200, `{"name":"a"}`},
+		{"GET", "/pjf/mock/v1/members", "", 404, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mockHandler(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		body, _ := io.ReadAll(w.Body)
+		if w.Code != tt.status || (tt.resp != "" && string(body) != tt.resp) {
+			t.Errorf("%v %v: got %v %s", tt.method, tt.path, w.Code, body)
+		}
+	}
+	if len(mockServer.requests) != len(tests) || mockServer.requests[0].Route != "GET /v1/members/{idm}" {
+		t.Errorf("unexpected requests %+v", mockServer.requests)
+	}
+
+	// 上限を超えるbodyは、途中までのbodyでマッチさせずに413にする
+	large := `{"type":"cash","amount":500,"memo":"` + strings.Repeat("x", httpRequestMaxBody) + `"}`
+	w := httptest.NewRecorder()
+	mockHandler(w, httptest.NewRequest("POST", "/pjf/mock/v1/orders", strings.NewReader(large)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: got %v", w.Code)
+	}
+	last := mockServer.requests[len(mockServer.requests)-1]
+	if last.Status != http.StatusRequestEntityTooLarge || last.Route != "" || last.Body != "" {
+		t.Errorf("unexpected request %+v", last)
+	}
+}
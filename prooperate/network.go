@@ -0,0 +1,161 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 端末のネットワーク状態。startEventListenのイベントを送るか、パターン(networkpattern.go)を実行すると変わる。端末ごとに持つ。
+// /pjf/proxy/ とフォワードプロキシ経由の通信は、この状態とネットワークの種類ごとのプロファイルに従って遅延させたり失敗させたりする。
+type network struct {
+	mutex     sync.Mutex
+	eventCode int // 最後に送ったstartEventListenのeventCode
+	changedAt time.Time
+	pattern   *networkPatternRun // 実行中のパターン
+}
+
+// ネットワークの種類ごとの通信の遅延と帯域
+type networkProfile struct {
+	Latency   Duration `json:"latency"`   // リクエストごとの遅延
+	Bandwidth int64    `json:"bandwidth"` // bit/秒。0なら制限しない
+}
+
+// ネットワーク状態の名前。/pjf/api/network/profilesのキーになる。
+var networkNames = map[int]string{
+	networkEventDisconnected: "disconnected",
+	networkEventMobile:       "mobile",
+	networkEventLAN:          "lan",
+	networkEventWLAN:         "wlan",
+}
+
+var networkProfiles = struct {
+	mutex    sync.Mutex
+	profiles map[string]*networkProfile
+}{profiles: defaultNetworkProfiles()}
+
+func defaultNetworkProfiles() map[string]*networkProfile {
+	return map[string]*networkProfile{
+		"mobile": {Latency: Duration(300 * time.Millisecond), Bandwidth: 1000000},
+		"lan":    {Latency: 0, Bandwidth: 0},
+		"wlan":   {Latency: Duration(20 * time.Millisecond), Bandwidth: 20000000},
+	}
+}
+
+type networkResp struct {
+	EventCode int                `json:"eventCode"`
+	Name      string             `json:"name"`
+	ChangedAt time.Time          `json:"changedAt"`
+	Profile   *networkProfile    `json:"profile,omitempty"`
+	Pattern   *networkPatternRun `json:"pattern"` // 実行中のパターン。無ければnull
+}
+
+func newNetwork() *network {
+	// prooperate.jsのgetNetworkStat()の初期値と同じLAN
+	return &network{eventCode: networkEventLAN, changedAt: time.Now()}
+}
+
+func setupNetwork(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/network", getNetworkHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/network/profiles", getNetworkProfilesHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/network/profiles", setNetworkProfilesHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/network/profiles/reset", resetNetworkProfilesHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/network/pattern", startNetworkPatternHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/network/pattern", stopNetworkPatternHandler).Methods("DELETE")
+}
+
+// ブラウザに送るイベントがstartEventListenなら、ネットワーク状態を変える
+func (n *network) observe(data []byte) {
+	var payload EventPayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Api != "startEventListen" || payload.EventCode == nil {
+		return
+	}
+	if _, ok := networkNames[*payload.EventCode]; !ok {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.eventCode != *payload.EventCode {
+		n.eventCode = *payload.EventCode
+		n.changedAt = time.Now()
+	}
+}
+
+func (n *network) connected() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.eventCode != networkEventDisconnected
+}
+
+// 現在の状態と、その種類のプロファイルを返す。切断中ならプロファイルはnil。
+func (n *network) resp() *networkResp {
+	n.mutex.Lock()
+	resp := &networkResp{EventCode: n.eventCode, Name: networkNames[n.eventCode], ChangedAt: n.changedAt}
+	if n.pattern != nil {
+		copied := *n.pattern
+		resp.Pattern = &copied
+	}
+	n.mutex.Unlock()
+	networkProfiles.mutex.Lock()
+	if p := networkProfiles.profiles[resp.Name]; p != nil {
+		copied := *p
+		resp.Profile = &copied
+	}
+	networkProfiles.mutex.Unlock()
+	return resp
+}
+
+func getNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.network.resp())
+}
+
+func writeNetworkProfiles(w http.ResponseWriter) {
+	networkProfiles.mutex.Lock()
+	defer networkProfiles.mutex.Unlock()
+	writeJSON(w, http.StatusOK, networkProfiles.profiles)
+}
+
+func getNetworkProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	writeNetworkProfiles(w)
+}
+
+// ネットワークの種類ごとの遅延と帯域を変更する。指定した種類だけ変更する。
+//
+//	{"mobile":{"latency":"500ms", "bandwidth":256000}}
+func setNetworkProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	var req map[string]*networkProfile
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	for name, p := range req {
+		if name == networkNames[networkEventDisconnected] || defaultNetworkProfiles()[name] == nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown network: %q", name))
+			return
+		}
+		if p == nil || p.Bandwidth < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid profile: %q", name))
+			return
+		}
+	}
+	networkProfiles.mutex.Lock()
+	for name, p := range req {
+		networkProfiles.profiles[name] = p
+	}
+	networkProfiles.mutex.Unlock()
+	writeNetworkProfiles(w)
+}
+
+func resetNetworkProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	networkProfiles.mutex.Lock()
+	networkProfiles.profiles = defaultNetworkProfiles()
+	networkProfiles.mutex.Unlock()
+	writeNetworkProfiles(w)
+}
@@ -0,0 +1,290 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ネットワーク状態を自動で変化させるパターン。typeによって使う項目が異なる。
+//
+//   - flap: 接続(up)と切断をランダムな時間で繰り返す。seedが同じなら同じ順序になる。countは切断する回数で、0なら止めるまで続ける
+//   - outage: 開始からafter後に、durationの間切断する
+//   - failover: primaryで接続し、after後に切断してswitchDelay後にbackupに切り替える。failbackが0でなければ、その後primaryに戻す
+//
+// 例:
+//
+//	{"type":"flap", "seed":42, "up":1, "upMin":"5s", "upMax":"30s", "downMin":"1s", "downMax":"10s", "count":10}
+//	{"type":"outage", "up":2, "outages":[{"after":"10s", "duration":"5s"}, {"after":"1m", "duration":"30s"}]}
+//	{"type":"failover", "primary":2, "backup":1, "after":"10s", "switchDelay":"3s", "failback":"1m"}
+type NetworkPattern struct {
+	Type string `json:"type"`
+
+	// flap
+	Seed    int64    `json:"seed,omitempty"` // 0なら開始時に決めて、実行状況に表示する
+	UpMin   Duration `json:"upMin,omitempty"`
+	UpMax   Duration `json:"upMax,omitempty"`
+	DownMin Duration `json:"downMin,omitempty"`
+	DownMax Duration `json:"downMax,omitempty"`
+	Count   int      `json:"count,omitempty"`
+
+	// flap, outage
+	Up int `json:"up,omitempty"` // 接続中のstartEventListenのeventCode。省略するとパターン開始時の状態(切断中ならLAN)
+
+	// outage
+	Outages []*networkOutage `json:"outages,omitempty"`
+
+	// failover
+	Primary     int      `json:"primary,omitempty"`
+	Backup      int      `json:"backup,omitempty"`
+	After       Duration `json:"after,omitempty"`
+	SwitchDelay Duration `json:"switchDelay,omitempty"`
+	Failback    Duration `json:"failback,omitempty"`
+}
+
+type networkOutage struct {
+	After    Duration `json:"after"` // パターンの開始からの時間
+	Duration Duration `json:"duration"`
+}
+
+const (
+	networkPatternFlap     = "flap"
+	networkPatternOutage   = "outage"
+	networkPatternFailover = "failover"
+)
+
+// ネットワークをeventCodeの状態にして、holdの間そのままにする
+type networkStep struct {
+	eventCode int
+	hold      time.Duration
+}
+
+// 実行中のパターンの状況
+type networkPatternRun struct {
+	Pattern       *NetworkPattern `json:"pattern"`
+	StartedAt     time.Time       `json:"startedAt"`
+	Steps         int             `json:"steps"`         // これまでに変化させた回数
+	NextEventCode *int            `json:"nextEventCode"` // 次に変化させる状態。最後ならnull
+	NextAt        *time.Time      `json:"nextAt"`
+
+	stop chan struct{}
+}
+
+func isNetworkUp(eventCode int) bool {
+	_, ok := networkNames[eventCode]
+	return ok && eventCode != networkEventDisconnected
+}
+
+func (p *NetworkPattern) validate() error {
+	if p.Up != 0 && !isNetworkUp(p.Up) {
+		return fmt.Errorf("invalid up: %v", p.Up)
+	}
+	switch p.Type {
+	case networkPatternFlap:
+		if p.UpMax == 0 || p.DownMax == 0 {
+			return fmt.Errorf("upMax and downMax are required")
+		}
+		if p.UpMin > p.UpMax || p.DownMin > p.DownMax {
+			return fmt.Errorf("min must not be greater than max")
+		}
+		if p.Count < 0 {
+			return fmt.Errorf("invalid count: %v", p.Count)
+		}
+	case networkPatternOutage:
+		if len(p.Outages) == 0 {
+			return fmt.Errorf("outages are required")
+		}
+		sort.Slice(p.Outages, func(i, j int) bool { return p.Outages[i].After < p.Outages[j].After })
+		for i, o := range p.Outages {
+			if o.Duration == 0 {
+				return fmt.Errorf("outages[%v]: duration is required", i)
+			}
+			if i > 0 && p.Outages[i-1].After+p.Outages[i-1].Duration > o.After {
+				return fmt.Errorf("outages[%v]: overlaps the previous outage", i)
+			}
+		}
+	case networkPatternFailover:
+		if !isNetworkUp(p.Primary) || !isNetworkUp(p.Backup) {
+			return fmt.Errorf("primary and backup must be 1, 2 or 6")
+		}
+	default:
+		return fmt.Errorf("unknown type: %q", p.Type)
+	}
+	return nil
+}
+
+// パターンを、状態の変化の列にする。nextは変化が無くなったらfalseを返す。
+// upは、p.Upを省略した場合の接続中の状態。
+func (p *NetworkPattern) steps(up int) (next func() (networkStep, bool)) {
+	if p.Up != 0 {
+		up = p.Up
+	}
+	var steps []networkStep
+	switch p.Type {
+	case networkPatternFlap:
+		rng := rand.New(rand.NewSource(p.Seed))
+		between := func(min, max Duration) time.Duration {
+			if max <= min {
+				return time.Duration(min)
+			}
+			return time.Duration(min) + time.Duration(rng.Int63n(int64(max-min)))
+		}
+		downs := 0
+		down := true
+		return func() (networkStep, bool) {
+			down = !down
+			if down {
+				if p.Count != 0 && downs >= p.Count {
+					return networkStep{eventCode: up}, false
+				}
+				downs++
+				return networkStep{eventCode: networkEventDisconnected, hold: between(p.DownMin, p.DownMax)}, true
+			}
+			if p.Count != 0 && downs >= p.Count {
+				// 最後の切断の後は接続して終わる
+				return networkStep{eventCode: up}, true
+			}
+			return networkStep{eventCode: up, hold: between(p.UpMin, p.UpMax)}, true
+		}
+	case networkPatternOutage:
+		var at time.Duration
+		for _, o := range p.Outages {
+			steps = append(steps, networkStep{eventCode: up, hold: time.Duration(o.After) - at})
+			steps = append(steps, networkStep{eventCode: networkEventDisconnected, hold: time.Duration(o.Duration)})
+			at = time.Duration(o.After + o.Duration)
+		}
+		steps = append(steps, networkStep{eventCode: up})
+	case networkPatternFailover:
+		steps = append(steps,
+			networkStep{eventCode: p.Primary, hold: time.Duration(p.After)},
+			networkStep{eventCode: networkEventDisconnected, hold: time.Duration(p.SwitchDelay)},
+			networkStep{eventCode: p.Backup, hold: time.Duration(p.Failback)},
+		)
+		if p.Failback != 0 {
+			steps = append(steps, networkStep{eventCode: p.Primary})
+		}
+	}
+	return func() (networkStep, bool) {
+		if len(steps) == 0 {
+			return networkStep{}, false
+		}
+		s := steps[0]
+		steps = steps[1:]
+		return s, true
+	}
+}
+
+// 端末tでパターンを開始する。実行中のパターンがあれば止める。
+func (t *terminal) startNetworkPattern(p *NetworkPattern) *networkPatternRun {
+	if p.Type == networkPatternFlap && p.Seed == 0 {
+		p.Seed = time.Now().UnixNano()
+	}
+	n := t.network
+	n.mutex.Lock()
+	if n.pattern != nil {
+		close(n.pattern.stop)
+	}
+	up := n.eventCode
+	if !isNetworkUp(up) {
+		up = networkEventLAN
+	}
+	run := &networkPatternRun{Pattern: p, StartedAt: time.Now(), stop: make(chan struct{})}
+	n.pattern = run
+	n.mutex.Unlock()
+
+	fmt.Printf("端末%v: ネットワークのパターン%vを開始します。\n", t.id, p.Type)
+	next := p.steps(up)
+	step, ok := next()
+	go func() {
+		for ok {
+			n.mutex.Lock()
+			stopped := n.pattern != run
+			n.mutex.Unlock()
+			if stopped {
+				return
+			}
+			data, _ := json.Marshal(map[string]interface{}{"api": "startEventListen", "eventCode": step.eventCode})
+			triggerEvent(t, data, "networkPattern")
+
+			nextStep, nextOk := next()
+			n.mutex.Lock()
+			if n.pattern != run {
+				n.mutex.Unlock()
+				return
+			}
+			run.Steps++
+			run.NextEventCode, run.NextAt = nil, nil
+			if nextOk {
+				at := time.Now().Add(step.hold)
+				run.NextEventCode, run.NextAt = &nextStep.eventCode, &at
+			}
+			n.mutex.Unlock()
+			if !nextOk {
+				break
+			}
+
+			timer := time.NewTimer(step.hold)
+			select {
+			case <-timer.C:
+			case <-run.stop:
+				timer.Stop()
+				return
+			}
+			step, ok = nextStep, nextOk
+		}
+		n.mutex.Lock()
+		if n.pattern == run {
+			n.pattern = nil
+		}
+		n.mutex.Unlock()
+		fmt.Printf("端末%v: ネットワークのパターン%vが終わりました。\n", t.id, p.Type)
+	}()
+	return run
+}
+
+// 実行中のパターンを止める。止めたらtrueを返す。
+func (t *terminal) stopNetworkPattern() bool {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.pattern == nil {
+		return false
+	}
+	close(n.pattern.stop)
+	n.pattern = nil
+	return true
+}
+
+// ネットワークのパターンを開始する。実行状況は/pjf/api/networkで確認できる。
+func startNetworkPatternHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var p NetworkPattern
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	if err := p.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t.startNetworkPattern(&p)
+	writeJSON(w, http.StatusOK, t.network.resp())
+}
+
+// 実行中のパターンを止める。ネットワーク状態はそのままにする。
+func stopNetworkPatternHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	if t.stopNetworkPattern() {
+		fmt.Printf("端末%v: ネットワークのパターンを止めました。\n", t.id)
+	}
+	writeJSON(w, http.StatusOK, t.network.resp())
+}
@@ -0,0 +1,49 @@
+package prooperate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func collectNetworkSteps(p *NetworkPattern, up int) []networkStep {
+	var steps []networkStep
+	next := p.steps(up)
+	for s, ok := next(); ok; s, ok = next() {
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+func TestNetworkPatternSteps(t *testing.T) {
+	outage := &NetworkPattern{Type: networkPatternOutage, Outages: []*networkOutage{
+		{After: Duration(time.Minute), Duration: Duration(10 * time.Second)},
+		{After: Duration(10 * time.Second), Duration: Duration(5 * time.Second)},
+	}}
+	if err := outage.validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []networkStep{
+		{networkEventLAN, 10 * time.Second},
+		{networkEventDisconnected, 5 * time.Second},
+		{networkEventLAN, 45 * time.Second},
+		{networkEventDisconnected, 10 * time.Second},
+		{networkEventLAN, 0},
+	}
+	if got := collectNetworkSteps(outage, networkEventLAN); !reflect.DeepEqual(got, want) {
+		t.Errorf("outage: got %v, want %v", got, want)
+	}
+
+	// 同じseedなら同じ順序になる
+	flap := &NetworkPattern{Type: networkPatternFlap, Seed: 42, Up: networkEventMobile, UpMax: Duration(time.Minute), DownMax: Duration(time.Minute), Count: 3}
+	if err := flap.validate(); err != nil {
+		t.Fatal(err)
+	}
+	steps := collectNetworkSteps(flap, networkEventLAN)
+	if len(steps) != 7 || steps[1].eventCode != networkEventDisconnected || steps[6].eventCode != networkEventMobile {
+		t.Errorf("flap: unexpected steps %v", steps)
+	}
+	if again := collectNetworkSteps(flap, networkEventLAN); !reflect.DeepEqual(steps, again) {
+		t.Errorf("flap: got %v, then %v", steps, again)
+	}
+}
@@ -0,0 +1,209 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// eventTriggerで受け付けるイベント。apiごとに以下の形式をとる。
+//
+//	{"api":"startCommunication", "eventCode":1, "responseObject":{"category":0, "paramResult":1, "idm":"0011223344556677"}}
+//	{"api":"startCommunication", "eventCode":0, "responseObject":{"idm":"0011223344556677"}}
+//	{"api":"startEventListen", "eventCode":2}
+//	{"api":"startKeypadListen", "eventCode":1}
+type EventPayload struct {
+	Api            string          `json:"api"`
+	EventCode      *int            `json:"eventCode"`
+	ResponseObject json.RawMessage `json:"responseObject,omitempty"`
+}
+
+// startCommunicationのresponseObject。
+// FeliCaのdataなど、ここに無いフィールドもそのままコンテンツセットに渡す。
+type CommunicationResponseObject struct {
+	Category    *int    `json:"category"`
+	ParamResult *int    `json:"paramResult"`
+	Idm         *string `json:"idm"`
+}
+
+// startCommunicationのeventCode
+const (
+	communicationEventRelease = 0 // カードが離れた
+	communicationEventTouch   = 1 // カードがタッチされた
+)
+
+// startCommunicationのcategory。IDmの形式が決まっているのはFeliCaだけ。
+const communicationCategoryFelica = 0
+
+// startEventListenのeventCode
+const (
+	networkEventDisconnected = 0
+	networkEventMobile       = 1
+	networkEventLAN          = 2
+	networkEventWLAN         = 6
+)
+
+// startKeypadListenのeventCode(キーコード)の最大値
+const keypadEventCodeMax = 0xFF
+
+// イベントの検証エラーの種類
+const (
+	payloadErrInvalidJSON  = "invalid_json"
+	payloadErrUnknownApi   = "unknown_api"
+	payloadErrUnknownField = "unknown_field"
+	payloadErrMissingField = "missing_field"
+	payloadErrInvalidValue = "invalid_value"
+)
+
+// イベントの検証エラー。400のレスポンスのerrorとしてそのまま返す。
+type payloadError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *payloadError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%v: %v", e.Field, e.Message)
+	}
+	return e.Message
+}
+
+// {"error":{"code":"missing_field","field":"eventCode","message":...}} の形式で400を返す
+func writePayloadError(w http.ResponseWriter, err *payloadError) {
+	writeJSON(w, http.StatusBadRequest, &struct {
+		Error *payloadError `json:"error"`
+	}{err})
+}
+
+var supportedApis = []string{"startCommunication", "startEventListen", "startKeypadListen"}
+
+// dataをparseし、apiごとの形式に合っているか検証する
+func parseEventPayload(data []byte) (*EventPayload, *payloadError) {
+	// encoding/jsonはフィールド名の大文字小文字を区別しないが、prooperate.jsは区別するので、
+	// フィールド名はmapにして完全一致で調べる。
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, &payloadError{Code: payloadErrInvalidJSON, Message: err.Error()}
+	}
+	for name := range fields {
+		if name != "api" && name != "eventCode" && name != "responseObject" {
+			return nil, &payloadError{Code: payloadErrUnknownField, Field: name, Message: "unknown field"}
+		}
+	}
+	if _, ok := fields["api"]; !ok {
+		return nil, &payloadError{Code: payloadErrMissingField, Field: "api", Message: "api is required"}
+	}
+	if _, ok := fields["eventCode"]; !ok {
+		return nil, &payloadError{Code: payloadErrMissingField, Field: "eventCode", Message: "eventCode is required"}
+	}
+
+	var p EventPayload
+	if err := json.Unmarshal(fields["api"], &p.Api); err != nil || p.Api == "" {
+		return nil, &payloadError{Code: payloadErrInvalidValue, Field: "api", Message: "api must be a non-empty string"}
+	}
+	var code int
+	if err := json.Unmarshal(fields["eventCode"], &code); err != nil {
+		return nil, &payloadError{Code: payloadErrInvalidValue, Field: "eventCode", Message: "eventCode must be an integer"}
+	}
+	p.EventCode = &code
+	if raw, ok := fields["responseObject"]; ok && string(raw) != "null" {
+		p.ResponseObject = raw
+	}
+
+	var err *payloadError
+	switch p.Api {
+	case "startCommunication":
+		err = validateCommunicationPayload(&p)
+	case "startEventListen":
+		err = validateEventListenPayload(&p)
+	case "startKeypadListen":
+		err = validateKeypadListenPayload(&p)
+	default:
+		err = &payloadError{
+			Code:    payloadErrUnknownApi,
+			Field:   "api",
+			Message: fmt.Sprintf("unknown api %q. supported apis are %v", p.Api, strings.Join(supportedApis, ", ")),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func validateCommunicationPayload(p *EventPayload) *payloadError {
+	code := *p.EventCode
+	if code != communicationEventRelease && code != communicationEventTouch {
+		return &payloadError{Code: payloadErrInvalidValue, Field: "eventCode", Message: "eventCode must be 0 or 1"}
+	}
+	if len(p.ResponseObject) == 0 {
+		return &payloadError{Code: payloadErrMissingField, Field: "responseObject", Message: "responseObject is required"}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(p.ResponseObject, &fields); err != nil {
+		return &payloadError{Code: payloadErrInvalidValue, Field: "responseObject", Message: "responseObject must be an object"}
+	}
+
+	required := []string{"idm"}
+	if code == communicationEventTouch {
+		required = append(required, "category", "paramResult")
+	}
+	for _, name := range required {
+		if _, ok := fields[name]; !ok {
+			return &payloadError{Code: payloadErrMissingField, Field: "responseObject." + name, Message: name + " is required"}
+		}
+	}
+
+	var resp CommunicationResponseObject
+	if err := json.Unmarshal(p.ResponseObject, &resp); err != nil {
+		return &payloadError{Code: payloadErrInvalidValue, Field: "responseObject", Message: err.Error()}
+	}
+	if resp.Category != nil && *resp.Category < 0 {
+		return &payloadError{Code: payloadErrInvalidValue, Field: "responseObject.category", Message: "category must be a non-negative integer"}
+	}
+	if resp.Idm == nil || *resp.Idm == "" {
+		return &payloadError{Code: payloadErrInvalidValue, Field: "responseObject.idm", Message: "idm must be a non-empty string"}
+	}
+	// 離脱ではcategoryを省略できるので、categoryが無ければidmの形式は問わない
+	if resp.Category != nil {
+		if err := validateCategoryIdm(*resp.Category, *resp.Idm); err != nil {
+			return &payloadError{Code: payloadErrInvalidValue, Field: "responseObject.idm", Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// FeliCaのIDmは16桁の16進数。その他のcategoryのidmは空でなければよい。
+func validateCategoryIdm(category int, idm string) error {
+	if category == communicationCategoryFelica {
+		return validateIdm(idm)
+	}
+	if idm == "" {
+		return fmt.Errorf("idm is required")
+	}
+	return nil
+}
+
+func validateEventListenPayload(p *EventPayload) *payloadError {
+	switch *p.EventCode {
+	case networkEventDisconnected, networkEventMobile, networkEventLAN, networkEventWLAN:
+	default:
+		return &payloadError{Code: payloadErrInvalidValue, Field: "eventCode", Message: "eventCode must be one of 0, 1, 2, 6"}
+	}
+	if len(p.ResponseObject) != 0 {
+		return &payloadError{Code: payloadErrUnknownField, Field: "responseObject", Message: "startEventListen has no responseObject"}
+	}
+	return nil
+}
+
+func validateKeypadListenPayload(p *EventPayload) *payloadError {
+	if code := *p.EventCode; code < 0 || code > keypadEventCodeMax {
+		return &payloadError{Code: payloadErrInvalidValue, Field: "eventCode", Message: fmt.Sprintf("eventCode must be between 0 and %v", keypadEventCodeMax)}
+	}
+	if len(p.ResponseObject) != 0 {
+		return &payloadError{Code: payloadErrUnknownField, Field: "responseObject", Message: "startKeypadListen has no responseObject"}
+	}
+	return nil
+}
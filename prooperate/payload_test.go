@@ -0,0 +1,52 @@
+package prooperate
+
+import (
+	"testing"
+)
+
+func TestParseEventPayload(t *testing.T) {
+	tests := []struct {
+		data  string
+		code  string
+		field string
+	}{
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":0,"paramResult":1,"idm":"0011223344556677"}}`, "", ""},
+		{`{"api":"startCommunication", "eventCode":0, "responseObject":{"idm":"0011223344556677"}}`, "", ""},
+		{`{"api":"startEventListen", "eventCode":6}`, "", ""},
+		{`{"api":"startKeypadListen", "eventCode":1}`, "", ""},
+		{`{"api":"startComunication", "eventCode":1}`, payloadErrUnknownApi, "api"},
+		{`{"api":"startEventListen"}`, payloadErrMissingField, "eventCode"},
+		{`{"api":"startEventListen", "eventcode":1}`, payloadErrUnknownField, "eventcode"},
+		{`{"api":"startEventListen", "eventCode":3}`, payloadErrInvalidValue, "eventCode"},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"idm":"0011223344556677"}}`, payloadErrMissingField, "responseObject.category"},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":0,"paramResult":1,"idm":"00112233"}}`, payloadErrInvalidValue, "responseObject.idm"},
+		{`{"api":"startCommunication", "eventCode":0, "responseObject":{"category":0,"idm":"00112233"}}`, payloadErrInvalidValue, "responseObject.idm"},
+		// FeliCa以外のcategoryでは、IDmの形式を問わない
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":1,"paramResult":1,"idm":"04A1B2C3"}}`, "", ""},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":2,"paramResult":1,"idm":"04A1B2C3D4E5F6"}}`, "", ""},
+		{`{"api":"startCommunication", "eventCode":0, "responseObject":{"idm":"04A1B2C3"}}`, "", ""},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":1,"paramResult":1,"idm":""}}`, payloadErrInvalidValue, "responseObject.idm"},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":1,"paramResult":1,"idm":1}}`, payloadErrInvalidValue, "responseObject"},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":-1,"paramResult":1,"idm":"04A1B2C3"}}`, payloadErrInvalidValue, "responseObject.category"},
+		{`{"api":"startCommunication", "eventCode":1, "responseObject":{"category":"0","paramResult":1,"idm":"0011223344556677"}}`, payloadErrInvalidValue, "responseObject"},
+		{`{"api":"startCommunication", "eventCode":0}`, payloadErrMissingField, "responseObject"},
+		{`not json`, payloadErrInvalidJSON, ""},
+	}
+
+	for _, tt := range tests {
+		_, err := parseEventPayload([]byte(tt.data))
+		if tt.code == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", tt.data, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: error expected", tt.data)
+			continue
+		}
+		if err.Code != tt.code || err.Field != tt.field {
+			t.Errorf("%v: got code=%v field=%v, want code=%v field=%v", tt.data, err.Code, err.Field, tt.code, tt.field)
+		}
+	}
+}
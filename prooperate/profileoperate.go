@@ -15,6 +15,10 @@ type WriteRequest struct {
 }
 
 func writeFileHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
 
 	var req WriteRequest
 	d := json.NewDecoder(r.Body)
@@ -27,7 +31,7 @@ func writeFileHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
 	}
-	f, err := os.OpenFile(filepath.Join(conf.fileOperateDir, req.FileName), flag, 0644)
+	f, err := os.OpenFile(filepath.Join(t.fileOperateDir, req.FileName), flag, 0644)
 	if err != nil {
 		return
 	}
@@ -40,6 +44,10 @@ type ReadRequest struct {
 }
 
 func readFileHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
 
 	var req ReadRequest
 	d := json.NewDecoder(r.Body)
@@ -47,7 +55,7 @@ func readFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f, err := os.Open(filepath.Join(conf.fileOperateDir, req.FileName))
+	f, err := os.Open(filepath.Join(t.fileOperateDir, req.FileName))
 	if err != nil {
 		return
 	}
@@ -1,26 +1,33 @@
 package prooperate
 
 import (
+	"encoding/json"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 	"io"
 	"net/http"
 	"os"
 	"pro3sim/websql"
-	"sync"
 )
 
 var conf struct {
-	dbDir          string
-	fileOperateDir string
+	ctsDir string
+	simDir string
 }
 
-func Setup(mux *mux.Router, dbDir string, fileOperateDir string) {
-	conf.dbDir = dbDir
-	conf.fileOperateDir = fileOperateDir
+// terminalIdsは、シミュレートする端末の端末ID。最初の端末がデフォルトになる。
+func Setup(mux *mux.Router, terminalIds []string, ctsDir string, dbDir string, fileOperateDir string, simDir string) error {
+	conf.ctsDir = ctsDir
+	conf.simDir = simDir
 
-	_ = os.MkdirAll(fileOperateDir, 0755)
+	if err := setupTerminals(terminalIds, dbDir, fileOperateDir); err != nil {
+		return err
+	}
+	_ = os.MkdirAll(simDir, 0755)
+	websql.SetDBDirFunc(dbDirForRequest)
+	websql.SetNowFunc(virtualNowForDBDir)
 
+	mux.HandleFunc("/pjf/api/terminals", listTerminalsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/terminal", getTerminalHandler).Methods("GET")
 	mux.HandleFunc("/pjf/api/removeAllWebSQLDB", removeAllWebSQLDBHandler)
 	// prooperate.jsのイベントを擬似的に発生させる機構
 	mux.HandleFunc("/pjf/api/eventTrigger", eventTrigger)
@@ -29,85 +36,114 @@ func Setup(mux *mux.Router, dbDir string, fileOperateDir string) {
 	// profileoperate
 	mux.HandleFunc("/pjf/api/writeFile", writeFileHandler)
 	mux.HandleFunc("/pjf/api/readFile", readFileHandler)
+
+	// キーパッド
+	setupKeypad(mux)
+	// 音声の再生
+	setupSound(mux)
+	// 外部からのHTTPリクエスト
+	setupHttpListener(mux)
+	// 時計
+	setupClock(mux)
+	// 再起動、シャットダウン
+	setupLifecycle(mux)
+
+	// 仮想カード
+	setupCards(mux)
+	setupFelica(mux)
+
+	// シナリオ
+	setupScenario(mux)
+	// イベントの記録と再生
+	setupRecord(mux)
+	// プロバイダ設定
+	setupProviderSetting(mux)
+	// 端末の識別情報
+	setupDevice(mux)
+	setupFirmware(mux)
+	// ネットワーク状態と、バックエンドへのプロキシ
+	setupNetwork(mux)
+	setupProxy(mux)
+	// バックエンドのモック
+	setupMock(mux)
+	// 端末の状態の保存
+	setupState(mux)
+	// databaseのスナップショット
+	setupSnapshot(mux)
+	return nil
 }
 
 func removeAllWebSQLDBHandler(w http.ResponseWriter, r *http.Request) {
-	websql.DeleteAllDatabases()
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	websql.DeleteAllDatabasesInDir(t.dbDir)
+}
+
+// prooperate.jsのhandleEvent()に渡すイベント
+type event struct {
+	Api            string      `json:"api"`
+	EventCode      int         `json:"eventCode"`
+	ResponseObject interface{} `json:"responseObject,omitempty"`
 }
 
-// addChannelされたchannel全てに、eventTriggerで受け取ったデータを配送する
+// eventTriggerで受け取ったデータを検証して配送し、配送結果をJSONで返す。
+// 形式が正しくなければ、400とエラーの内容を返す。
 func eventTrigger(w http.ResponseWriter, r *http.Request) {
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		return
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	for _, ch := range channels {
-		select {
-		case ch <- data:
-		}
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	if _, perr := parseEventPayload(data); perr != nil {
+		writePayloadError(w, perr)
+		return
 	}
+	_, result := triggerEvent(t, data, "eventTrigger")
+	writeJSON(w, http.StatusOK, &result)
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// eventTriggerやシナリオなど、外部から注入されたイベントを記録し、端末tに配送する。
+// sourceは記録に残す注入元。
+// カードのタッチならFeliCaの読み書きの結果を反映するので、実際に配送したデータも返す。
+func triggerEvent(t *terminal, data []byte, source string) ([]byte, publishResult) {
+	recordEvent(t, data, source)
+	t.network.observe(data)
+	applied := applyFelicaParamToRaw(t, data)
+	return applied, broadcast(t, applied)
 }
 
-var channels = []chan []byte{}
-var mutex sync.Mutex
-
-func addChannel(ch chan []byte) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	channels = append(channels, ch)
+// 端末tのeventNotificationで接続中の全てのクライアントにdataを配送する
+func broadcast(t *terminal, data []byte) publishResult {
+	return t.events.publish(data)
 }
 
-func removeChannel(ch chan []byte) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for i, c := range channels {
-		if c == ch {
-			channels = append(channels[:i], channels[i+1:]...)
-			break
-		}
+// FeliCaのカードのタッチのイベントなら、FeliCaの読み書きの結果を反映したものを返す。
+// それ以外のイベントやparseできないデータはそのまま返す。
+func applyFelicaParamToRaw(t *terminal, data []byte) []byte {
+	var ev struct {
+		Api            string                 `json:"api"`
+		EventCode      int                    `json:"eventCode"`
+		ResponseObject map[string]interface{} `json:"responseObject"`
 	}
-}
-
-// websocketでeventを受け取る
-func eventNotification(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return data
 	}
-	defer conn.Close()
-
-	// 切断を検知するためのchannel
-	disconnectedCh := make(chan struct{}, 1)
-	go func() {
-		for {
-			_, _, err := conn.ReadMessage()
-			if err != nil {
-				break
-			}
-		}
-		disconnectedCh <- struct{}{}
-	}()
-
-	ch := make(chan []byte, 10)
-	addChannel(ch)
-	defer removeChannel(ch)
-
-	for {
-		select {
-		case msg := <-ch:
-			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-				break
-			}
-		case <-disconnectedCh:
-			return
-		}
+	if ev.Api != "startCommunication" || ev.EventCode != communicationEventTouch || ev.ResponseObject == nil {
+		return data
 	}
-
+	// FeliCa以外のカードには読み書きしない
+	if category, ok := ev.ResponseObject["category"].(float64); !ok || category != communicationCategoryFelica {
+		return data
+	}
+	applyFelicaParam(t, ev.ResponseObject)
+	applied, err := json.Marshal(&ev)
+	if err != nil {
+		return data
+	}
+	return applied
 }
@@ -0,0 +1,216 @@
+package prooperate
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// providersetting.xmlをXMLとしてparseしたもの。/pjf/api/providersettingでJSONとして取得できる。
+// 実機のプロバイダ設定のスキーマはわからないので、要素の型や値は検証しない。
+// 検証するのはXMLとして正しいか(well-formedか)だけで、要素と属性はRoot、Valuesにそのまま入れる。
+type ProviderSettingXML struct {
+	Path       string                 `json:"path"`
+	ModTime    time.Time              `json:"modTime"`
+	LoadedAt   time.Time              `json:"loadedAt"`
+	WellFormed bool                   `json:"wellFormed"` // XMLとして正しいか。空のファイルもtrue
+	Errors     []*ProviderSettingErr  `json:"errors"`
+	Root       *ProviderSettingElem   `json:"root"`
+	Values     map[string]interface{} `json:"values"` // Rootを {"要素名": {"属性名": 値, "子要素名": ...}} の形にしたもの
+}
+
+// XMLの要素
+type ProviderSettingElem struct {
+	Name       string                 `json:"name"`
+	Attributes map[string]string      `json:"attributes"`
+	Text       string                 `json:"text,omitempty"`
+	Children   []*ProviderSettingElem `json:"children,omitempty"`
+	Line       int                    `json:"line"`
+}
+
+// providersetting.xmlのエラー。lineは1から始まる行番号。
+type ProviderSettingErr struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e *ProviderSettingErr) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Message)
+}
+
+// 変更を確認する間隔
+const providerSettingPollInterval = time.Second
+
+var providerSetting struct {
+	mutex   sync.Mutex
+	current *ProviderSettingXML
+}
+
+func setupProviderSetting(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/providersetting", getProviderSettingHandler).Methods("GET")
+}
+
+// pathのprovidersetting.xmlを読み込み、XMLのエラーがあれば表示する。
+// その後はファイルの変更を監視し、変更されたら読み込み直す。
+func WatchProviderSetting(path string) {
+	s := loadProviderSetting(path)
+	setProviderSetting(s)
+	go func() {
+		for {
+			time.Sleep(providerSettingPollInterval)
+			st, err := os.Stat(path)
+			var modTime time.Time
+			if err == nil {
+				modTime = st.ModTime()
+			}
+			if !modTime.Equal(s.ModTime) {
+				s = loadProviderSetting(path)
+				fmt.Printf("%vが変更されたので読み込み直しました。\n", path)
+				setProviderSetting(s)
+			}
+		}
+	}()
+}
+
+func setProviderSetting(s *ProviderSettingXML) {
+	for _, e := range s.Errors {
+		fmt.Printf("%v:%v: %v\n", s.Path, e.Line, e.Message)
+	}
+	providerSetting.mutex.Lock()
+	providerSetting.current = s
+	providerSetting.mutex.Unlock()
+}
+
+func loadProviderSetting(path string) *ProviderSettingXML {
+	s := &ProviderSettingXML{Path: path, LoadedAt: time.Now(), Errors: []*ProviderSettingErr{}}
+	st, err := os.Stat(path)
+	if err != nil {
+		s.Errors = append(s.Errors, &ProviderSettingErr{Line: 0, Message: err.Error()})
+		return s
+	}
+	s.ModTime = st.ModTime()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		s.Errors = append(s.Errors, &ProviderSettingErr{Line: 0, Message: err.Error()})
+		return s
+	}
+	s.Root, s.Errors = parseProviderSetting(data)
+	if s.Root != nil {
+		s.Values = map[string]interface{}{s.Root.Name: s.Root.values()}
+	}
+	s.WellFormed = len(s.Errors) == 0
+	return s
+}
+
+// dataをparseし、要素の木と、見つかったエラーを返す。
+// 空のファイルはプロバイダ設定が無いものとして、エラーにしない。
+func parseProviderSetting(data []byte) (*ProviderSettingElem, []*ProviderSettingErr) {
+	errs := []*ProviderSettingErr{}
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errs
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root *ProviderSettingElem
+	var stack []*ProviderSettingElem
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			line := lineAt(d.InputOffset())
+			if se, ok := err.(*xml.SyntaxError); ok {
+				line = se.Line
+				err = fmt.Errorf("%v", se.Msg)
+			}
+			return root, append(errs, &ProviderSettingErr{Line: line, Message: err.Error()})
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			e := &ProviderSettingElem{Name: tok.Name.Local, Attributes: map[string]string{}, Line: lineAt(offset)}
+			for _, a := range tok.Attr {
+				if _, dup := e.Attributes[a.Name.Local]; dup {
+					errs = append(errs, &ProviderSettingErr{Line: e.Line, Message: fmt.Sprintf("duplicated attribute %q in <%v>", a.Name.Local, e.Name)})
+				}
+				e.Attributes[a.Name.Local] = a.Value
+			}
+			if len(stack) == 0 {
+				if root != nil {
+					errs = append(errs, &ProviderSettingErr{Line: e.Line, Message: fmt.Sprintf("multiple root elements: <%v>", e.Name)})
+				} else {
+					root = e
+				}
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, e)
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			e.Text = strings.TrimSpace(e.Text)
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(tok)
+			} else if len(bytes.TrimSpace(tok)) > 0 {
+				errs = append(errs, &ProviderSettingErr{Line: lineAt(offset), Message: "text outside of the root element"})
+			}
+		}
+	}
+	if root == nil {
+		errs = append(errs, &ProviderSettingErr{Line: 1, Message: "no root element"})
+	}
+	return root, errs
+}
+
+// 要素を、属性と子要素をキーにしたmapにする。
+// 子要素が属性も子要素も持たなければテキストを値にする。同じ名前の子要素が複数あれば配列にする。
+func (e *ProviderSettingElem) values() interface{} {
+	if len(e.Attributes) == 0 && len(e.Children) == 0 {
+		return e.Text
+	}
+	m := map[string]interface{}{}
+	for k, v := range e.Attributes {
+		m[k] = v
+	}
+	for _, c := range e.Children {
+		v := c.values()
+		switch prev := m[c.Name].(type) {
+		case nil:
+			m[c.Name] = v
+		case []interface{}:
+			m[c.Name] = append(prev, v)
+		default:
+			m[c.Name] = []interface{}{prev, v}
+		}
+	}
+	if e.Text != "" {
+		m["#text"] = e.Text
+	}
+	return m
+}
+
+// providersetting.xmlのparse結果を返す
+func getProviderSettingHandler(w http.ResponseWriter, r *http.Request) {
+	providerSetting.mutex.Lock()
+	s := providerSetting.current
+	providerSetting.mutex.Unlock()
+	if s == nil {
+		writeError(w, http.StatusNotFound, "providersetting.xml is not loaded")
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
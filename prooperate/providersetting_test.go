@@ -0,0 +1,57 @@
+package prooperate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProviderSetting(t *testing.T) {
+	tests := []struct {
+		data  string
+		lines []int // エラーの行番号
+	}{
+		{"", nil},
+		{"<setting>\n  <server url=\"https://example.com/api\" port=\"443\"/>\n</setting>\n", nil},
+		// 要素の値は検証しない
+		{"<setting>\n  <server url=\"example.com\"/>\n  <server><port>0</port></server>\n</setting>\n", nil},
+		{"<setting>\n  <server a=\"1\">\n</setting>\n", []int{3}},
+		{"<setting>\n  <server a=\"1\" a=\"2\"/>\n</setting>\n", []int{2}},
+		{"<a/>\n<b/>\n", []int{2}},
+		{"<a/>\ntext\n", []int{1}},
+	}
+	for _, tt := range tests {
+		_, errs := parseProviderSetting([]byte(tt.data))
+		if len(errs) != len(tt.lines) {
+			t.Errorf("%q: got errors %v, want lines %v", tt.data, errs, tt.lines)
+			continue
+		}
+		for i, e := range errs {
+			if e.Line != tt.lines[i] {
+				t.Errorf("%q: got error %v, want line %v", tt.data, e, tt.lines[i])
+			}
+		}
+	}
+
+	root, _ := parseProviderSetting([]byte(`<setting><server url="https://a.example/"/><server name="b" url="https://b.example/" port="8443"/><name>x</name></setting>`))
+	values := root.values().(map[string]interface{})
+	if servers, ok := values["server"].([]interface{}); !ok || len(servers) != 2 || values["name"] != "x" {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestLoadProviderSetting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providersetting.xml")
+	if s := loadProviderSetting(path); s.WellFormed || len(s.Errors) != 1 || s.Errors[0].Line != 0 {
+		t.Fatalf("missing file: %+v", s)
+	}
+	_ = os.WriteFile(path, []byte("<setting>\n  <server url=\"x\"/>\n</setting>\n"), 0644)
+	s := loadProviderSetting(path)
+	if !s.WellFormed || len(s.Errors) != 0 || s.Root.Name != "setting" || s.ModTime.IsZero() {
+		t.Fatalf("well-formed file: %+v", s)
+	}
+	_ = os.WriteFile(path, []byte("<setting>\n  <server>\n"), 0644)
+	if s := loadProviderSetting(path); s.WellFormed || len(s.Errors) != 1 {
+		t.Fatalf("broken file: %+v", s)
+	}
+}
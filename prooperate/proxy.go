@@ -0,0 +1,317 @@
+package prooperate
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// コンテンツセットからバックエンドへの通信を中継するプロキシ。
+// /pjf/proxy/{名前}/ 以下へのリクエストを、名前に対応するURLに転送する。
+//
+// 端末のネットワーク状態が切断なら、レスポンスを返さずに接続を切る。(ブラウザではネットワークエラーになる)
+// それ以外は、ネットワークの種類ごとのプロファイルに従って、リクエストを遅延させ、帯域を制限する。
+// 通信中に切断された場合も、その時点で接続を切る。
+//
+// ブラウザのプロキシに設定して使うフォワードプロキシも、端末ごとのポートで動作する。(StartForwardProxies)
+// 絶対URIのリクエストはそのURLに中継し、CONNECTはトンネルを作って中継する。
+// どちらも/pjf/proxy/と同じように、ネットワーク状態に従って失敗させたり遅延させたりする。
+
+// 名前をキーにした転送先
+var proxyTargets = map[string]*url.URL{}
+
+// 帯域を制限する場合に、一度に読み書きする大きさ
+const proxyChunkSize = 4096
+
+var errNetworkDisconnected = errors.New("network is disconnected")
+
+func setupProxy(mux *mux.Router) {
+	mux.PathPrefix("/pjf/proxy/{target}/").HandlerFunc(proxyHandler)
+}
+
+// プロキシの転送先を設定する。targetsは名前をキーにした転送先のURL。
+func SetProxyTargets(targets map[string]string) error {
+	parsed := map[string]*url.URL{}
+	for name, target := range targets {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid proxy name: %q", name)
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid proxy url: %q", target)
+		}
+		parsed[name] = u
+	}
+	proxyTargets = parsed
+	return nil
+}
+
+// /pjf/proxy/{target}/ 以下へのリクエストを、ネットワーク状態に従ってtargetの転送先に中継する。
+// コンテンツセットのURLをここに向けるか、ブラウザのプロキシをフォワードプロキシに設定すると、ネットワーク状態が反映される。
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	name := mux.Vars(r)["target"]
+	target := proxyTargets[name]
+	if target == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("proxy %q not found", name))
+		return
+	}
+
+	serveProxy(w, r, t, func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(r.URL.Path, "/pjf/proxy/"+name)
+		req.URL.RawPath = ""
+		// 端末の指定は転送しない
+		if q := req.URL.Query(); q.Has("terminal") {
+			q.Del("terminal")
+			req.URL.RawQuery = q.Encode()
+		}
+		req.Host = target.Host
+	})
+}
+
+// 端末ごとに、basePortから順に1つずつ増やしたポートでフォワードプロキシを起動する。
+func StartForwardProxies(basePort int) error {
+	for i, t := range terminals {
+		port := basePort + i
+		server := &http.Server{
+			Addr:    fmt.Sprintf(":%v", port),
+			Handler: forwardProxyHandler(t),
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- server.ListenAndServe()
+		}()
+		// Listenに失敗した場合はすぐにエラーが返るので、少しだけ待って確認する
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("port %v: %v", port, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// 端末tのフォワードプロキシのhandler
+func forwardProxyHandler(t *terminal) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			serveTunnel(w, r, t)
+			return
+		}
+		if !r.URL.IsAbs() {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		serveProxy(w, r, t, func(req *http.Request) {
+			req.Host = req.URL.Host
+		})
+	})
+}
+
+// ネットワーク状態に従って遅延させてから、現在のネットワークのプロファイルを返す。
+// 切断されていれば接続を切る。
+func waitProxyNetwork(t *terminal, r *http.Request) *networkProfile {
+	n := t.network.resp()
+	if n.Profile == nil {
+		abortProxy(t, r)
+	}
+	time.Sleep(time.Duration(n.Profile.Latency))
+	if !t.network.connected() {
+		abortProxy(t, r)
+	}
+	return n.Profile
+}
+
+// ネットワーク状態に従って、directorで書き換えたリクエストを中継する
+func serveProxy(w http.ResponseWriter, r *http.Request, t *terminal, director func(req *http.Request)) {
+	profile := waitProxyNetwork(t, r)
+
+	proxy := &httputil.ReverseProxy{
+		Director: director,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if !t.network.connected() {
+				abortProxy(t, r)
+			}
+			fmt.Printf("端末%v: %vへの転送に失敗しました: %v\n", t.id, req.URL, err)
+			writeError(w, http.StatusBadGateway, err.Error())
+		},
+	}
+	if r.Body != nil {
+		r.Body = &throttledReader{ReadCloser: r.Body, t: t, bandwidth: profile.Bandwidth}
+	}
+	proxy.ServeHTTP(&throttledWriter{ResponseWriter: w, t: t, bandwidth: profile.Bandwidth}, r)
+}
+
+// CONNECTのリクエストで、転送先とのトンネルを作って中継する。
+// 中継するデータは帯域を制限し、切断されたら(通信していない間でも)接続を切る。
+func serveTunnel(w http.ResponseWriter, r *http.Request, t *terminal) {
+	profile := waitProxyNetwork(t, r)
+
+	dst, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		if !t.network.connected() {
+			abortProxy(t, r)
+		}
+		fmt.Printf("端末%v: %vへの転送に失敗しました: %v\n", t.id, r.Host, err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		dst.Close()
+		writeError(w, http.StatusInternalServerError, "hijacking is not supported")
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		dst.Close()
+		return
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			close(done)
+			conn.Close()
+			dst.Close()
+		})
+	}
+	// bufにはHijack()までに読まれたデータが残っている場合がある
+	go copyTunnel(dst, buf, t, profile.Bandwidth, closeAll)
+	go copyTunnel(conn, dst, t, profile.Bandwidth, closeAll)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !t.network.connected() {
+				fmt.Printf("端末%v: ネットワークが切断されたため、%vへの通信を切りました。\n", t.id, r.Host)
+				closeAll()
+				return
+			}
+		}
+	}
+}
+
+// 帯域を制限してsrcからdstにコピーする。どちらかが終わるか切断されたら、closeAllで両方の接続を閉じる。
+func copyTunnel(dst io.Writer, src io.Reader, t *terminal, bandwidth int64, closeAll func()) {
+	defer closeAll()
+	p := make([]byte, proxyChunkSize)
+	for {
+		n, err := src.Read(p)
+		if n > 0 {
+			if !t.network.connected() {
+				return
+			}
+			waitBandwidth(n, bandwidth)
+			if _, werr := dst.Write(p[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ネットワークが切断されているので、レスポンスを返さずに接続を切る
+func abortProxy(t *terminal, r *http.Request) {
+	fmt.Printf("端末%v: ネットワークが切断されているため、%vへの通信を失敗させました。\n", t.id, proxyRequestName(r))
+	panic(http.ErrAbortHandler)
+}
+
+// ログに出す中継先。CONNECTならホストとポート、絶対URIならクエリを除いたURL。
+func proxyRequestName(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return r.Host
+	}
+	if r.URL.IsAbs() {
+		return r.URL.Scheme + "://" + r.URL.Host + r.URL.Path
+	}
+	return r.URL.Path
+}
+
+// bandwidth(bit/秒)の速さでn byteを送るのにかかる時間、待つ
+func waitBandwidth(n int, bandwidth int64) {
+	if bandwidth > 0 {
+		time.Sleep(time.Duration(int64(n) * 8 * int64(time.Second) / bandwidth))
+	}
+}
+
+// 帯域を制限してリクエストのbodyを読む。切断されたらエラーを返す。
+type throttledReader struct {
+	io.ReadCloser
+	t         *terminal
+	bandwidth int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if !r.t.network.connected() {
+		return 0, errNetworkDisconnected
+	}
+	if len(p) > proxyChunkSize {
+		p = p[:proxyChunkSize]
+	}
+	n, err := r.ReadCloser.Read(p)
+	waitBandwidth(n, r.bandwidth)
+	return n, err
+}
+
+// 帯域を制限してレスポンスを書く。切断されたら接続を切る。
+type throttledWriter struct {
+	http.ResponseWriter
+	t         *terminal
+	bandwidth int64
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if !w.t.network.connected() {
+			panic(http.ErrAbortHandler)
+		}
+		chunk := p
+		if len(chunk) > proxyChunkSize {
+			chunk = chunk[:proxyChunkSize]
+		}
+		waitBandwidth(len(chunk), w.bandwidth)
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if w.bandwidth > 0 {
+			w.Flush()
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
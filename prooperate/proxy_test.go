@@ -0,0 +1,140 @@
+package prooperate
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer backend.Close()
+	if err := SetProxyTargets(map[string]string{"api": backend.URL + "/base"}); err != nil {
+		t.Fatal(err)
+	}
+	m := mux.NewRouter()
+	setupProxy(m)
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/pjf/proxy/api/v1/orders?terminal=T&a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/base/v1/orders?a=1" {
+		t.Fatalf("unexpected response %q", body)
+	}
+
+	// 切断中はレスポンスを返さずに接続を切る
+	defaultTerminal().network.observe([]byte(`{"api":"startEventListen","eventCode":0}`))
+	if resp, err := http.Get(server.URL + "/pjf/proxy/api/v1/orders"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request succeeded while disconnected: %v", resp.Status)
+	}
+}
+
+func TestForwardProxy(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+r.URL.Path+"?"+r.URL.RawQuery)
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+	proxy := httptest.NewServer(forwardProxyHandler(defaultTerminal()))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := tlsBackend.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport}
+	get := func(u string) (string, error) {
+		resp, err := client.Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// 絶対URIのリクエストはそのURLに中継する
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	if body, err := get(backend.URL + "/v1/orders?a=1"); err != nil || body != backendHost+"/v1/orders?a=1" {
+		t.Fatalf("http: %q %v", body, err)
+	}
+	// httpsはCONNECTのトンネルで中継する
+	tlsHost := strings.TrimPrefix(tlsBackend.URL, "https://")
+	if body, err := get(tlsBackend.URL + "/v1/orders"); err != nil || body != tlsHost+"/v1/orders?" {
+		t.Fatalf("https: %q %v", body, err)
+	}
+
+	// プロキシへのリクエストでなければ400
+	resp, err := http.Get(proxy.URL + "/v1/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("direct request: %v", resp.Status)
+	}
+
+	// 切断中はどちらも失敗する
+	transport.CloseIdleConnections()
+	defaultTerminal().network.observe([]byte(`{"api":"startEventListen","eventCode":0}`))
+	if _, err := get(backend.URL + "/v1/orders"); err == nil {
+		t.Fatal("http request succeeded while disconnected")
+	}
+	if _, err := get(tlsBackend.URL + "/v1/orders"); err == nil {
+		t.Fatal("https request succeeded while disconnected")
+	}
+}
+
+func TestForwardProxyTunnelDisconnect(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer tlsBackend.Close()
+	proxy := httptest.NewServer(forwardProxyHandler(defaultTerminal()))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(tlsBackend.URL, "https://")
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+
+	// 通信していない間に切断されても、トンネルを閉じる
+	defaultTerminal().network.observe([]byte(`{"api":"startEventListen","eventCode":0}`))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("tunnel is not closed: %v", err)
+	}
+}
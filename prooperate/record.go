@@ -0,0 +1,241 @@
+package prooperate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 注入されたイベントの記録。セッションファイルに1行1イベントのJSONで保存する。
+//
+//	{"time":"2024-10-31T12:00:00.123+09:00","source":"eventTrigger","terminal":"00000000","event":{"api":"startEventListen","eventCode":0}}
+type recordEntry struct {
+	Time     time.Time       `json:"time"`
+	Source   string          `json:"source"`
+	Terminal string          `json:"terminal,omitempty"`
+	Event    json.RawMessage `json:"event"`
+}
+
+const recordFileExt = ".jsonl"
+
+// 記録中のセッション。最初のイベントを記録する時にファイルを作る。
+var recorder struct {
+	mutex sync.Mutex
+	name  string
+	file  *os.File
+}
+
+func setupRecord(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/record/sessions", listRecordSessionsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/record/sessions/{name}", getRecordSessionHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/record/new", newRecordSessionHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/replay", replayHandler).Methods("POST")
+}
+
+func recordDir() string {
+	return filepath.Join(conf.simDir, "record")
+}
+
+// 端末tに送るdataを記録中のセッションに追記する。リプレイで再生したイベントは記録しない。
+func recordEvent(t *terminal, data []byte, source string) {
+	if source == "replay" || !json.Valid(data) {
+		return
+	}
+	entry := recordEntry{Time: time.Now(), Source: source, Terminal: t.id, Event: compactJSON(data)}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file == nil {
+		if err := openRecordSessionLocked(); err != nil {
+			fmt.Printf("イベントの記録ファイルを作成できません: %v\n", err)
+			return
+		}
+	}
+	recorder.file.Write(append(line, '\n'))
+}
+
+func compactJSON(data []byte) json.RawMessage {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// recorder.mutexをlockした状態で呼ぶこと
+func openRecordSessionLocked() error {
+	if err := os.MkdirAll(recordDir(), 0755); err != nil {
+		return err
+	}
+	base := time.Now().Format("20060102-150405")
+	name := base
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(recordDir(), name+recordFileExt)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%v-%v", base, i)
+	}
+	f, err := os.OpenFile(filepath.Join(recordDir(), name+recordFileExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	recorder.name = name
+	recorder.file = f
+	fmt.Printf("イベントを %v に記録します。\n", f.Name())
+	return nil
+}
+
+type recordSessionsResp struct {
+	Current  string   `json:"current"`
+	Sessions []string `json:"sessions"`
+}
+
+func listRecordSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := recordSessionsResp{Sessions: []string{}}
+	files, _ := os.ReadDir(recordDir())
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), recordFileExt) {
+			resp.Sessions = append(resp.Sessions, strings.TrimSuffix(f.Name(), recordFileExt))
+		}
+	}
+	sort.Strings(resp.Sessions)
+
+	recorder.mutex.Lock()
+	resp.Current = recorder.name
+	recorder.mutex.Unlock()
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+func recordSessionPath(name string) string {
+	return filepath.Join(recordDir(), filepath.Base(name)+recordFileExt)
+}
+
+func getRecordSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	http.ServeFile(w, r, recordSessionPath(mux.Vars(r)["name"]))
+}
+
+// 記録中のセッションを閉じる。次のイベントからは新しいセッションファイルに記録する。
+func newRecordSessionHandler(w http.ResponseWriter, r *http.Request) {
+	recorder.mutex.Lock()
+	closed := recorder.name
+	if recorder.file != nil {
+		recorder.file.Close()
+	}
+	recorder.file = nil
+	recorder.name = ""
+	recorder.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{"closed": closed})
+}
+
+// 記録したセッションを再生する。
+// クエリのsessionにセッション名を指定するか、bodyにセッションファイルの内容を入れる。
+// クエリのspeedで再生速度の倍率を指定できる。(2なら2倍速、0なら待ち時間なし)
+// イベントは記録した端末に送る。クエリのterminalを指定すると、全てのイベントをその端末に送る。
+// 再生はシナリオとして実行するので、状況は/pjf/api/scenario/runsで確認できる。
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	terminalId := r.URL.Query().Get("terminal")
+	speed := 1.0
+	if s := r.URL.Query().Get("speed"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid speed: %q", s))
+			return
+		}
+		speed = v
+	}
+
+	var in io.Reader
+	name := r.URL.Query().Get("session")
+	if name != "" {
+		f, err := os.Open(recordSessionPath(name))
+		if err != nil {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		defer f.Close()
+		in = f
+	} else {
+		name = "request body"
+		in = r.Body
+	}
+
+	s, err := replayScenario(in, speed, terminalId)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.Name = "replay " + name
+	s.Terminal = t.id
+
+	run := startScenario(s, "replay")
+	waitAndWriteScenarioRun(w, r, run)
+}
+
+// セッションファイルを、記録した時間間隔をspeedで割った待ち時間で再生するシナリオにする。
+// terminalIdが""でなければ、記録した端末の代わりにその端末に送る。
+func replayScenario(in io.Reader, speed float64, terminalId string) (*Scenario, error) {
+	s := &Scenario{}
+	var prev time.Time
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry recordEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNo, err)
+		}
+		ev, perr := parseEventPayload(entry.Event)
+		if perr != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNo, perr)
+		}
+
+		step := &ScenarioStep{
+			Name:     fmt.Sprintf("line %v", lineNo),
+			Api:      ev.Api,
+			Terminal: entry.Terminal,
+			raw:      entry.Event,
+		}
+		if terminalId != "" {
+			step.Terminal = terminalId
+		}
+		if step.Terminal != "" && findTerminal(step.Terminal) == nil {
+			return nil, fmt.Errorf("line %v: terminal %q not found", lineNo, step.Terminal)
+		}
+		if !prev.IsZero() && speed > 0 && entry.Time.After(prev) {
+			step.Delay = Duration(float64(entry.Time.Sub(prev)) / speed)
+		}
+		prev = entry.Time
+		s.Steps = append(s.Steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("session is empty")
+	}
+	return s, nil
+}
@@ -0,0 +1,173 @@
+package prooperate
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupRecordTest(t *testing.T) *mux.Router {
+	t.Helper()
+	conf.simDir = t.TempDir()
+	if err := setupTerminals([]string{"A", "B"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	m := mux.NewRouter()
+	m.HandleFunc("/pjf/api/eventTrigger", eventTrigger)
+	setupRecord(m)
+	// 他のテストで記録中のセッションを閉じる
+	closeSession := func() { m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/pjf/api/record/new", nil)) }
+	closeSession()
+	t.Cleanup(closeSession)
+	return m
+}
+
+func TestRecordEvent(t *testing.T) {
+	m := setupRecordTest(t)
+
+	for _, req := range []struct{ query, body string }{
+		{"", `{"api":"startEventListen", "eventCode":0}`},
+		{"?terminal=B", `{"api":"startKeypadListen","eventCode":1}`},
+	} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", "/pjf/api/eventTrigger"+req.query, strings.NewReader(req.body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("eventTrigger: %v %v", w.Code, w.Body.String())
+		}
+	}
+	// リプレイで再生したイベントは記録しない
+	triggerEvent(findTerminal("A"), []byte(`{"api":"startKeypadListen","eventCode":3}`), "replay")
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/pjf/api/record/sessions", nil))
+	var sessions recordSessionsResp
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	if sessions.Current == "" || len(sessions.Sessions) != 1 || sessions.Sessions[0] != sessions.Current {
+		t.Fatalf("sessions %+v", sessions)
+	}
+
+	data, err := os.ReadFile(recordSessionPath(sessions.Current))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("recorded %v lines: %v", len(lines), string(data))
+	}
+	var entries []recordEntry
+	for _, line := range lines {
+		var e recordEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if e := entries[0]; e.Source != "eventTrigger" || e.Terminal != "A" || string(e.Event) != `{"api":"startEventListen","eventCode":0}` {
+		t.Errorf("entry 0: %+v %s", e, e.Event)
+	}
+	if e := entries[1]; e.Terminal != "B" || e.Time.Before(entries[0].Time) {
+		t.Errorf("entry 1: %+v", e)
+	}
+
+	// 新しいセッションにすると、次のイベントは別のファイルに記録する
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("POST", "/pjf/api/record/new", nil))
+	if !strings.Contains(w.Body.String(), sessions.Current) {
+		t.Fatalf("new: %v", w.Body.String())
+	}
+	triggerEvent(findTerminal("A"), []byte(`{"api":"startEventListen","eventCode":2}`), "scenario")
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/pjf/api/record/sessions", nil))
+	sessions = recordSessionsResp{}
+	json.Unmarshal(w.Body.Bytes(), &sessions)
+	if len(sessions.Sessions) != 2 || sessions.Current != sessions.Sessions[1] {
+		t.Fatalf("sessions %+v", sessions)
+	}
+}
+
+func recordLines(entries ...recordEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, _ := json.Marshal(&e)
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	return &buf
+}
+
+func TestReplayScenario(t *testing.T) {
+	setupRecordTest(t)
+
+	start := time.Date(2024, 10, 31, 12, 0, 0, 0, time.UTC)
+	session := func() *bytes.Buffer {
+		return recordLines(
+			recordEntry{Time: start, Source: "eventTrigger", Terminal: "A", Event: json.RawMessage(`{"api":"startEventListen","eventCode":0}`)},
+			recordEntry{Time: start.Add(2 * time.Second), Source: "eventTrigger", Terminal: "B", Event: json.RawMessage(`{"api":"startKeypadListen","eventCode":1}`)},
+			recordEntry{Time: start.Add(3 * time.Second), Source: "card", Terminal: "A", Event: json.RawMessage(`{"api":"startEventListen","eventCode":2}`)},
+		)
+	}
+
+	// 記録した時間間隔をspeedで割った待ち時間になる
+	s, err := replayScenario(session(), 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Steps) != 3 {
+		t.Fatalf("steps %+v", s.Steps)
+	}
+	for i, want := range []time.Duration{0, time.Second, 500 * time.Millisecond} {
+		if got := time.Duration(s.Steps[i].Delay); got != want {
+			t.Errorf("step %v: delay %v, want %v", i, got, want)
+		}
+	}
+	if s.Steps[0].Terminal != "A" || s.Steps[1].Terminal != "B" || s.Steps[1].Name != "line 2" {
+		t.Errorf("steps %+v %+v", s.Steps[0], s.Steps[1])
+	}
+
+	// speed=0なら待ち時間なし。terminalを指定すると全てのイベントをその端末に送る
+	s, err = replayScenario(session(), 0, "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, step := range s.Steps {
+		if step.Delay != 0 || step.Terminal != "B" {
+			t.Errorf("step %v: %+v", i, step)
+		}
+	}
+
+	// 実行すると記録したイベントがそのまま配送される
+	a := findTerminal("A").events.subscribe("a")
+	defer findTerminal("A").events.unsubscribe(a)
+	s, _ = replayScenario(session(), 0, "")
+	run := startScenario(s, "replay")
+	<-run.doneCh
+	for _, want := range []string{"startEventListen:0", "startEventListen:2"} {
+		if got := receiveEvent(t, a); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReplayScenarioError(t *testing.T) {
+	setupRecordTest(t)
+
+	valid := `{"time":"2024-10-31T12:00:00Z","terminal":"A","event":{"api":"startEventListen","eventCode":0}}`
+	for _, c := range []struct{ in, terminal, want string }{
+		{valid + "\n" + `{"time":"2024-10-31T12:00:01Z","terminal":"X","event":{"api":"startEventListen","eventCode":0}}`, "", `line 2: terminal "X" not found`},
+		{valid, "X", `line 1: terminal "X" not found`},
+		{valid + "\n\n" + `{"time":`, "", "line 3: "},
+		{valid + "\n" + `{"time":"2024-10-31T12:00:01Z","event":{"api":"startEventListen","eventCode":9}}`, "", "line 2: "},
+		{"\n", "", "session is empty"},
+	} {
+		_, err := replayScenario(strings.NewReader(c.in), 1, c.terminal)
+		if err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want %v", c.in, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// シナリオ。stepsを順に、各stepのdelayだけ待ってから実行する。
+//
+//	{
+//	    "name": "touch then network down",
+//	    "steps": [
+//	        {"name": "touch", "card": "member1"},
+//	        {"name": "network off", "delay": "2s", "api": "startEventListen", "eventCode": 0},
+//	        {"name": "LAN", "delay": "1s", "api": "startEventListen", "eventCode": 2},
+//	        {"name": "keys", "repeat": 3, "steps": [
+//	            {"delay": "200ms", "api": "startKeypadListen", "eventCode": 1}
+//	        ]}
+//	    ]
+//	}
+//
+// terminalにはイベントを送る端末の端末IDを指定する。省略した場合は最初の端末になる。
+// ステップごとにterminalを指定すると、そのステップだけ別の端末に送る。
+type Scenario struct {
+	Name     string          `json:"name"`
+	Terminal string          `json:"terminal,omitempty"`
+	Steps    []*ScenarioStep `json:"steps"`
+}
+
+// シナリオの1ステップ。api, card, stepsのいずれか1つを指定する。
+//   - api: eventTriggerと同じ形式のイベントを発生させる
+//   - card: 登録済みの仮想カードのタッチを発生させる。holdで離すまでの時間を指定できる。
+//   - steps: stepsをrepeat回繰り返す。stepsは空にできない。
+//
+// cardとterminalは、読み込むときに存在を確認する。
+type ScenarioStep struct {
+	Name           string          `json:"name,omitempty"`
+	Delay          Duration        `json:"delay,omitempty"`
+	Api            string          `json:"api,omitempty"`
+	EventCode      int             `json:"eventCode,omitempty"`
+	ResponseObject json.RawMessage `json:"responseObject,omitempty"`
+	Card           string          `json:"card,omitempty"`
+	Hold           Duration        `json:"hold,omitempty"`
+	Repeat         int             `json:"repeat,omitempty"`
+	Steps          []*ScenarioStep `json:"steps,omitempty"`
+	Terminal       string          `json:"terminal,omitempty"`
+
+	raw json.RawMessage // リプレイ用。指定されていればapiなどの代わりにそのまま配送する。
+}
+
+// "1.5s"のような文字列、またはミリ秒の数値で表した時間
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(v * float64(time.Millisecond)))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", b)
+	}
+	if *d < 0 {
+		return fmt.Errorf("negative duration: %s", b)
+	}
+	return nil
+}
+
+const scenarioMaxRuns = 20
+
+var errScenarioStopped = errors.New("stopped")
+
+// シナリオの実行状況
+type scenarioRun struct {
+	ID         int                 `json:"id"`
+	Name       string              `json:"name"`
+	Terminal   string              `json:"terminal"`
+	Status     string              `json:"status"` // running, done, stopped, failed
+	Error      string              `json:"error,omitempty"`
+	StartedAt  time.Time           `json:"startedAt"`
+	FinishedAt *time.Time          `json:"finishedAt,omitempty"`
+	Log        []*scenarioLogEntry `json:"log"`
+
+	source string // triggerEvent()に渡す注入元
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+type scenarioLogEntry struct {
+	Time     time.Time      `json:"time"`
+	Step     string         `json:"step"`
+	Api      string         `json:"api,omitempty"`
+	Card     string         `json:"card,omitempty"`
+	Terminal string         `json:"terminal"`
+	Result   *publishResult `json:"result,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+var scenarioRuns = map[int]*scenarioRun{}
+var scenarioNextId int
+var scenarioMutex sync.Mutex
+
+func setupScenario(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/scenario", listScenarioFilesHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/scenario/run", runScenarioHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/scenario/runs", listScenarioRunsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/scenario/runs/{id}", getScenarioRunHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/scenario/runs/{id}/stop", stopScenarioRunHandler).Methods("POST")
+}
+
+func scenarioDir() string {
+	return filepath.Join(conf.simDir, "scenario")
+}
+
+// シナリオファイルを読み込んで検証する
+func loadScenarioFile(path string) (*Scenario, error) {
+	var s Scenario
+	if err := readJSONFile(path, &s); err != nil {
+		return nil, err
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(path)
+	}
+	if err := validateScenario(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func validateScenario(s *Scenario) error {
+	if len(s.Steps) == 0 {
+		return errors.New("steps is empty")
+	}
+	if s.Terminal != "" && findTerminal(s.Terminal) == nil {
+		return fmt.Errorf("terminal %q not found", s.Terminal)
+	}
+	return validateSteps(s.Steps, "steps")
+}
+
+func validateSteps(steps []*ScenarioStep, path string) error {
+	for i, step := range steps {
+		p := fmt.Sprintf("%v[%v]", path, i)
+		if step == nil {
+			return fmt.Errorf("%v: step is null", p)
+		}
+		if step.Terminal != "" && findTerminal(step.Terminal) == nil {
+			return fmt.Errorf("%v: terminal %q not found", p, step.Terminal)
+		}
+		kinds := 0
+		if step.Api != "" {
+			kinds++
+		}
+		if step.Card != "" {
+			kinds++
+			if findCard(step.Card) == nil {
+				return fmt.Errorf("%v: card %q not found", p, step.Card)
+			}
+		}
+		if step.Steps != nil {
+			kinds++
+			if step.Repeat < 0 {
+				return fmt.Errorf("%v: repeat must not be negative", p)
+			}
+			// 空のstepsを繰り返すと、待たずに回り続ける
+			if len(step.Steps) == 0 {
+				return fmt.Errorf("%v: steps is empty", p)
+			}
+			if err := validateSteps(step.Steps, p+".steps"); err != nil {
+				return err
+			}
+		}
+		if step.Repeat != 0 && step.Steps == nil {
+			return fmt.Errorf("%v: repeat requires steps", p)
+		}
+		if kinds != 1 {
+			return fmt.Errorf("%v: exactly one of api, card or steps is required", p)
+		}
+		if step.Api != "" {
+			if _, err := parseEventPayload(step.eventData()); err != nil {
+				return fmt.Errorf("%v: %v", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// シナリオファイルを読み込み、eventNotificationのクライアントが接続するのを待ってから実行する。
+// 起動時に-scenarioで指定されたシナリオを実行するためのもの。
+func RunScenarioFile(path string) error {
+	s, err := loadScenarioFile(path)
+	if err != nil {
+		return err
+	}
+	t := findTerminalOrDefault(s.Terminal)
+	go func() {
+		for t.events.count() == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		startScenario(s, "scenario")
+	}()
+	return nil
+}
+
+// シナリオの実行を開始する。実行はgoroutineで行い、すぐに返る。
+func startScenario(s *Scenario, source string) *scenarioRun {
+	scenarioMutex.Lock()
+	defer scenarioMutex.Unlock()
+
+	scenarioNextId++
+	run := &scenarioRun{
+		ID:        scenarioNextId,
+		Name:      s.Name,
+		Terminal:  findTerminalOrDefault(s.Terminal).id,
+		Status:    "running",
+		StartedAt: time.Now(),
+		Log:       []*scenarioLogEntry{},
+		source:    source,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	scenarioRuns[run.ID] = run
+	// 古い実行結果は捨てる
+	for id, old := range scenarioRuns {
+		if id <= run.ID-scenarioMaxRuns && old.Status != "running" {
+			delete(scenarioRuns, id)
+		}
+	}
+
+	fmt.Printf("シナリオを開始します。id=%v name=%v\n", run.ID, run.Name)
+	go run.execute(s)
+	return run
+}
+
+func (run *scenarioRun) execute(s *Scenario) {
+	err := run.executeSteps(s.Steps, "")
+
+	scenarioMutex.Lock()
+	now := time.Now()
+	run.FinishedAt = &now
+	switch err {
+	case nil:
+		run.Status = "done"
+	case errScenarioStopped:
+		run.Status = "stopped"
+	default:
+		run.Status = "failed"
+		run.Error = err.Error()
+	}
+	fmt.Printf("シナリオが終了しました。id=%v name=%v status=%v\n", run.ID, run.Name, run.Status)
+	scenarioMutex.Unlock()
+	close(run.doneCh)
+}
+
+func (run *scenarioRun) executeSteps(steps []*ScenarioStep, prefix string) error {
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		name = prefix + name
+
+		if err := run.sleep(time.Duration(step.Delay)); err != nil {
+			return err
+		}
+
+		if step.Steps != nil {
+			repeat := step.Repeat
+			if repeat == 0 {
+				repeat = 1
+			}
+			for n := 0; n < repeat; n++ {
+				if err := run.executeSteps(step.Steps, fmt.Sprintf("%v#%v/", name, n+1)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := run.executeStep(step, name); err == errScenarioStopped {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("step %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (run *scenarioRun) executeStep(step *ScenarioStep, name string) error {
+	t := findTerminalOrDefault(step.Terminal)
+	if step.Terminal == "" {
+		t = findTerminal(run.Terminal)
+	}
+	entry := &scenarioLogEntry{Step: name, Api: step.Api, Card: step.Card, Terminal: t.id}
+	defer func() {
+		entry.Time = time.Now()
+		scenarioMutex.Lock()
+		run.Log = append(run.Log, entry)
+		scenarioMutex.Unlock()
+	}()
+
+	if step.Card != "" {
+		c := findCard(step.Card)
+		if c == nil {
+			entry.Error = "card not found"
+			return fmt.Errorf("card %q not found", step.Card)
+		}
+		_, err := touchCard(t, c, time.Duration(step.Hold), run.source, run.sleep)
+		return err
+	}
+
+	_, result := triggerEvent(t, step.eventData(), run.source)
+	entry.Result = &result
+	return nil
+}
+
+// apiを指定したステップの、eventTriggerと同じ形式のデータ
+func (step *ScenarioStep) eventData() []byte {
+	if step.raw != nil {
+		return step.raw
+	}
+	data, _ := json.Marshal(&EventPayload{
+		Api:            step.Api,
+		EventCode:      &step.EventCode,
+		ResponseObject: step.ResponseObject,
+	})
+	return data
+}
+
+// dだけ待つ。途中でstopされたらerrScenarioStoppedを返す。
+func (run *scenarioRun) sleep(d time.Duration) error {
+	if d <= 0 {
+		select {
+		case <-run.stopCh:
+			return errScenarioStopped
+		default:
+			return nil
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-run.stopCh:
+		return errScenarioStopped
+	}
+}
+
+func listScenarioFilesHandler(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	files, _ := os.ReadDir(scenarioDir())
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+// シナリオを実行する。
+// クエリのfileに simDir/scenario/ 以下のファイル名を指定するか、bodyにシナリオのJSONを入れる。
+// クエリにwait=1を付けると、シナリオが終わるまで待ってから実行結果を返す。
+// クエリのterminalを指定すると、シナリオのterminalより優先する。
+func runScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var s *Scenario
+	if file := r.URL.Query().Get("file"); file != "" {
+		loaded, err := loadScenarioFile(filepath.Join(scenarioDir(), filepath.Base(file)))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("cannot load scenario: %v", err))
+			return
+		}
+		s = loaded
+	} else {
+		var body Scenario
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+			return
+		}
+		if err := validateScenario(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s = &body
+	}
+	if r.URL.Query().Get("terminal") != "" {
+		s.Terminal = t.id
+	}
+
+	run := startScenario(s, "scenario")
+	waitAndWriteScenarioRun(w, r, run)
+}
+
+// クエリにwait=1が付いていれば、シナリオが終わるまで待ってから実行結果を返す
+func waitAndWriteScenarioRun(w http.ResponseWriter, r *http.Request, run *scenarioRun) {
+	if r.URL.Query().Get("wait") != "" {
+		select {
+		case <-run.doneCh:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	writeScenarioRun(w, run)
+}
+
+func writeScenarioRun(w http.ResponseWriter, run *scenarioRun) {
+	scenarioMutex.Lock()
+	body, _ := json.Marshal(run)
+	scenarioMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func findScenarioRun(w http.ResponseWriter, r *http.Request) *scenarioRun {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	scenarioMutex.Lock()
+	run := scenarioRuns[id]
+	scenarioMutex.Unlock()
+	if run == nil {
+		writeError(w, http.StatusNotFound, "scenario run not found")
+	}
+	return run
+}
+
+func listScenarioRunsHandler(w http.ResponseWriter, r *http.Request) {
+	scenarioMutex.Lock()
+	list := make([]*scenarioRun, 0, len(scenarioRuns))
+	for _, run := range scenarioRuns {
+		list = append(list, run)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	body, _ := json.Marshal(list)
+	scenarioMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func getScenarioRunHandler(w http.ResponseWriter, r *http.Request) {
+	if run := findScenarioRun(w, r); run != nil {
+		writeScenarioRun(w, run)
+	}
+}
+
+func stopScenarioRunHandler(w http.ResponseWriter, r *http.Request) {
+	run := findScenarioRun(w, r)
+	if run == nil {
+		return
+	}
+	scenarioMutex.Lock()
+	if run.Status == "running" {
+		select {
+		case <-run.stopCh:
+		default:
+			close(run.stopCh)
+		}
+	}
+	scenarioMutex.Unlock()
+	<-run.doneCh
+	writeScenarioRun(w, run)
+}
@@ -0,0 +1,268 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscriberに配送されたイベントのapiとeventCodeを、"startKeypadListen:1"の形式で返す
+func receiveEvent(t *testing.T, s *subscriber) string {
+	t.Helper()
+	select {
+	case data := <-s.ch:
+		var ev struct {
+			Api       string `json:"api"`
+			EventCode int    `json:"eventCode"`
+		}
+		if err := json.Unmarshal(data, &ev); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%v:%v", ev.Api, ev.EventCode)
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+		return ""
+	}
+}
+
+func parseScenario(t *testing.T, data string) *Scenario {
+	t.Helper()
+	var s Scenario
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func TestScenarioRun(t *testing.T) {
+	conf.simDir = t.TempDir()
+	if err := setupTerminals([]string{"A", "B"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	cardsMutex.Lock()
+	cards = map[string]*Card{"member1": {Name: "member1", Idm: "0011223344556677", Category: 0, ParamResult: 1}}
+	cardsMutex.Unlock()
+	defer func() {
+		cardsMutex.Lock()
+		cards = map[string]*Card{}
+		cardsMutex.Unlock()
+	}()
+	a := findTerminal("A").events.subscribe("a")
+	b := findTerminal("B").events.subscribe("b")
+
+	s := parseScenario(t, `{
+		"name": "test",
+		"steps": [
+			{"name": "lan", "api": "startEventListen", "eventCode": 2},
+			{"name": "key", "delay": "100ms", "api": "startKeypadListen", "eventCode": 1, "terminal": "B"},
+			{"name": "keys", "repeat": 2, "steps": [{"api": "startKeypadListen", "eventCode": 3}]},
+			{"name": "touch", "card": "member1"}
+		]
+	}`)
+	if err := validateScenario(s); err != nil {
+		t.Fatal(err)
+	}
+	run := startScenario(s, "scenario")
+	select {
+	case <-run.doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scenario did not finish")
+	}
+
+	// terminalを指定したステップだけBに送られる
+	for _, want := range []string{
+		"startEventListen:2", "startKeypadListen:3", "startKeypadListen:3",
+		"startCommunication:1", "startCommunication:0",
+	} {
+		if got := receiveEvent(t, a); got != want {
+			t.Errorf("A: got %v, want %v", got, want)
+		}
+	}
+	if got := receiveEvent(t, b); got != "startKeypadListen:1" {
+		t.Errorf("B: got %v", got)
+	}
+
+	m := mux.NewRouter()
+	setupScenario(m)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/pjf/api/scenario/runs", nil))
+	var runs []*scenarioRun
+	if err := json.Unmarshal(w.Body.Bytes(), &runs); err != nil {
+		t.Fatal(err)
+	}
+	var got *scenarioRun
+	for _, r := range runs {
+		if r.ID == run.ID {
+			got = r
+		}
+	}
+	if got == nil || got.Status != "done" || got.Terminal != "A" || got.FinishedAt == nil {
+		t.Fatalf("unexpected run %+v", got)
+	}
+	var steps []string
+	for _, e := range got.Log {
+		steps = append(steps, e.Step+"@"+e.Terminal)
+	}
+	if want := "lan@A key@B keys#1/0@A keys#2/0@A touch@A"; strings.Join(steps, " ") != want {
+		t.Fatalf("log %v, want %v", steps, want)
+	}
+	if r := got.Log[1].Result; r == nil || r.Clients != 1 || r.Delivered != 1 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	// delayだけ待ってから実行される
+	if d := got.Log[1].Time.Sub(got.Log[0].Time); d < 100*time.Millisecond {
+		t.Errorf("delay not applied: %v", d)
+	}
+}
+
+func TestScenarioRunFailedAndStopped(t *testing.T) {
+	conf.simDir = t.TempDir()
+	if err := setupTerminals([]string{"A"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	m := mux.NewRouter()
+	setupScenario(m)
+
+	// 登録されていないカードのステップで失敗する
+	run := startScenario(parseScenario(t, `{"steps":[{"name":"touch","card":"nobody"}]}`), "scenario")
+	<-run.doneCh
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/pjf/api/scenario/runs/%v", run.ID), nil))
+	var got scenarioRun
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Status != "failed" || got.Error != `step touch: card "nobody" not found` {
+		t.Fatalf("unexpected run %+v", got)
+	}
+
+	// delayの途中で止められる
+	run = startScenario(parseScenario(t, `{"steps":[{"delay":"10s","api":"startKeypadListen","eventCode":1}]}`), "scenario")
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/pjf/api/scenario/runs/%v/stop", run.ID), nil))
+	got = scenarioRun{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Status != "stopped" || len(got.Log) != 0 {
+		t.Fatalf("unexpected run %+v", got)
+	}
+
+	// カードのholdの途中でも止められ、離脱のイベントを送ってから終わる
+	cardsMutex.Lock()
+	cards = map[string]*Card{"member1": {Name: "member1", Idm: "0011223344556677"}}
+	cardsMutex.Unlock()
+	defer func() {
+		cardsMutex.Lock()
+		cards = map[string]*Card{}
+		cardsMutex.Unlock()
+	}()
+	a := findTerminal("A").events.subscribe("a")
+	run = startScenario(parseScenario(t, `{"steps":[{"name":"touch","card":"member1","hold":"10s"}]}`), "scenario")
+	if got := receiveEvent(t, a); got != "startCommunication:1" {
+		t.Fatalf("got %v", got)
+	}
+	start := time.Now()
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/pjf/api/scenario/runs/%v/stop", run.ID), nil))
+	got = scenarioRun{}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.Status != "stopped" || time.Since(start) > 5*time.Second {
+		t.Fatalf("unexpected run %+v", got)
+	}
+	if got := receiveEvent(t, a); got != "startCommunication:0" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestValidateScenario(t *testing.T) {
+	if err := setupTerminals([]string{"A", "B"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	cardsMutex.Lock()
+	cards = map[string]*Card{"member1": {Name: "member1", Idm: "0011223344556677"}}
+	cardsMutex.Unlock()
+	defer func() {
+		cardsMutex.Lock()
+		cards = map[string]*Card{}
+		cardsMutex.Unlock()
+	}()
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`{"steps":[{"api":"startKeypadListen","eventCode":1}]}`, ""},
+		{`{"terminal":"B","steps":[{"card":"member1","terminal":"A"},{"repeat":2,"steps":[{"api":"startEventListen","eventCode":0}]}]}`, ""},
+		{`{"steps":[]}`, "steps is empty"},
+		{`{"terminal":"X","steps":[{"card":"member1"}]}`, `terminal "X" not found`},
+		{`{"steps":[{"card":"member1","terminal":"X"}]}`, `steps[0]: terminal "X" not found`},
+		{`{"steps":[null]}`, "steps[0]: step is null"},
+		{`{"steps":[{"delay":"1s"}]}`, "steps[0]: exactly one of api, card or steps is required"},
+		{`{"steps":[{"api":"startKeypadListen","card":"member1"}]}`, "steps[0]: exactly one of api, card or steps is required"},
+		{`{"steps":[{"repeat":-1,"steps":[{"card":"member1"}]}]}`, "steps[0]: repeat must not be negative"},
+		{`{"steps":[{"card":"nobody"}]}`, `steps[0]: card "nobody" not found`},
+		{`{"steps":[{"api":"startKeypadListen","eventCode":1},{"repeat":2,"steps":[{"card":"member1"},{"card":"nobody"}]}]}`, `steps[1].steps[1]: card "nobody" not found`},
+		{`{"steps":[{"repeat":1000,"steps":[]}]}`, "steps[0]: steps is empty"},
+		{`{"steps":[{"repeat":2,"steps":[{"steps":[]}]}]}`, "steps[0].steps[0]: steps is empty"},
+		{`{"steps":[{"repeat":2}]}`, "steps[0]: repeat requires steps"},
+		{`{"steps":[{"repeat":2,"card":"member1"}]}`, "steps[0]: repeat requires steps"},
+		{`{"steps":[{"steps":[{"api":"startEventListen","eventCode":3}]}]}`, "steps[0].steps[0]: eventCode: eventCode must be one of 0, 1, 2, 6"},
+		{`{"steps":[{"api":"startComunication","eventCode":1}]}`, `steps[0]: api: unknown api "startComunication". supported apis are startCommunication, startEventListen, startKeypadListen`},
+	}
+	for _, tt := range tests {
+		err := validateScenario(parseScenario(t, tt.data))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", tt.data, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%v: got %v, want %v", tt.data, err, tt.err)
+		}
+	}
+
+	// delayは"1.5s"のような文字列か、ミリ秒の数値
+	s := parseScenario(t, `{"steps":[{"delay":1500,"card":"a"},{"delay":"1.5s","card":"a"}]}`)
+	if s.Steps[0].Delay != Duration(1500*time.Millisecond) || s.Steps[1].Delay != s.Steps[0].Delay {
+		t.Errorf("unexpected delay %v %v", s.Steps[0].Delay, s.Steps[1].Delay)
+	}
+	var d Duration
+	if err := json.Unmarshal([]byte(`"-1s"`), &d); err == nil {
+		t.Errorf("negative delay accepted")
+	}
+}
+
+func TestRunScenarioHandlerInvalid(t *testing.T) {
+	conf.simDir = t.TempDir()
+	if err := setupTerminals([]string{"A"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	m := mux.NewRouter()
+	setupScenario(m)
+	_ = os.MkdirAll(scenarioDir(), 0755)
+	_ = os.WriteFile(filepath.Join(scenarioDir(), "bad.json"), []byte(`{"steps":[{"repeat":3,"steps":[]}]}`), 0644)
+
+	// 実行する前に、どのステップが不正かを返す
+	for _, c := range []struct {
+		url, body, err string
+	}{
+		{"/pjf/api/scenario/run", `{"steps":[{"name":"touch","card":"nobody"}]}`, `steps[0]: card "nobody" not found`},
+		{"/pjf/api/scenario/run?file=bad.json", "", "cannot load scenario: steps[0]: steps is empty"},
+	} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", c.url, strings.NewReader(c.body)))
+		var got struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if w.Code != http.StatusBadRequest || got.Error.Message != c.err {
+			t.Errorf("%v: %v %v", c.url, w.Code, w.Body.String())
+		}
+	}
+}
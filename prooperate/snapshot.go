@@ -0,0 +1,370 @@
+package prooperate
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pro3sim/websql"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// データベースのスナップショット。端末のdbDir(指定すればfileOperateDirも)を simDir/snapshots/{名前}/ にコピーし、後で元に戻す。
+// テストを「来店履歴が3回ある会員」のような状態から始めるためのもの。
+//
+// 保存はSQLiteのbackup APIでコピーするので、WebSQLの接続は閉じず、端末の状態も変えない。
+// 復元はdbDirの中の一時ディレクトリにコピーしてから、接続を閉じてdatabaseのファイルを1つずつrenameで入れ替える。
+// dbDir自体は入れ替えないので、dbDirがマウントポイントでもよく、database以外のファイル(.gitkeepなど)はそのまま残る。
+// 途中で失敗しても元のファイルに戻すので、途中の状態のdatabaseが開かれることはない。
+// 復元の後は、端末を再起動してページをリロードさせる。(閉じた接続をコンテンツセットが使い続けないように)
+
+const snapshotMetaFile = "snapshot.json"
+
+var snapshotNamePattern = regexp.MustCompile(`^[0-9A-Za-z_-][0-9A-Za-z._-]*$`)
+
+type snapshotInfo struct {
+	Name      string    `json:"name"`
+	Terminal  string    `json:"terminal"` // 保存した端末
+	CreatedAt time.Time `json:"createdAt"`
+	Databases []string  `json:"databases"` // 含まれるdatabaseの名前
+	Files     bool      `json:"files"`     // fileOperateDirを含むか
+}
+
+type snapshotResp struct {
+	Snapshot   *snapshotInfo `json:"snapshot"`
+	RolledBack int           `json:"rolledBack"` // 復元で接続を閉じる時にrollbackしたtransactionの数。保存では0
+}
+
+func setupSnapshot(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/snapshots", listSnapshotsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/snapshots/{name}", saveSnapshotHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/snapshots/{name}", deleteSnapshotHandler).Methods("DELETE")
+	mux.HandleFunc("/pjf/api/snapshots/{name}/restore", restoreSnapshotHandler).Methods("POST")
+}
+
+func snapshotsDir() string {
+	return filepath.Join(conf.simDir, "snapshots")
+}
+
+func loadSnapshot(name string) (*snapshotInfo, error) {
+	var info snapshotInfo
+	if err := readJSONFile(filepath.Join(snapshotsDir(), name, snapshotMetaFile), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func listSnapshots() ([]*snapshotInfo, error) {
+	entries, err := os.ReadDir(snapshotsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	list := []*snapshotInfo{}
+	for _, e := range entries {
+		if !e.IsDir() || !snapshotNamePattern.MatchString(e.Name()) {
+			continue
+		}
+		if info, err := loadSnapshot(e.Name()); err == nil {
+			list = append(list, info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// 端末tのdatabaseを、nameのスナップショットとして保存する。同じ名前があれば置き換える。
+// filesがtrueならfileOperateDirも保存する。
+func (t *terminal) saveSnapshot(name string, files bool) (*snapshotResp, error) {
+	dir := filepath.Join(snapshotsDir(), name)
+	tmp := filepath.Join(snapshotsDir(), "."+name+".tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := websql.BackupDatabasesInDir(t.dbDir, filepath.Join(tmp, "db"), lifecycleGracefulTimeout); err != nil {
+		return nil, err
+	}
+	if files {
+		if err := copyDir(t.fileOperateDir, filepath.Join(tmp, "files"), true); err != nil {
+			return nil, err
+		}
+	}
+
+	info := &snapshotInfo{Name: name, Terminal: t.id, CreatedAt: time.Now(), Databases: []string{}, Files: files}
+	dbs, err := websql.ListDatabasesInDir(filepath.Join(tmp, "db"))
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbs {
+		info.Databases = append(info.Databases, db.Name)
+	}
+	if err := writeJSONFile(filepath.Join(tmp, snapshotMetaFile), info); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("端末%v: スナップショット%vを保存しました。(database: %v件)\n", t.id, name, len(info.Databases))
+	return &snapshotResp{Snapshot: info}, nil
+}
+
+// nameのスナップショットを端末tに復元する。スナップショットに無いdatabaseは削除される。
+// スナップショットにfileOperateDirが含まれていれば、fileOperateDirも置き換える。
+func (t *terminal) restoreSnapshot(name string) (*snapshotResp, error) {
+	info, err := loadSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(snapshotsDir(), name)
+
+	// 先に入れ替え先のディレクトリの中にコピーしておき、接続を閉じている間はrenameだけにする
+	stageDb := filepath.Join(t.dbDir, snapshotStageDir)
+	stageFiles := filepath.Join(t.fileOperateDir, snapshotStageDir)
+	defer os.RemoveAll(stageDb)
+	defer os.RemoveAll(stageFiles)
+	if err := os.RemoveAll(stageDb); err != nil {
+		return nil, err
+	}
+	if err := copyDir(filepath.Join(dir, "db"), stageDb, false); err != nil {
+		return nil, err
+	}
+	if info.Files {
+		if err := os.RemoveAll(stageFiles); err != nil {
+			return nil, err
+		}
+		if err := copyDir(filepath.Join(dir, "files"), stageFiles, true); err != nil {
+			return nil, err
+		}
+	}
+
+	isDatabase := func(e os.DirEntry) bool { return !e.IsDir() && websql.IsDatabaseFile(e.Name()) }
+	all := func(e os.DirEntry) bool { return true }
+	rolledBack, err := websql.WithConnectionsClosedInDir(t.dbDir, lifecycleGracefulTimeout, func() error {
+		oldDb, err := swapEntries(t.dbDir, stageDb, isDatabase)
+		if err != nil {
+			return err
+		}
+		if info.Files {
+			oldFiles, err := swapEntries(t.fileOperateDir, stageFiles, all)
+			if err != nil {
+				undoSwapEntries(t.dbDir, oldDb, isDatabase)
+				return err
+			}
+			if err := os.RemoveAll(oldFiles); err != nil {
+				fmt.Printf("%vを削除できません: %v\n", oldFiles, err)
+			}
+		}
+		if err := os.RemoveAll(oldDb); err != nil {
+			fmt.Printf("%vを削除できません: %v\n", oldDb, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("端末%v: スナップショット%vを復元しました。\n", t.id, name)
+	t.changeLifecycle(lifecycleReboot, "snapshot")
+	return &snapshotResp{Snapshot: info, RolledBack: rolledBack}, nil
+}
+
+// srcのファイルをdstにコピーする。recursiveでなければ、サブディレクトリはコピーしない。
+// (端末が複数の場合、dbDirの下には端末ごとのディレクトリがあるため)
+func copyDir(src string, dst string, recursive bool) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s, d := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		switch {
+		case e.IsDir():
+			if recursive {
+				if err := copyDir(s, d, true); err != nil {
+					return err
+				}
+			}
+		case e.Type().IsRegular():
+			if err := copyFile(s, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// 復元で、入れ替えるファイルをコピーしておくディレクトリと、入れ替えた元のファイルを移すディレクトリ。
+// どちらも入れ替えるディレクトリの中に作る。(同じファイルシステムの中でrenameするため)
+const (
+	snapshotStageDir = ".snapshot-restore"
+	snapshotOldDir   = ".snapshot-old"
+)
+
+func isSnapshotWorkDir(name string) bool {
+	return name == snapshotStageDir || name == snapshotOldDir
+}
+
+// dirのうちmatchするエントリを、stagedのエントリとrenameで1つずつ入れ替え、元のエントリを移したディレクトリを返す。
+// matchしないエントリはそのまま残す。
+// 途中で失敗したら元に戻すので、dirは元のままか、stagedの内容のどちらかになる。
+func swapEntries(dir string, staged string, match func(e os.DirEntry) bool) (string, error) {
+	old := filepath.Join(dir, snapshotOldDir)
+	if err := os.RemoveAll(old); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(old, 0755); err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if isSnapshotWorkDir(e.Name()) || !match(e) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, e.Name()), filepath.Join(old, e.Name())); err != nil {
+			undoSwapEntries(dir, old, match)
+			return "", err
+		}
+	}
+	stagedEntries, err := os.ReadDir(staged)
+	if err != nil && !os.IsNotExist(err) {
+		undoSwapEntries(dir, old, match)
+		return "", err
+	}
+	for _, e := range stagedEntries {
+		if err := os.Rename(filepath.Join(staged, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			undoSwapEntries(dir, old, match)
+			return "", err
+		}
+	}
+	return old, nil
+}
+
+// swapEntries()で入れ替えたdirのエントリを、oldのエントリに戻す
+func undoSwapEntries(dir string, old string, match func(e os.DirEntry) bool) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if isSnapshotWorkDir(e.Name()) || !match(e) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			fmt.Printf("%vを元に戻せません: %v\n", dir, err)
+			return
+		}
+	}
+	oldEntries, _ := os.ReadDir(old)
+	for _, e := range oldEntries {
+		if err := os.Rename(filepath.Join(old, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			fmt.Printf("%vを元に戻せません: %v\n", dir, err)
+			return
+		}
+	}
+	os.RemoveAll(old)
+}
+
+func snapshotName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["name"]
+	if !snapshotNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid snapshot name: %q", name))
+		return "", false
+	}
+	return name, true
+}
+
+func listSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := listSnapshots()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// スナップショットを保存する。クエリにfiles=1を付けると、fileOperateDirも保存する。
+func saveSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	name, ok := snapshotName(w, r)
+	if !ok {
+		return
+	}
+	resp, err := t.saveSnapshot(name, r.URL.Query().Get("files") == "1")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func restoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	name, ok := snapshotName(w, r)
+	if !ok {
+		return
+	}
+	resp, err := t.restoreSnapshot(name)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("snapshot %q not found", name))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func deleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := snapshotName(w, r)
+	if !ok {
+		return
+	}
+	if _, err := loadSnapshot(name); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("snapshot %q not found", name))
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(snapshotsDir(), name)); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,149 @@
+package prooperate
+
+import (
+	"os"
+	"path/filepath"
+	"pro3sim/websql"
+	"testing"
+)
+
+func countVisits(t *testing.T, dir string) int64 {
+	dbId, _, err := websql.OpenInDir(dir, "member", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer websql.Close(dbId)
+	txId, _ := websql.BeginTransaction(dbId)
+	defer websql.Commit(txId)
+	_, _, rows, err := websql.Exec(txId, "SELECT COUNT(*) AS n FROM visits", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows[0]["n"].(int64)
+}
+
+func TestSnapshot(t *testing.T) {
+	conf.simDir = t.TempDir()
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	term := defaultTerminal()
+	_ = os.WriteFile(filepath.Join(term.dbDir, ".gitkeep"), nil, 0644)
+	dbId, _, _ := websql.OpenInDir(term.dbDir, "member", "", false)
+	txId, _ := websql.BeginTransaction(dbId)
+	websql.Exec(txId, "CREATE TABLE visits (id INTEGER PRIMARY KEY)", nil)
+	websql.Exec(txId, "INSERT INTO visits VALUES (1), (2), (3)", nil)
+	websql.Commit(txId)
+	_ = os.WriteFile(filepath.Join(term.fileOperateDir, "a.txt"), []byte("a"), 0644)
+
+	// 保存中のtransactionの、commitしていない変更は含まれない
+	pendingTxId, _ := websql.BeginTransaction(dbId)
+	websql.Exec(pendingTxId, "INSERT INTO visits VALUES (100)", nil)
+	resp, err := term.saveSnapshot("three-visits", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Snapshot.Databases) != 1 || resp.Snapshot.Databases[0] != "member" {
+		t.Fatalf("unexpected snapshot %+v", resp.Snapshot)
+	}
+	if err := websql.Abort(pendingTxId); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存しても接続は閉じないので、同じdbIdを使い続けられる
+	txId, err = websql.BeginTransaction(dbId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 保存した後の変更は、復元すると無くなる
+	websql.Exec(txId, "INSERT INTO visits VALUES (4)", nil)
+	if err := websql.Commit(txId); err != nil {
+		t.Fatal(err)
+	}
+	websql.OpenInDir(term.dbDir, "other", "", false)
+	_ = os.Remove(filepath.Join(term.fileOperateDir, "a.txt"))
+	if n := countVisits(t, term.dbDir); n != 4 {
+		t.Fatalf("visits = %v", n)
+	}
+
+	if _, err := term.restoreSnapshot("three-visits"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countVisits(t, term.dbDir); n != 3 {
+		t.Fatalf("visits = %v after restore", n)
+	}
+	if dbs, _ := websql.ListDatabasesInDir(term.dbDir); len(dbs) != 1 {
+		t.Fatalf("unexpected databases %+v", dbs)
+	}
+	// database以外のファイルは残り、作業用のディレクトリは残らない
+	entries, _ := os.ReadDir(term.dbDir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != ".gitkeep" || !websql.IsDatabaseFile(names[1]) {
+		t.Fatalf("unexpected files in dbDir %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(term.fileOperateDir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, _ := listSnapshots(); len(list) != 1 || list[0].Name != "three-visits" {
+		t.Fatalf("unexpected snapshots %+v", list)
+	}
+	if _, err := term.restoreSnapshot("missing"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestSwapEntries(t *testing.T) {
+	dir := t.TempDir()
+	staged := filepath.Join(dir, snapshotStageDir)
+	_ = os.MkdirAll(filepath.Join(dir, "T2"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, ".gitkeep"), nil, 0644)
+	_ = os.WriteFile(filepath.Join(dir, "a.db"), []byte("old"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "b.db"), []byte("old"), 0644)
+	isDb := func(e os.DirEntry) bool { return !e.IsDir() && filepath.Ext(e.Name()) == ".db" }
+
+	// stagedのエントリを移せなければ、dirは元のまま
+	_ = os.MkdirAll(staged, 0755)
+	_ = os.WriteFile(filepath.Join(staged, "a.db"), []byte("new"), 0644)
+	_ = os.WriteFile(filepath.Join(staged, "T2"), []byte("new"), 0644) // ディレクトリにはrenameできない
+	if _, err := swapEntries(dir, staged, isDb); err == nil {
+		t.Fatal("swapEntries succeeded")
+	}
+	for _, name := range []string{"a.db", "b.db"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != "old" {
+			t.Fatalf("%v changed: %q", name, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotOldDir)); !os.IsNotExist(err) {
+		t.Fatalf("old dir remains: %v", err)
+	}
+
+	_ = os.Remove(filepath.Join(staged, "T2"))
+	old, err := swapEntries(dir, staged, isDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.db")); string(data) != "new" {
+		t.Fatalf("a.db not swapped: %q", data)
+	}
+	// matchしないファイルとディレクトリは残り、stagedに無いdatabaseは無くなる
+	for _, name := range []string{".gitkeep", "T2"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.db")); !os.IsNotExist(err) {
+		t.Fatalf("b.db remains: %v", err)
+	}
+
+	// 元に戻せる
+	undoSwapEntries(dir, old, isDb)
+	for _, name := range []string{"a.db", "b.db"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != "old" {
+			t.Fatalf("%v not restored: %q", name, data)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// playSound()の再生記録。端末ごとに持つ。
+// 実際に音は鳴らさないが、どのファイルがいつ再生、停止されたかを/pjf/api/soundで確認できる。
+type soundPlayer struct {
+	mutex  sync.Mutex
+	nextId int
+	log    []*soundLogEntry
+}
+
+// 再生記録の1件。ファイルが存在しないなど、再生に失敗した場合はidが0でerrorが入る。
+type soundLogEntry struct {
+	Id        int             `json:"id"`
+	FilePath  string          `json:"filePath"`
+	Param     json.RawMessage `json:"param"`
+	Error     string          `json:"error,omitempty"`
+	StartedAt time.Time       `json:"startedAt"`
+	StoppedAt *time.Time      `json:"stoppedAt,omitempty"`
+}
+
+// playSound()に渡されるparamのうち、シミュレーターが使うもの
+type soundParam struct {
+	FilePath string `json:"filePath"`
+}
+
+// 保持する再生記録の最大数。超えたら古いものから捨てる。
+const soundLogMax = 100
+
+type soundResp struct {
+	Log []*soundLogEntry `json:"log"`
+}
+
+func newSoundPlayer() *soundPlayer {
+	return &soundPlayer{nextId: 1, log: []*soundLogEntry{}}
+}
+
+func setupSound(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/sound", getSoundHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/sound", clearSoundHandler).Methods("DELETE")
+	mux.HandleFunc("/pjf/api/sound/play", playSoundHandler).Methods("POST")
+	mux.HandleFunc("/pjf/api/sound/stop", stopSoundHandler).Methods("POST")
+}
+
+// コンテンツセット内のパスを、ctsDir以下のパスにする。ctsDirの外は指せない。
+func ctsFilePath(path string) string {
+	return filepath.Join(conf.ctsDir, filepath.Clean("/"+path))
+}
+
+// p.mutexをlockした状態で呼ぶこと
+func (p *soundPlayer) addLogLocked(entry *soundLogEntry) {
+	p.log = append(p.log, entry)
+	if len(p.log) > soundLogMax {
+		p.log = p.log[len(p.log)-soundLogMax:]
+	}
+}
+
+// filePathのファイルの再生を記録し、音声のIDを返す。ファイルが存在しなければエラーを返す。
+func (p *soundPlayer) play(param json.RawMessage, filePath string) (int, error) {
+	entry := &soundLogEntry{FilePath: filePath, Param: param, StartedAt: time.Now()}
+
+	var err error
+	if filePath == "" {
+		err = fmt.Errorf("filePath is required")
+	} else if st, serr := os.Stat(ctsFilePath(filePath)); serr != nil || st.IsDir() {
+		err = fmt.Errorf("sound file %q not found in ctsDir", filePath)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		entry.Error = err.Error()
+		p.addLogLocked(entry)
+		return 0, err
+	}
+	entry.Id = p.nextId
+	p.nextId++
+	p.addLogLocked(entry)
+	return entry.Id, nil
+}
+
+// idの音声の停止を記録する。idが0なら再生中の全ての音声を停止する。
+// 停止した音声の数を返す。
+func (p *soundPlayer) stop(id int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	stopped := 0
+	for _, entry := range p.log {
+		if entry.Id == 0 || entry.StoppedAt != nil {
+			continue
+		}
+		if id == 0 || entry.Id == id {
+			entry.StoppedAt = &now
+			stopped++
+		}
+	}
+	return stopped
+}
+
+func (p *soundPlayer) resp() *soundResp {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// StoppedAtを後から書き換えるので、コピーして返す
+	log := make([]*soundLogEntry, 0, len(p.log))
+	for _, entry := range p.log {
+		copied := *entry
+		log = append(log, &copied)
+	}
+	return &soundResp{Log: log}
+}
+
+func (p *soundPlayer) clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.log = []*soundLogEntry{}
+}
+
+// 再生記録を返す
+func getSoundHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.sound.resp())
+}
+
+// 再生記録を消す。自動テストでテストケースごとに記録を分けるためのもの。
+func clearSoundHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	t.sound.clear()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prooperate.jsのplaySound()から呼ばれる。paramはplaySound()に渡されたもの。
+// ファイルがctsDirに存在しなければ404を返す。
+func playSoundHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var param json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	var sp soundParam
+	if err := json.Unmarshal(param, &sp); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid param: %v", err))
+		return
+	}
+	id, err := t.sound.play(compactJSON(param), sp.FilePath)
+	if err != nil {
+		fmt.Printf("playSound: %v\n", err)
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"id": id})
+}
+
+// prooperate.jsのstopSound()から呼ばれる。{"id":1}で指定した音声を、idを省略すると全ての音声を停止する。
+func stopSoundHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var req struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"stopped": t.sound.stop(req.Id)})
+}
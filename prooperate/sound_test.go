@@ -0,0 +1,37 @@
+package prooperate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSoundPlayer(t *testing.T) {
+	conf.ctsDir = t.TempDir()
+	_ = os.MkdirAll(filepath.Join(conf.ctsDir, "sound"), 0755)
+	_ = os.WriteFile(filepath.Join(conf.ctsDir, "sound", "ok.wav"), nil, 0644)
+
+	p := newSoundPlayer()
+	id1, err := p.play(nil, "sound/ok.wav")
+	if err != nil || id1 != 1 {
+		t.Fatalf("play: id=%v err=%v", id1, err)
+	}
+	if _, err := p.play(nil, "sound/ng.wav"); err == nil {
+		t.Fatalf("play of missing file succeeded")
+	}
+	id2, _ := p.play(nil, "/sound/ok.wav")
+	if id2 != 2 {
+		t.Fatalf("id is not incremented. got %v", id2)
+	}
+
+	if n := p.stop(id1); n != 1 {
+		t.Fatalf("stop(%v) stopped %v sounds", id1, n)
+	}
+	if n := p.stop(0); n != 1 {
+		t.Fatalf("stop(0) stopped %v sounds", n)
+	}
+	log := p.resp().Log
+	if len(log) != 3 || log[1].Error == "" || log[0].StoppedAt == nil || log[2].StoppedAt == nil {
+		t.Fatalf("unexpected log %+v", log)
+	}
+}
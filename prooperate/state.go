@@ -0,0 +1,212 @@
+package prooperate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 端末の状態の保存。
+// 実機で再起動やコンテンツの再読み込みをしても残る状態(ネットワーク、画面の明るさ、キーパッド、電源、時計)を
+// simDir/state.json に保存し、シミュレーターの起動時に読み込む。
+// ページは読み込み時に/pjf/api/stateから取得するので、リロードしても状態は変わらない。
+//
+// 端末の識別情報(/pjf/api/device/info)は起動時のオプションで決まるものとして、保存しない。
+
+const stateFileName = "state.json"
+
+// 変更を確認して保存する間隔
+const stateSaveInterval = time.Second
+
+// state.jsonの内容
+type simState struct {
+	Terminals map[string]*terminalState `json:"terminals"` // 端末IDがキー
+}
+
+// 端末ごとの状態。/pjf/api/stateのレスポンスでもある。
+type terminalState struct {
+	Network    int            `json:"network"` // startEventListenのeventCode
+	Brightness int            `json:"brightness"`
+	Keypad     *keypadState   `json:"keypad"`
+	PoweredOn  bool           `json:"poweredOn"`
+	Clock      *clockSnapshot `json:"clock"`
+}
+
+type keypadState struct {
+	Connected bool            `json:"connected"`
+	Display   KeypadDisplay   `json:"display"`
+	Led       json.RawMessage `json:"led"`
+}
+
+// 画面の明るさ。getDisplayBrightness()が返す数値を保持する。
+type display struct {
+	mutex      sync.Mutex
+	brightness int
+}
+
+func newDisplay() *display {
+	return &display{}
+}
+
+func setupState(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/state", getStateHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/brightness", setBrightnessHandler).Methods("POST")
+}
+
+func stateFilePath() string {
+	return filepath.Join(conf.simDir, stateFileName)
+}
+
+func (t *terminal) state() *terminalState {
+	k := t.keypad.resp()
+	t.display.mutex.Lock()
+	brightness := t.display.brightness
+	t.display.mutex.Unlock()
+	t.network.mutex.Lock()
+	network := t.network.eventCode
+	t.network.mutex.Unlock()
+	return &terminalState{
+		Network:    network,
+		Brightness: brightness,
+		Keypad:     &keypadState{Connected: k.Connected, Display: k.Display, Led: k.Led},
+		PoweredOn:  t.lifecycle.resp().PoweredOn,
+		Clock:      t.clock.snapshot(),
+	}
+}
+
+// 保存した状態に戻す。ブラウザにはイベントを送らない。
+func (t *terminal) restoreState(s *terminalState) {
+	if _, ok := networkNames[s.Network]; ok {
+		t.network.mutex.Lock()
+		t.network.eventCode = s.Network
+		t.network.mutex.Unlock()
+	}
+	t.display.mutex.Lock()
+	t.display.brightness = s.Brightness
+	t.display.mutex.Unlock()
+	if s.Keypad != nil {
+		t.keypad.mutex.Lock()
+		t.keypad.connected = s.Keypad.Connected
+		t.keypad.display = s.Keypad.Display
+		if len(s.Keypad.Led) > 0 {
+			t.keypad.led = s.Keypad.Led
+		}
+		t.keypad.mutex.Unlock()
+	}
+	t.lifecycle.mutex.Lock()
+	t.lifecycle.poweredOn = s.PoweredOn
+	t.lifecycle.mutex.Unlock()
+	if s.Clock != nil {
+		t.clock.restore(s.Clock)
+	}
+}
+
+func currentState() *simState {
+	s := &simState{Terminals: map[string]*terminalState{}}
+	for _, t := range terminals {
+		s.Terminals[t.id] = t.state()
+	}
+	return s
+}
+
+// simDir/state.jsonから状態を読み込み、その後は変更があれば保存する。
+// resetがtrueなら読み込まずに初期状態から始める。Setup()の後に呼ぶこと。
+func RestoreState(reset bool) error {
+	path := stateFilePath()
+	var s simState
+	err := readJSONFile(path, &s)
+	switch {
+	case reset || os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("%v: %v", path, err)
+	default:
+		for id, ts := range s.Terminals {
+			if t := findTerminal(id); t != nil {
+				t.restoreState(ts)
+			}
+		}
+		fmt.Printf("%vから端末の状態を読み込みました。\n", path)
+	}
+
+	last, _ := json.Marshal(currentState())
+	if err := writeJSONFile(path, currentState()); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(stateSaveInterval)
+			s := currentState()
+			data, _ := json.Marshal(s)
+			if bytes.Equal(data, last) {
+				continue
+			}
+			if err := writeJSONFile(path, s); err != nil {
+				fmt.Printf("端末の状態を保存できません: %v\n", err)
+				continue
+			}
+			last = data
+		}
+	}()
+	return nil
+}
+
+// prooperate.jsがページの読み込み時に呼ぶ
+func getStateHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.state())
+}
+
+// 画面の明るさの変更のイベント。/pjf/api/brightnessのレスポンスでもある。
+type brightnessResp struct {
+	Brightness int `json:"brightness"`
+}
+
+// setDisplayBrightness()の引数から明るさを取り出す。数値か、{"brightness":数値}を受け付ける。
+func parseBrightness(data []byte) (int, error) {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		return n, nil
+	}
+	var param struct {
+		Brightness *int `json:"brightness"`
+	}
+	if err := json.Unmarshal(data, &param); err != nil || param.Brightness == nil {
+		return 0, fmt.Errorf("brightness must be a number or {\"brightness\":number}: %s", data)
+	}
+	return *param.Brightness, nil
+}
+
+// prooperate.jsのsetDisplayBrightness()から呼ばれる。
+// ブラウザには {"api":"brightness","eventCode":0,"responseObject":brightnessResp} を送り、getDisplayBrightness()の値を更新させる。
+func setBrightnessHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	brightness, err := parseBrightness(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t.display.mutex.Lock()
+	t.display.brightness = brightness
+	t.display.mutex.Unlock()
+	resp := &brightnessResp{Brightness: brightness}
+	ev, _ := json.Marshal(&event{Api: "brightness", EventCode: 0, ResponseObject: resp})
+	broadcast(t, ev)
+	writeJSON(w, http.StatusOK, resp)
+}
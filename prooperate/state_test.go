@@ -0,0 +1,82 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTerminalStateRoundTrip(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	term := defaultTerminal()
+	term.network.observe([]byte(`{"api":"startEventListen","eventCode":0}`))
+	term.display.brightness = 3
+	term.keypad.connected = true
+	term.lifecycle.poweredOn = false
+	data, err := json.Marshal(term.state())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 再起動したものとして、新しい端末に読み込む
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	term = defaultTerminal()
+	var s terminalState
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	term.restoreState(&s)
+	got := term.state()
+	if got.Network != networkEventDisconnected || got.Brightness != 3 || !got.Keypad.Connected || got.PoweredOn {
+		t.Fatalf("unexpected state %+v", got)
+	}
+
+	// 不明なeventCodeは無視する
+	term.restoreState(&terminalState{Network: 5, Brightness: 3, PoweredOn: true})
+	if got := term.state(); got.Network != networkEventDisconnected || got.Brightness != 3 {
+		t.Fatalf("unexpected state %+v", got)
+	}
+}
+
+func TestSetBrightness(t *testing.T) {
+	if err := setupTerminals([]string{"T"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	m := mux.NewRouter()
+	setupState(m)
+	term := defaultTerminal()
+	sub := term.events.subscribe("test")
+
+	for _, c := range []struct {
+		body string
+		code int
+		want int
+	}{
+		{`5`, http.StatusOK, 5},
+		{`{"brightness":2}`, http.StatusOK, 2},
+		{`{"level":3}`, http.StatusBadRequest, 2},
+		{`"bright"`, http.StatusBadRequest, 2},
+	} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", "/pjf/api/brightness", strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Fatalf("%v: %v %v", c.body, w.Code, w.Body.String())
+		}
+		if got := term.state().Brightness; got != c.want {
+			t.Fatalf("%v: brightness %v", c.body, got)
+		}
+		// 変更したらブラウザに送る
+		if c.code == http.StatusOK {
+			if got := receiveEvent(t, sub); got != "brightness:0" {
+				t.Fatalf("%v: got %v", c.body, got)
+			}
+		}
+	}
+}
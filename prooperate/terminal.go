@@ -0,0 +1,159 @@
+package prooperate
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// シミュレートする端末。
+// 1つのシミュレーターで複数の端末をシミュレートする場合、端末ごとにWebSQLのdbDir、fileOperateDir、
+// eventNotificationの接続先を分ける。
+//
+// ブラウザでは /t/{端末ID}/ 以下でコンテンツセットを開くか、URLに ?terminal={端末ID} を付けると、その端末として動作する。
+// /pjf/api/ 以下のAPIでは、クエリのterminalで端末を指定する。省略した場合は最初の端末になる。
+type terminal struct {
+	id             string
+	dbDir          string
+	fileOperateDir string
+	events         *hub // eventNotificationで接続中のクライアント
+	keypad         *keypad
+	sound          *soundPlayer
+	httpListener   *httpListener
+	lifecycle      *lifecycle
+	device         *device
+	network        *network
+	display        *display
+	clock          *virtualClock
+
+	// startCommunication()で登録されたparam。stopCommunication()でnilに戻る。felicaMutexで保護する。
+	communicationParam *communicationParam
+}
+
+var terminals []*terminal
+
+// 端末IDに使える文字。IDはディレクトリ名と /t/{端末ID}/ のURLに使うので、"."や".."、"/"などは許可しない。
+var terminalIdPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// 端末を作る。
+// 端末が1つならdbDir,fileOperateDirをそのまま使い、複数ならその下に端末IDのディレクトリを作って使う。
+func setupTerminals(ids []string, dbDir string, fileOperateDir string) error {
+	if len(ids) == 0 {
+		return fmt.Errorf("no terminal")
+	}
+	terminals = nil
+	for _, id := range ids {
+		if !terminalIdPattern.MatchString(id) {
+			return fmt.Errorf("invalid terminal id: %q", id)
+		}
+		if findTerminal(id) != nil {
+			return fmt.Errorf("duplicated terminal id: %q", id)
+		}
+		t := &terminal{
+			id:             id,
+			dbDir:          dbDir,
+			fileOperateDir: fileOperateDir,
+			events:         newHub(),
+			keypad:         newKeypad(),
+			sound:          newSoundPlayer(),
+			httpListener:   newHttpListener(),
+			lifecycle:      newLifecycle(),
+			device:         newDevice(id),
+			network:        newNetwork(),
+			display:        newDisplay(),
+			clock:          newVirtualClock(),
+		}
+		if len(ids) > 1 {
+			t.dbDir = filepath.Join(dbDir, id)
+			t.fileOperateDir = filepath.Join(fileOperateDir, id)
+		}
+		_ = os.MkdirAll(t.dbDir, 0755)
+		_ = os.MkdirAll(t.fileOperateDir, 0755)
+		terminals = append(terminals, t)
+	}
+	return nil
+}
+
+func defaultTerminal() *terminal {
+	return terminals[0]
+}
+
+func findTerminal(id string) *terminal {
+	for _, t := range terminals {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// idの端末を返す。idが""なら最初の端末を返す。
+func findTerminalOrDefault(id string) *terminal {
+	if id == "" {
+		return defaultTerminal()
+	}
+	return findTerminal(id)
+}
+
+// リクエストのクエリのterminalで指定された端末を返す。
+// 存在しない端末が指定されていたら、404を書き込んでnilを返す。
+func terminalFromRequest(w http.ResponseWriter, r *http.Request) *terminal {
+	id := r.URL.Query().Get("terminal")
+	t := findTerminalOrDefault(id)
+	if t == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("terminal %q not found", id))
+	}
+	return t
+}
+
+// websql.SetDBDirFunc()に登録する。terminalFromRequest()と同様に、存在しない端末ならエラーを返す。
+// (端末IDの誤りで、別の端末のdatabaseを読み書きしてしまわないように)
+func dbDirForRequest(r *http.Request) (string, error) {
+	id := r.URL.Query().Get("terminal")
+	t := findTerminalOrDefault(id)
+	if t == nil {
+		return "", fmt.Errorf("terminal %q not found", id)
+	}
+	return t.dbDir, nil
+}
+
+// 端末IDが存在するか
+func HasTerminal(id string) bool {
+	return findTerminal(id) != nil
+}
+
+type terminalInfo struct {
+	Id             string `json:"id"`
+	DbDir          string `json:"dbDir"`
+	FileOperateDir string `json:"fileOperateDir"`
+	Clients        int    `json:"clients"`
+	HttpListenPort int    `json:"httpListenPort,omitempty"`
+}
+
+func (t *terminal) info() *terminalInfo {
+	return &terminalInfo{
+		Id:             t.id,
+		DbDir:          t.dbDir,
+		FileOperateDir: t.fileOperateDir,
+		Clients:        t.events.count(),
+		HttpListenPort: t.httpListener.port,
+	}
+}
+
+func listTerminalsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []*terminalInfo{}
+	for _, t := range terminals {
+		list = append(list, t.info())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func getTerminalHandler(w http.ResponseWriter, r *http.Request) {
+	t := terminalFromRequest(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.info())
+}
@@ -0,0 +1,58 @@
+package prooperate
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"pro3sim/websql"
+	"strings"
+	"testing"
+)
+
+func TestUnknownTerminalDatabase(t *testing.T) {
+	if err := setupTerminals([]string{"A", "B"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	websql.SetDBDirFunc(dbDirForRequest)
+	defer websql.SetDBDirFunc(nil)
+	m := mux.NewRouter()
+	websql.Setup(m, nil)
+
+	open := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"name":"db","version":"","displayName":"","estimatedSize":"0"}`)
+		m.ServeHTTP(w, httptest.NewRequest("POST", "/pjf/api/websql/open"+query, body))
+		return w
+	}
+	if w := open("?terminal=B"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"dbId"`) {
+		t.Fatalf("open on B: %v %v", w.Code, w.Body.String())
+	}
+	// 存在しない端末は、デフォルトの端末のdatabaseを開かずに404にする
+	if w := open("?terminal=X"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `terminal \"X\" not found`) {
+		t.Fatalf("open on X: %v %v", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/pjf/api/websql/databases?terminal=X", "/pjf/api/websql/transaction?terminal=X&dbId=1"} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%v: status %v", path, w.Code)
+		}
+	}
+	if dbs, _ := websql.ListDatabasesInDir(findTerminal("A").dbDir); len(dbs) != 0 {
+		t.Errorf("database created on A: %+v", dbs)
+	}
+}
+
+func TestInvalidTerminalId(t *testing.T) {
+	for _, id := range []string{"", ".", "..", "a/b", `a\b`, "a b", "a?b", "a%2Fb", ".hidden"} {
+		if err := setupTerminals([]string{"00000000", id}, t.TempDir(), t.TempDir()); err == nil {
+			t.Errorf("%q: accepted", id)
+		}
+	}
+	if err := setupTerminals([]string{"00000000", "term_1-B"}, t.TempDir(), t.TempDir()); err != nil {
+		t.Error(err)
+	}
+	if err := setupTerminals([]string{"A", "A"}, t.TempDir(), t.TempDir()); err == nil {
+		t.Error("duplicated id accepted")
+	}
+}
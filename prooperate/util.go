@@ -0,0 +1,55 @@
+package prooperate
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// vをJSONにしてレスポンスとして書き込む
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+type errorResp struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Message string `json:"message"`
+}
+
+// {"error":{"message":...}} の形式でエラーを返す
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &errorResp{Error: errorBody{Message: message}})
+}
+
+// pathのJSONファイルをvに読み込む。ファイルが無い場合はos.IsNotExist()なエラーを返す。
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// vをJSONにしてpathに保存する。
+// 書き込み途中で落ちてもファイルが壊れないよう、一時ファイルに書いてからrenameする。
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
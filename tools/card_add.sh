@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 使い方: card_add.sh 名前 IDm [ラベル]
+curl -X PUT -d "{\"label\":\"${3:-$1}\", \"idm\":\"$2\", \"category\":0, \"paramResult\":1}" "http://localhost:8889/pjf/api/cards/$1"
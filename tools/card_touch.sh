@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 使い方: card_touch.sh 名前
+curl -X POST "http://localhost:8889/pjf/api/cards/$1/touch"
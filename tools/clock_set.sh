@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 使い方: clock_set.sh 2025-04-01T09:00:00+09:00 [端末ID]
+curl -X POST -d "{\"time\":\"$1\"}" "http://localhost:8889/pjf/api/clock?terminal=${2:-}"
@@ -0,0 +1,9 @@
+#!/bin/bash -ue
+
+# 使い方: device_info.sh '{"firmwareVersion":"5.10r000000"}'
+#         device_info.sh reset
+if [ "$1" = "reset" ]; then
+	curl -X POST http://localhost:8889/pjf/api/device/info/reset
+else
+	curl -X POST -d "$1" http://localhost:8889/pjf/api/device/info
+fi
@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# キーパッドの現在の状態と変更履歴を表示する
+curl "http://localhost:8889/pjf/api/keypad"
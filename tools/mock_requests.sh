@@ -0,0 +1,9 @@
+#!/bin/bash -ue
+
+# モックが受けたリクエストを表示する。clearを指定すると記録を消す。
+# 使い方: mock_requests.sh [clear]
+if [ "${1:-}" = "clear" ]; then
+	curl -X DELETE http://localhost:8889/pjf/api/mock/requests
+else
+	curl http://localhost:8889/pjf/api/mock/requests
+fi
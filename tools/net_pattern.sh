@@ -0,0 +1,10 @@
+#!/bin/bash -ue
+
+# ネットワーク状態を自動で変化させる。stopを指定すると止める。
+# 使い方: net_pattern.sh '{"type":"flap", "seed":42, "up":1, "upMax":"30s", "downMax":"10s"}'
+#         net_pattern.sh stop
+if [ "$1" = "stop" ]; then
+	curl -X DELETE http://localhost:8889/pjf/api/network/pattern
+else
+	curl -X POST -d "$1" http://localhost:8889/pjf/api/network/pattern
+fi
@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 電源断をシミュレートする。tools/power_on.shで起動する。
+curl -X POST http://localhost:8889/pjf/api/lifecycle/powerCut
@@ -0,0 +1,3 @@
+#!/bin/bash -ue
+
+curl -X POST http://localhost:8889/pjf/api/lifecycle/powerOn
@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 使い方: replay.sh セッションファイル [再生速度の倍率]
+curl -X POST --data-binary "@$1" "http://localhost:8889/pjf/api/replay?speed=${2:-1}&wait=1"
@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 使い方: scenario_run.sh volume/sim/scenario/ 以下のファイル名
+curl -X POST "http://localhost:8889/pjf/api/scenario/run?file=$1&wait=1"
@@ -0,0 +1,25 @@
+#!/bin/bash -ue
+
+# WebSQLのdatabaseのスナップショットを保存、復元する。
+# 使い方: snapshot.sh save 名前 [files]   (filesを指定すると、fileOperateDirも保存する)
+#         snapshot.sh restore 名前
+#         snapshot.sh delete 名前
+#         snapshot.sh list
+case "${1:-list}" in
+save)
+	query=""
+	if [ "${3:-}" = "files" ]; then
+		query="?files=1"
+	fi
+	curl -X POST "http://localhost:8889/pjf/api/snapshots/$2$query"
+	;;
+restore)
+	curl -X POST "http://localhost:8889/pjf/api/snapshots/$2/restore"
+	;;
+delete)
+	curl -X DELETE "http://localhost:8889/pjf/api/snapshots/$2"
+	;;
+*)
+	curl http://localhost:8889/pjf/api/snapshots
+	;;
+esac
@@ -0,0 +1,4 @@
+#!/bin/bash -ue
+
+# 音声の再生記録を表示する
+curl "http://localhost:8889/pjf/api/sound"
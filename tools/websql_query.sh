@@ -0,0 +1,11 @@
+#!/bin/bash -ue
+
+# WebSQLのdatabaseでSELECTを実行する。引数が無ければdatabaseの一覧を表示する。
+# database名に記号が含まれる場合は、URLエンコードして指定する。
+# 使い方: websql_query.sh [database名 SQL]
+if [ $# -eq 0 ]; then
+	curl http://localhost:8889/pjf/api/websql/databases
+else
+	sql=$(printf '%s' "$2" | sed -e 's/\\/\\\\/g' -e 's/"/\\"/g')
+	curl -X POST "http://localhost:8889/pjf/api/websql/database/query?name=$1" -d "{\"sql\": \"$sql\"}"
+fi
@@ -0,0 +1,11 @@
+CREATE TABLE items (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    price INTEGER NOT NULL
+);
+
+CREATE TABLE members (
+    idm TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    visits INTEGER NOT NULL DEFAULT 0
+);
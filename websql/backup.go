@@ -0,0 +1,92 @@
+package websql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/sstinc-jp/go-sqlite3"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dirにあるdatabaseを、SQLiteのbackup APIでdstDirにコピーする。
+// 接続を閉じないので、コンテンツセットはそのままdatabaseを使い続けられる。
+// 実行中のtransactionがあれば、commitされた内容だけがコピーされる。
+// 他の接続がcommit中でコピーできない間は、最大timeoutだけ待つ。
+func BackupDatabasesInDir(dir string, dstDir string, timeout time.Duration) error {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := databaseNameFromFile(e.Name())
+		if e.IsDir() || !ok {
+			continue
+		}
+		if err := backupDatabase(dir, name, filepath.Join(dstDir, e.Name()), timeout); err != nil {
+			return fmt.Errorf("%v: %v", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+func backupDatabase(dir string, name string, dst string, timeout time.Duration) error {
+	ctx := context.Background()
+	srcDb, err := openReadOnly(dir, name)
+	if err != nil {
+		return err
+	}
+	defer srcDb.Close()
+	dstDb, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return err
+	}
+	defer dstDb.Close()
+
+	srcConn, err := srcDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dstDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			backup, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			deadline := time.Now().Add(timeout)
+			for {
+				// BUSY、LOCKEDの間はfalse, nilが返る
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				if time.Now().After(deadline) {
+					backup.Finish()
+					return fmt.Errorf("database is locked")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	})
+}
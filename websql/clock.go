@@ -0,0 +1,232 @@
+package websql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databaseのあるディレクトリでの、SQLの'now'などが表す時刻と、時刻が設定されているかを返す関数。
+// nilなら実際の時刻が使われる。
+var nowFunc func(dir string) (time.Time, bool)
+
+// Exec()で実行するSQLの、日時関数の'now'とCURRENT_TIMESTAMP,CURRENT_DATE,CURRENT_TIMEを、fが返す時刻に置き換えるようにする。
+// datetime('now')などで、シミュレーターの時計の時刻を使うためのもの。
+// fにはdatabaseのあるディレクトリ(OpenInDir()のdir)が渡されるので、ディレクトリごとに別の時計を使える。
+// fがfalseを返す間(時刻が設定されていない間)は置き換えない。
+//
+// 'now'は、date(),time(),datetime(),julianday(),unixepoch()の1番目、strftime()の2番目の引数の時だけ置き換える。
+// INSERTの値などの'now'という文字列はそのままにする。
+// datetime(?)のように、その位置の引数がパラメータで、"now"という文字列がbindされる場合も置き換える。
+//
+// CREATE文は置き換えない。(DEFAULT CURRENT_TIMESTAMPなどが固定の時刻になってしまうため)
+// そのため、列のデフォルト値やトリガー内の'now'は実際の時刻になる。
+func SetNowFunc(f func(dir string) (time.Time, bool)) {
+	nowFunc = f
+}
+
+// dirのdatabaseで、nowFuncの時刻が設定されていれば、statementの'now'などと、日時関数の時刻の引数にbindする"now"を置き換える。
+// argsは変更せず、置き換える場合はコピーを返す。
+func applyNow(dir string, statement string, args []interface{}) (string, []interface{}) {
+	if nowFunc == nil {
+		return statement, args
+	}
+	now, ok := nowFunc(dir)
+	if !ok {
+		return statement, args
+	}
+	statement, params := replaceNow(statement, now)
+	replaced := false
+	for _, i := range params {
+		if i >= len(args) {
+			continue
+		}
+		if v, ok := args[i].(string); ok && strings.EqualFold(v, "now") {
+			if !replaced {
+				args = append([]interface{}{}, args...)
+				replaced = true
+			}
+			args[i] = now.UTC().Format("2006-01-02 15:04:05.000")
+		}
+	}
+	return statement, args
+}
+
+// 日時関数の、時刻を表す引数の位置
+var timeValueArgs = map[string]int{
+	"DATE":      0,
+	"TIME":      0,
+	"DATETIME":  0,
+	"JULIANDAY": 0,
+	"UNIXEPOCH": 0,
+	"STRFTIME":  1,
+}
+
+// replaceNow()で読んでいる括弧の中
+type sqlCall struct {
+	fn     string // 括弧の直前の関数名(大文字)。関数呼び出しでなければ""
+	arg    int    // 何番目の引数か
+	tokens int    // 今の引数で読んだトークンの数
+}
+
+// statementの日時関数の'now'などを、nowの時刻(UTC)のリテラルに置き換える。
+// 文字列リテラル、識別子、コメントの中はそのままにする。
+// 日時関数の時刻の引数になっているパラメータ(?、?NNN)の、0から始まる番号も返す。
+func replaceNow(statement string, now time.Time) (string, []int) {
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(statement)), "CREATE") {
+		return statement, nil
+	}
+	now = now.UTC()
+	keywords := map[string]string{
+		"CURRENT_TIMESTAMP": now.Format("'2006-01-02 15:04:05'"),
+		"CURRENT_DATE":      now.Format("'2006-01-02'"),
+		"CURRENT_TIME":      now.Format("'15:04:05'"),
+	}
+
+	var b strings.Builder
+	var calls []*sqlCall
+	var params []int
+	maxParam := 0   // これまでのパラメータの最大の番号。番号の無い?はこの次の番号になる
+	lastIdent := "" // 直前のトークンが識別子なら、その名前
+	// 空白とコメント以外のトークンを読んだ
+	token := func() {
+		if len(calls) > 0 {
+			calls[len(calls)-1].tokens++
+		}
+	}
+	s := statement
+	for len(s) > 0 {
+		switch {
+		case s[0] == '\'':
+			end := quotedEnd(s, '\'')
+			if strings.EqualFold(s[:end], "'now'") && isTimeValueArg(calls) && isArgEnd(s[end:]) {
+				b.WriteString(now.Format("'2006-01-02 15:04:05.000'"))
+			} else {
+				b.WriteString(s[:end])
+			}
+			s = s[end:]
+			token()
+			lastIdent = ""
+		case s[0] == '"' || s[0] == '`':
+			end := quotedEnd(s, s[0])
+			b.WriteString(s[:end])
+			s = s[end:]
+			token()
+			lastIdent = ""
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']') + 1
+			if end == 0 {
+				end = len(s)
+			}
+			b.WriteString(s[:end])
+			s = s[end:]
+			token()
+			lastIdent = ""
+		case strings.HasPrefix(s, "--"):
+			end := strings.IndexByte(s, '\n') + 1
+			if end == 0 {
+				end = len(s)
+			}
+			b.WriteString(s[:end])
+			s = s[end:]
+		case strings.HasPrefix(s, "/*"):
+			end := strings.Index(s[2:], "*/") + 4
+			if end == 3 {
+				end = len(s)
+			}
+			b.WriteString(s[:end])
+			s = s[end:]
+		case isIdentChar(s[0]):
+			end := 1
+			for end < len(s) && isIdentChar(s[end]) {
+				end++
+			}
+			if lit, ok := keywords[strings.ToUpper(s[:end])]; ok {
+				b.WriteString(lit)
+				lastIdent = ""
+			} else {
+				b.WriteString(s[:end])
+				lastIdent = strings.ToUpper(s[:end])
+			}
+			s = s[end:]
+			token()
+		case s[0] == '?':
+			end := 1
+			for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+				end++
+			}
+			n := maxParam + 1
+			if end > 1 {
+				n, _ = strconv.Atoi(s[1:end])
+			}
+			if n > maxParam {
+				maxParam = n
+			}
+			if isTimeValueArg(calls) && isArgEnd(s[end:]) {
+				params = append(params, n-1)
+			}
+			b.WriteString(s[:end])
+			s = s[end:]
+			token()
+			lastIdent = ""
+		case s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r':
+			b.WriteByte(s[0])
+			s = s[1:]
+		default:
+			switch s[0] {
+			case '(':
+				token()
+				calls = append(calls, &sqlCall{fn: lastIdent})
+			case ')':
+				if len(calls) > 0 {
+					calls = calls[:len(calls)-1]
+				}
+			case ',':
+				if len(calls) > 0 {
+					calls[len(calls)-1].arg++
+					calls[len(calls)-1].tokens = 0
+				}
+			default:
+				token()
+			}
+			b.WriteByte(s[0])
+			s = s[1:]
+			lastIdent = ""
+		}
+	}
+	return b.String(), params
+}
+
+// sが、引数の終わり(,か))から始まるか
+func isArgEnd(s string) bool {
+	s = strings.TrimLeft(s, " \t\r\n")
+	return strings.HasPrefix(s, ",") || strings.HasPrefix(s, ")")
+}
+
+// 今読んでいる文字列リテラルが、日時関数の時刻を表す引数の最初のトークンか
+func isTimeValueArg(calls []*sqlCall) bool {
+	if len(calls) == 0 {
+		return false
+	}
+	c := calls[len(calls)-1]
+	arg, ok := timeValueArgs[c.fn]
+	return ok && c.arg == arg && c.tokens == 0
+}
+
+// sの先頭から始まるquoteで囲まれた部分の長さを返す。quoteを2つ重ねたものはエスケープとみなす。
+func quotedEnd(s string, quote byte) int {
+	for i := 1; i < len(s); i++ {
+		if s[i] == quote {
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,127 @@
+package websql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplaceNow(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"SELECT datetime('now')", "SELECT datetime('2030-01-02 03:04:05.006')"},
+		{"SELECT date('NOW', 'localtime')", "SELECT date('2030-01-02 03:04:05.006', 'localtime')"},
+		{"SELECT CURRENT_TIMESTAMP, current_date, CURRENT_TIME", "SELECT '2030-01-02 03:04:05', '2030-01-02', '03:04:05'"},
+		{"SELECT 'it''s now', \"now\", [CURRENT_DATE], my_current_date", "SELECT 'it''s now', \"now\", [CURRENT_DATE], my_current_date"},
+		{"SELECT 1 -- 'now'\n, date('now') /* CURRENT_TIME */", "SELECT 1 -- 'now'\n, date('2030-01-02 03:04:05.006') /* CURRENT_TIME */"},
+		{"CREATE TABLE t (a TEXT DEFAULT CURRENT_TIMESTAMP)", "CREATE TABLE t (a TEXT DEFAULT CURRENT_TIMESTAMP)"},
+		{"SELECT strftime('%s', 'now'), julianday ('now'), unixepoch('now')", "SELECT strftime('%s', '2030-01-02 03:04:05.006'), julianday ('2030-01-02 03:04:05.006'), unixepoch('2030-01-02 03:04:05.006')"},
+		// 日時関数の時刻の引数でなければ置き換えない
+		{"INSERT INTO t (a, b) VALUES ('now', 'NOW')", "INSERT INTO t (a, b) VALUES ('now', 'NOW')"},
+		{"UPDATE t SET a = 'now' WHERE b IN ('now')", "UPDATE t SET a = 'now' WHERE b IN ('now')"},
+		{"SELECT strftime('now'), datetime(a, 'now'), datetime(coalesce(a, 'now')), date('now' || '')", "SELECT strftime('now'), datetime(a, 'now'), datetime(coalesce(a, 'now')), date('now' || '')"},
+		{"SELECT lower('now'), datetime(lower('now'))", "SELECT lower('now'), datetime(lower('now'))"},
+	}
+	for _, tt := range tests {
+		if got, _ := replaceNow(tt.in, now); got != tt.want {
+			t.Errorf("replaceNow(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceNowParams(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		in     string
+		params []int
+	}{
+		{"SELECT datetime(?)", []int{0}},
+		{"SELECT ?, strftime(?, ?), date(? , 'localtime')", []int{2, 3}},
+		{"SELECT datetime(?3), time(?), julianday(?1)", []int{2, 3, 0}},
+		{"INSERT INTO t (a, b) VALUES (?, ?)", nil},
+		{"SELECT datetime(a, ?), date(? || ''), lower(?)", nil},
+		{"SELECT '?', \"?\", datetime('now') -- ?", nil},
+		{"CREATE TABLE t (a TEXT DEFAULT (datetime(?)))", nil},
+	}
+	for _, tt := range tests {
+		_, params := replaceNow(tt.in, now)
+		if fmt.Sprint(params) != fmt.Sprint(tt.params) {
+			t.Errorf("replaceNow(%q) params = %v, want %v", tt.in, params, tt.params)
+		}
+	}
+}
+
+func TestExecWithNowFunc(t *testing.T) {
+	virtual := true
+	dir := t.TempDir()
+	otherDir := t.TempDir()
+	// dirのdatabaseだけ時刻を設定する
+	SetNowFunc(func(d string) (time.Time, bool) {
+		return time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), virtual && d == dir
+	})
+	defer SetNowFunc(nil)
+
+	dbId, _, err := OpenInDir(dir, "clockdb", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(dbId)
+	txId, err := BeginTransaction(dbId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Abort(txId)
+
+	_, _, data, err := Exec(txId, "SELECT datetime('now', '+1 day') AS d, datetime(NULL) AS n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]["d"] != "2030-01-03 03:04:05" || data[0]["n"] != nil {
+		t.Fatalf("unexpected result %v", data)
+	}
+
+	// bindする"now"も、日時関数の時刻の引数なら置き換える
+	args := []interface{}{"now", "now", "NOW"}
+	_, _, data, err = Exec(txId, "SELECT datetime(?) AS d, ? AS s, strftime('%Y', ?) AS y", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]["d"] != "2030-01-02 03:04:05" || data[0]["s"] != "now" || data[0]["y"] != "2030" {
+		t.Fatalf("unexpected result %v", data)
+	}
+	if args[0] != "now" {
+		t.Fatalf("args are modified: %v", args)
+	}
+
+	// 別のディレクトリのdatabaseは、そのディレクトリの時計を使う
+	otherId, _, err := OpenInDir(otherDir, "clockdb", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(otherId)
+	otherTx, err := BeginTransaction(otherId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Abort(otherTx)
+	_, _, data, err = Exec(otherTx, "SELECT date('now') AS d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]["d"] != time.Now().UTC().Format("2006-01-02") {
+		t.Fatalf("unexpected result in other dir %v", data)
+	}
+
+	// 時刻が設定されていなければ、実際の時刻のまま
+	virtual = false
+	_, _, data, err = Exec(txId, "SELECT date('now') AS d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]["d"] != time.Now().UTC().Format("2006-01-02") {
+		t.Fatalf("unexpected result %v", data)
+	}
+}
@@ -0,0 +1,207 @@
+package websql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// databaseのフィクスチャ。databaseが新しく作られた時に、SQLのスクリプトとJSONの行を入れる。
+// コンテンツセットをマスタデータなどが入った状態から始めるためのもの。
+//
+// fixtureDirのfixtures.jsonで、databaseの名前(openDatabase()に渡す名前)とversionごとに定義する。
+// sqlのスクリプトを順に実行してから、dataの行をINSERTする。ファイルはfixtureDirからの相対パス。
+//
+//	[
+//	    {"database": "shop", "version": "1.0", "sql": ["schema.sql", "master.sql"],
+//	     "data": [{"table": "items", "file": "items.json"}, {"table": "shops", "rows": [{"id": 1, "name": "本店"}]}]}
+//	]
+//
+// versionを省略したフィクスチャは、どのversionでopenした場合にも使う。
+// fixtures.jsonはdatabaseを作る時に読み込むので、変更はシミュレーターを再起動しなくても反映される。
+
+const fixturesFile = "fixtures.json"
+
+type Fixture struct {
+	Database string         `json:"database"`
+	Version  string         `json:"version,omitempty"`
+	Sql      []string       `json:"sql,omitempty"`
+	Data     []*FixtureData `json:"data,omitempty"`
+}
+
+// テーブルに入れる行。fileかrowsのどちらかを指定する。fileは行の配列のJSON。
+type FixtureData struct {
+	Table string                   `json:"table"`
+	File  string                   `json:"file,omitempty"`
+	Rows  []map[string]interface{} `json:"rows,omitempty"`
+}
+
+var fixtureDir = ""
+
+// フィクスチャを置くディレクトリを設定し、fixtures.jsonを確認してフィクスチャの数を返す。""ならフィクスチャは使わない。
+// fixtures.jsonが無ければエラーにしない。
+func SetFixtureDir(dir string) (int, error) {
+	fixtureDir = dir
+	fixtures, err := loadFixtures()
+	return len(fixtures), err
+}
+
+func loadFixtures() ([]*Fixture, error) {
+	if fixtureDir == "" {
+		return nil, nil
+	}
+	path := filepath.Join(fixtureDir, fixturesFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*Fixture
+	if err := decodeUseNumber(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for i, f := range fixtures {
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("%v: [%v]: %v", path, i, err)
+		}
+	}
+	return fixtures, nil
+}
+
+func (f *Fixture) validate() error {
+	if f.Database == "" {
+		return fmt.Errorf("database is required")
+	}
+	files := append([]string{}, f.Sql...)
+	for _, d := range f.Data {
+		if d.Table == "" {
+			return fmt.Errorf("data: table is required")
+		}
+		if (d.File == "") == (d.Rows == nil) {
+			return fmt.Errorf("data %v: either file or rows is required", d.Table)
+		}
+		if d.File != "" {
+			files = append(files, d.File)
+		}
+	}
+	for _, file := range files {
+		if filepath.IsAbs(file) || strings.HasPrefix(filepath.Clean(file), "..") {
+			return fmt.Errorf("file must be in the fixture directory: %q", file)
+		}
+		if _, err := os.Stat(filepath.Join(fixtureDir, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameのdatabaseをversionで作る時に使うフィクスチャを返す。無ければnil。
+// versionが""なら、versionに関係なく最初にnameが一致したものを使う。
+func findFixture(name string, version string) (*Fixture, error) {
+	fixtures, err := loadFixtures()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fixtures {
+		if f.Database == name && (f.Version == "" || version == "" || f.Version == version) {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// フィクスチャを適用したdatabaseのversion
+func (f *Fixture) versionFor(version string) string {
+	if f.Version != "" {
+		return f.Version
+	}
+	return version
+}
+
+func (f *Fixture) apply(tx *sql.Tx) error {
+	for _, file := range f.Sql {
+		script, err := os.ReadFile(filepath.Join(fixtureDir, file))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(script)); err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+	}
+	for _, d := range f.Data {
+		rows := d.Rows
+		if d.File != "" {
+			var err error
+			if rows, err = readFixtureRows(filepath.Join(fixtureDir, d.File)); err != nil {
+				return err
+			}
+		}
+		for i, row := range rows {
+			if err := insertFixtureRow(tx, d.Table, row); err != nil {
+				return fmt.Errorf("%v[%v]: %w", d.Table, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 行の値の数値は、整数ならINTEGER、そうでなければREALとして入れるため、json.Numberのままにしておく
+func decodeUseNumber(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// 行の配列のJSONを読む
+func readFixtureRows(path string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	if err := decodeUseNumber(data, &rows); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return rows, nil
+}
+
+func insertFixtureRow(tx *sql.Tx, table string, row map[string]interface{}) error {
+	columns := make([]string, 0, len(row))
+	for c := range row {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	names := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, c := range columns {
+		names[i] = quoteIdentifier(c)
+		args[i] = fixtureValue(row[c])
+	}
+	stmt := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", quoteIdentifier(table), strings.Join(names, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+	_, err := tx.Exec(stmt, args...)
+	return err
+}
+
+// JSONの値を、SQLに渡す値にする。オブジェクトと配列はJSONの文字列にする。
+func fixtureValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return v
+}
@@ -0,0 +1,67 @@
+package websql
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixture(t *testing.T) {
+	dir := t.TempDir()
+	defer SetFixtureDir("")
+	files := map[string]string{
+		"fixtures.json": `[
+	{"database": "shop", "version": "1.0", "sql": ["schema.sql"],
+	 "data": [{"table": "items", "file": "items.json"}, {"table": "items", "rows": [{"id": 3, "name": "c", "price": 1.5}]}]},
+	{"database": "broken", "sql": ["broken.sql"]}
+]`,
+		"schema.sql": "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price); CREATE INDEX items_name ON items (name);",
+		"items.json": `[{"id": 1, "name": "a", "price": 100}, {"id": 2, "name": "b", "price": 200}]`,
+		"broken.sql": "CREATE TABLE x (id); INSERT INTO missing VALUES (1);",
+	}
+	for name, content := range files {
+		_ = os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	if n, err := SetFixtureDir(dir); err != nil || n != 2 {
+		t.Fatalf("SetFixtureDir() = %v, %v", n, err)
+	}
+
+	dbDir := t.TempDir()
+	dbId, created, err := OpenInDir(dbDir, "shop", "1.0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(dbId)
+	// フィクスチャを入れたdatabaseは、既にあったものとして扱う
+	if created {
+		t.Fatal("created is true")
+	}
+	if ver, _ := DatabaseVersion(dbId); ver != "1.0" {
+		t.Fatalf("version = %q", ver)
+	}
+	result, err := QueryDatabase(dbDir, "shop", "SELECT id, name, price, typeof(price) FROM items ORDER BY id", nil, 10)
+	if err != nil || len(result.Rows) != 3 || result.Rows[2][3] != "real" || result.Rows[0][3] != "integer" {
+		t.Fatalf("unexpected rows %+v %v", result, err)
+	}
+
+	// versionが違えばフィクスチャは使わない
+	dbId, created, err = OpenInDir(dbDir, "shop2", "2.0", false)
+	if err != nil || !created {
+		t.Fatalf("OpenInDir() = %v, %v", created, err)
+	}
+	Close(dbId)
+	if _, created, _ := OpenInDir(t.TempDir(), "shop", "2.0", false); !created {
+		t.Fatal("fixture for 1.0 was used for 2.0")
+	}
+
+	// フィクスチャの適用に失敗したら、databaseは作られない
+	if _, _, err := OpenInDir(dbDir, "broken", "", false); err == nil {
+		t.Fatal("broken fixture was applied")
+	}
+	_ = os.WriteFile(filepath.Join(dir, "broken.sql"), []byte("CREATE TABLE x (id);"), 0644)
+	dbId, created, err = OpenInDir(dbDir, "broken", "", false)
+	if err != nil || created {
+		t.Fatalf("OpenInDir() = %v, %v", created, err)
+	}
+	Close(dbId)
+}
@@ -48,11 +48,17 @@ func openHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbId, created, err := Open(req.Name, req.Version, req.HasCreationCallback)
+	dir, err := dbDirForRequest(r)
+	if err != nil {
+		writeDirNotFound(w, err)
+		return
+	}
+	dbId, created, err := OpenInDir(dir, req.Name, req.Version, req.HasCreationCallback)
 	if err != nil {
 		writeErrorResp(w, err)
 		return
 	}
+	setEstimatedSize(dir, req.Name, req.EstimatedSize)
 
 	resp := OpenResp{
 		DbId:    dbId,
@@ -70,11 +76,12 @@ type TransactionResp struct {
 }
 
 type TransactionMsg struct {
-	Cmd    string        `json:"cmd"`
-	Stmt   string        `json:"statement"`
-	Args   []interface{} `json:"args"`
-	OldVer string        `json:"oldVersion"`
-	NewVer string        `json:"newVersion"`
+	Cmd      string        `json:"cmd"`
+	Stmt     string        `json:"statement"`
+	Args     []interface{} `json:"args"`
+	OldVer   string        `json:"oldVersion"`
+	NewVer   string        `json:"newVersion"`
+	ReadOnly bool          `json:"readOnly"` // beginで、readTransaction()のtransactionを開始する
 }
 
 func transactionHandler(httpw http.ResponseWriter, r *http.Request) {
@@ -82,6 +89,10 @@ func transactionHandler(httpw http.ResponseWriter, r *http.Request) {
 	websqlLog.Debugf(0x1, "transactionHandler start")
 	defer websqlLog.Debugf(0x1, "transactionHandler end")
 
+	if _, err := dbDirForRequest(r); err != nil {
+		writeDirNotFound(httpw, err)
+		return
+	}
 	conn, err := upgrader.Upgrade(httpw, r, nil)
 	if err != nil {
 		return
@@ -119,7 +130,11 @@ func transactionHandler(httpw http.ResponseWriter, r *http.Request) {
 				txId = 0
 			}
 
-			txId, err = BeginTransaction(uint32(dbId)) // XXX もはやuintである必要がない
+			if msg.ReadOnly {
+				txId, err = BeginReadTransaction(uint32(dbId))
+			} else {
+				txId, err = BeginTransaction(uint32(dbId)) // XXX もはやuintである必要がない
+			}
 			if err != nil {
 				websqlLog.Debugf(0x1, "failed to begin transaction: %v", err)
 				conn.WriteJSON(makeErrorResp(err))
@@ -281,7 +296,16 @@ type CloseAllResp struct {
 // 現状は内部使用の非公開API
 // WebKitNetworkProcessのcrash時にDBを強制closeするために使っている。
 func closeAllHandler(w http.ResponseWriter, r *http.Request) {
-	CloseAllConnections()
+	if dbDirFunc != nil {
+		dir, err := dbDirForRequest(r)
+		if err != nil {
+			writeDirNotFound(w, err)
+			return
+		}
+		CloseConnectionsInDir(dir)
+	} else {
+		CloseAllConnections()
+	}
 
 	var resp CloseAllResp
 	writeSuccessResp(w, &resp)
@@ -359,6 +383,14 @@ func makeErrorResp(err error) map[string]interface{} {
 			}
 		}
 	default:
+		// フィクスチャの適用などで、容量の超過がwrapされて返ってくる場合
+		if isQuotaError(err) {
+			resp["sqlerror"] = map[string]interface{}{
+				"code":    WEBSQL_QUOTA_ERR,
+				"message": err.Error(),
+			}
+			break
+		}
 		resp["error"] = map[string]interface{}{
 			"name":    "UnknownError",
 			"message": err.Error(),
@@ -385,4 +417,7 @@ func Setup(mux *mux.Router, logger Logger) {
 	mux.HandleFunc("/pjf/api/websql/closeAll", closeAllHandler)
 	mux.HandleFunc("/pjf/api/websql/dbversion", dbVersionHandler)
 	//mux.HandleFunc("/pjf/api/websql/changeVersion", changeVersionHandler)
+
+	// databaseの中身を確認する管理用API
+	setupInspect(mux)
 }
@@ -0,0 +1,423 @@
+package websql
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databaseの中身を確認するための管理用API。コンテンツセットからは使わない。
+// dbファイルは読み取り専用で開くので、管理用APIからdatabaseを変更することはできない。
+//
+// databaseはdbファイル名ではなく、openDatabase()に渡した名前で指定する。
+
+// 1回に返す行数の既定値と最大値
+const (
+	inspectRowsDefault = 100
+	inspectRowsMax     = 1000
+)
+
+var errDatabaseNotFound = errors.New("database not found")
+
+// ListDatabasesInDir()が返す、databaseの一覧の要素
+type DatabaseSummary struct {
+	Name    string    `json:"name"`
+	File    string    `json:"file"`
+	Version string    `json:"version"` // __pro_database_infoのversion
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// InspectDatabase()が返す、databaseのテーブルなどの情報
+type DatabaseDetail struct {
+	DatabaseSummary
+	Tables   []*TableInfo  `json:"tables"`
+	Indexes  []*SchemaItem `json:"indexes"`
+	Triggers []*SchemaItem `json:"triggers"`
+}
+
+type TableInfo struct {
+	Name    string        `json:"name"`
+	Type    string        `json:"type"` // tableかview
+	Sql     string        `json:"sql"`
+	Rows    int64         `json:"rows"`
+	Columns []*ColumnInfo `json:"columns"`
+}
+
+type ColumnInfo struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	NotNull    bool        `json:"notNull"`
+	Default    interface{} `json:"default"`
+	PrimaryKey bool        `json:"primaryKey"`
+}
+
+// インデックスとトリガー
+type SchemaItem struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	Sql   string `json:"sql"`
+}
+
+// SELECTの結果。列の順序を保つため、行は値の配列にする。
+type QueryResult struct {
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated"` // limitより多くの行があった
+}
+
+// テーブルの内容の1ページ
+type TablePage struct {
+	QueryResult
+	Table  string `json:"table"`
+	Total  int64  `json:"total"`
+	Offset int    `json:"offset"`
+	Limit  int    `json:"limit"`
+}
+
+// BLOBの値。JSONでは {"blob":"16進数"} にする。
+type blobValue []byte
+
+func (b blobValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"blob": hex.EncodeToString(b)})
+}
+
+// dirにあるdatabaseの一覧を、名前の順に返す。
+func ListDatabasesInDir(dir string) ([]*DatabaseSummary, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []*DatabaseSummary{}
+	for _, f := range files {
+		name, ok := databaseNameFromFile(f.Name())
+		if f.IsDir() || !ok {
+			continue
+		}
+		summary, err := inspectSummary(dir, name)
+		if err != nil {
+			websqlLog.Warningf("cannot read %v: %v", f.Name(), err)
+			summary = &DatabaseSummary{Name: name, File: f.Name(), Size: f.Size(), ModTime: f.ModTime()}
+		}
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// databaseを読み取り専用で開く。無ければerrDatabaseNotFoundを返す。
+func openReadOnly(dir string, name string) (*sql.DB, error) {
+	path := databasePath(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errDatabaseNotFound
+		}
+		return nil, err
+	}
+	// URIのファイル名では、%などはescapeする
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filepath.ToSlash(path))
+	return sql.Open("sqlite3", "file:"+escaped+"?mode=ro")
+}
+
+func inspectSummary(dir string, name string) (*DatabaseSummary, error) {
+	path := databasePath(dir, name)
+	st, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errDatabaseNotFound
+		}
+		return nil, err
+	}
+	db, err := openReadOnly(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	version, err := getDatabaseVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	return &DatabaseSummary{Name: name, File: filepath.Base(path), Version: version, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+// dirにあるdatabaseの、テーブル、スキーマ、行数を返す。__pro_database_infoとsqlite_のテーブルは含めない。
+func InspectDatabase(dir string, name string) (*DatabaseDetail, error) {
+	summary, err := inspectSummary(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openReadOnly(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	detail := &DatabaseDetail{DatabaseSummary: *summary, Tables: []*TableInfo{}, Indexes: []*SchemaItem{}, Triggers: []*SchemaItem{}}
+	rows, err := db.Query("SELECT type, name, tbl_name, IFNULL(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite\\_%' ESCAPE '\\' AND name != ? ORDER BY name", databaseInfoTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var typ, itemName, table, stmt string
+		if err := rows.Scan(&typ, &itemName, &table, &stmt); err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "table", "view":
+			detail.Tables = append(detail.Tables, &TableInfo{Name: itemName, Type: typ, Sql: stmt})
+		case "index":
+			detail.Indexes = append(detail.Indexes, &SchemaItem{Name: itemName, Table: table, Sql: stmt})
+		case "trigger":
+			detail.Triggers = append(detail.Triggers, &SchemaItem{Name: itemName, Table: table, Sql: stmt})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, table := range detail.Tables {
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + quoteIdentifier(table.Name)).Scan(&table.Rows); err != nil {
+			return nil, err
+		}
+		if table.Columns, err = tableColumns(db, table.Name); err != nil {
+			return nil, err
+		}
+	}
+	return detail, nil
+}
+
+func tableColumns(db *sql.DB, table string) ([]*ColumnInfo, error) {
+	rows, err := db.Query("PRAGMA table_info(" + quoteIdentifier(table) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := []*ColumnInfo{}
+	for rows.Next() {
+		var cid, pk int
+		var c ColumnInfo
+		if err := rows.Scan(&cid, &c.Name, &c.Type, &c.NotNull, &c.Default, &pk); err != nil {
+			return nil, err
+		}
+		c.PrimaryKey = pk != 0
+		columns = append(columns, &c)
+	}
+	return columns, rows.Err()
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// テーブルの内容を、rowidの順にoffset行目からlimit行返す。
+func TableRows(dir string, name string, table string, offset int, limit int) (*TablePage, error) {
+	db, err := openReadOnly(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	page := &TablePage{Table: table, Offset: offset, Limit: limit}
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + quoteIdentifier(table)).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+	result, err := queryRows(db, "SELECT * FROM "+quoteIdentifier(table)+" LIMIT ? OFFSET ?", []interface{}{limit, offset}, limit)
+	if err != nil {
+		return nil, err
+	}
+	page.QueryResult = *result
+	page.Truncated = offset+len(result.Rows) < int(page.Total)
+	return page, nil
+}
+
+// databaseでSELECTを実行し、最大limit行を返す。
+// 読み取り専用で開くので、変更するSQLはエラーになる。'now'などはExec()と同様に置き換える。
+func QueryDatabase(dir string, name string, statement string, args []interface{}, limit int) (*QueryResult, error) {
+	db, err := openReadOnly(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	statement, args = applyNow(dir, statement, args)
+	return queryRows(db, statement, args, limit)
+}
+
+func queryRows(db *sql.DB, statement string, args []interface{}, limit int) (*QueryResult, error) {
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &QueryResult{Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		if len(result.Rows) >= limit {
+			result.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = blobValue(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, rows.Err()
+}
+
+func writeInspectResp(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := json.Marshal(v)
+	w.Write(body)
+}
+
+// 管理用APIのエラー。databaseや端末が無ければ404、それ以外(SQLの誤りなど)は400にする。
+func writeInspectError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var dirErr *dirNotFoundError
+	if errors.Is(err, errDatabaseNotFound) || errors.As(err, &dirErr) {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"message": err.Error()},
+	})
+	w.Write(body)
+}
+
+// クエリのoffset、limitを読む。limitは1〜inspectRowsMaxにする。
+func pageParams(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	offset, limit := 0, inspectRowsDefault
+	var err error
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset: %q", s)
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit: %q", s)
+		}
+	}
+	if limit > inspectRowsMax {
+		limit = inspectRowsMax
+	}
+	return offset, limit, nil
+}
+
+func listDatabasesHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := dbDirForRequest(r)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	list, err := ListDatabasesInDir(dir)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	writeInspectResp(w, list)
+}
+
+func inspectDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := dbDirForRequest(r)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	detail, err := InspectDatabase(dir, r.URL.Query().Get("name"))
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	writeInspectResp(w, detail)
+}
+
+func tableRowsHandler(w http.ResponseWriter, r *http.Request) {
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	dir, err := dbDirForRequest(r)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	page, err := TableRows(dir, q.Get("name"), q.Get("table"), offset, limit)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	writeInspectResp(w, page)
+}
+
+type QueryReq struct {
+	Sql   string        `json:"sql"`
+	Args  []interface{} `json:"args"`
+	Limit int           `json:"limit"` // 省略するとinspectRowsDefault
+}
+
+func queryDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req QueryReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeInspectError(w, fmt.Errorf("invalid json: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.Sql) == "" {
+		writeInspectError(w, errors.New("sql is required"))
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = inspectRowsDefault
+	}
+	if req.Limit > inspectRowsMax {
+		req.Limit = inspectRowsMax
+	}
+	dir, err := dbDirForRequest(r)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	result, err := QueryDatabase(dir, r.URL.Query().Get("name"), req.Sql, req.Args, req.Limit)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	writeInspectResp(w, result)
+}
+
+func setupInspect(mux *mux.Router) {
+	mux.HandleFunc("/pjf/api/websql/databases", listDatabasesHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/websql/usage", usageHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/websql/database", inspectDatabaseHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/websql/database/rows", tableRowsHandler).Methods("GET")
+	mux.HandleFunc("/pjf/api/websql/database/query", queryDatabaseHandler).Methods("POST")
+}
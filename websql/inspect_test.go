@@ -0,0 +1,77 @@
+package websql
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDatabaseNameFromFile(t *testing.T) {
+	for _, name := range []string{"mydb", "a/b_c", "日本語 db%"} {
+		got, ok := databaseNameFromFile(databasePath("", name))
+		if !ok || got != name {
+			t.Fatalf("databaseNameFromFile(%q) = %q, %v", name, got, ok)
+		}
+	}
+	for _, file := range []string{"mydb.db", "mydb_zz.db", "other_6d7964620a.db", "mydb_6d796462.db-journal"} {
+		if name, ok := databaseNameFromFile(file); ok {
+			t.Fatalf("databaseNameFromFile(%q) = %q", file, name)
+		}
+	}
+}
+
+func TestInspectDatabase(t *testing.T) {
+	dir := t.TempDir()
+	dbId, _, err := OpenInDir(dir, "shop/items", "1.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(dbId)
+	txId, _ := BeginTransaction(dbId)
+	for _, stmt := range []string{
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL, data BLOB)",
+		"CREATE INDEX items_name ON items (name)",
+		"INSERT INTO items (name, data) VALUES ('a', x'0102'), ('b', NULL), ('c', NULL)",
+	} {
+		if _, _, _, err := Exec(txId, stmt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Commit(txId); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := ListDatabasesInDir(dir)
+	if err != nil || len(list) != 1 || list[0].Name != "shop/items" || list[0].Version != "1.0" {
+		t.Fatalf("unexpected list %+v %v", list, err)
+	}
+
+	detail, err := InspectDatabase(dir, "shop/items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detail.Tables) != 1 || detail.Tables[0].Rows != 3 || len(detail.Tables[0].Columns) != 3 || len(detail.Indexes) != 1 {
+		t.Fatalf("unexpected detail %+v", detail)
+	}
+
+	page, err := TableRows(dir, "shop/items", "items", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(page.Rows)
+	if page.Total != 3 || !page.Truncated || string(data) != `[[1,"a",{"blob":"0102"}],[2,"b",null]]` {
+		t.Fatalf("unexpected page %+v %s", page, data)
+	}
+
+	result, err := QueryDatabase(dir, "shop/items", "SELECT name FROM items WHERE id > ?", []interface{}{1}, 10)
+	if err != nil || len(result.Rows) != 2 || result.Truncated {
+		t.Fatalf("unexpected result %+v %v", result, err)
+	}
+
+	// 読み取り専用なので変更できない
+	if _, err := QueryDatabase(dir, "shop/items", "DELETE FROM items", nil, 10); err == nil {
+		t.Fatal("DELETE succeeded")
+	}
+	if _, err := InspectDatabase(dir, "missing"); err != errDatabaseNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
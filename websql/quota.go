@@ -0,0 +1,180 @@
+package websql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/sstinc-jp/go-sqlite3"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// WebSQLの容量の制限。実機では容量を超える書き込みはQUOTA_ERRになるので、SQLiteのmax_page_countで同様に制限する。
+// 制限を超える書き込みはSQLITE_FULLになり、makeErrorResp()でWEBSQL_QUOTA_ERRとして返す。
+//
+// 制限はtransactionのbegin時に設定するので、SetBeginHook(QuotaBeginHook)で登録して使う。
+type Quota struct {
+	Database      int64 `json:"database"`      // 1つのdatabaseの最大サイズ(byte)。0なら制限しない
+	Total         int64 `json:"total"`         // dbDirにある全てのdatabaseの合計の最大サイズ(byte)。0なら制限しない
+	EstimatedSize bool  `json:"estimatedSize"` // openDatabase()のestimatedSizeを、そのdatabaseの最大サイズにする
+}
+
+// 制限しない場合のmax_page_count。SQLiteの最大値より大きければ、最大値になる。
+const maxPageCountUnlimited = 4294967294
+
+var quota Quota
+var estimatedSizes = map[string]int64{} // dbファイルのパスごとの、最後にopenした時のestimatedSize
+var quotaLock sync.Mutex
+
+func SetQuota(q Quota) error {
+	if q.Database < 0 || q.Total < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+	quotaLock.Lock()
+	quota = q
+	quotaLock.Unlock()
+	return nil
+}
+
+// openDatabase()のestimatedSizeを記録する。数値でなければ記録しない。
+func setEstimatedSize(dir string, name string, estimatedSize interface{}) {
+	var size int64
+	switch v := estimatedSize.(type) {
+	case float64:
+		size = int64(v)
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return
+		}
+		size = int64(f)
+	default:
+		return
+	}
+	quotaLock.Lock()
+	estimatedSizes[databasePath(dir, name)] = size
+	quotaLock.Unlock()
+}
+
+func isQuotaError(err error) bool {
+	var e sqlite3.Error
+	return errors.As(err, &e) && e.Code == sqlite3.ErrFull
+}
+
+// dirのdatabaseのファイルサイズを、databaseの名前ごとに返す
+func databaseSizes(dir string) (map[string]int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, f := range files {
+		if name, ok := databaseNameFromFile(f.Name()); ok && !f.IsDir() {
+			sizes[name] = f.Size()
+		}
+	}
+	return sizes, nil
+}
+
+// dirのnameのdatabaseが使える最大サイズ(byte)を返す。0なら制限しない。
+// Totalの制限は、他のdatabaseが使っている分を除いた残りにする。
+func databaseLimit(dir string, name string, sizes map[string]int64) int64 {
+	quotaLock.Lock()
+	q := quota
+	estimatedSize := estimatedSizes[databasePath(dir, name)]
+	quotaLock.Unlock()
+
+	limit := q.Database
+	if q.EstimatedSize && estimatedSize > 0 && (limit == 0 || estimatedSize < limit) {
+		limit = estimatedSize
+	}
+	if q.Total > 0 {
+		rest := q.Total
+		for n, size := range sizes {
+			if n != name {
+				rest -= size
+			}
+		}
+		if rest < 1 {
+			rest = 1
+		}
+		if limit == 0 || rest < limit {
+			limit = rest
+		}
+	}
+	return limit
+}
+
+// SetBeginHook()に登録して、Quotaの制限をtransactionのmax_page_countに設定する
+func QuotaBeginHook(tx *sql.Tx, info *BeginInfo, log Logger) error {
+	sizes, err := databaseSizes(info.Dir)
+	if err != nil {
+		return err
+	}
+	pages := int64(maxPageCountUnlimited)
+	if limit := databaseLimit(info.Dir, info.Name, sizes); limit > 0 {
+		var pageSize int64
+		if err := tx.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+			return err
+		}
+		// 今のサイズより小さくはできないので、それ以上は大きくならない
+		pages = limit / pageSize
+		if pages < 1 {
+			pages = 1
+		}
+	}
+	log.Debugf(0x1, "max_page_count=%v name=%v", pages, info.Name)
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA max_page_count = %d", pages))
+	return err
+}
+
+// databaseごとの使用量
+type DatabaseUsage struct {
+	Name          string `json:"name"`
+	Size          int64  `json:"size"`
+	EstimatedSize int64  `json:"estimatedSize"` // 最後にopenした時のestimatedSize。シミュレーターの起動後にopenされていなければ0
+	Limit         int64  `json:"limit"`         // 使える最大サイズ。0なら制限しない
+}
+
+type StorageUsage struct {
+	Quota     Quota            `json:"quota"`
+	Total     int64            `json:"total"`
+	Databases []*DatabaseUsage `json:"databases"`
+}
+
+// dirのdatabaseの使用量と制限を返す
+func UsageInDir(dir string) (*StorageUsage, error) {
+	sizes, err := databaseSizes(dir)
+	if err != nil {
+		return nil, err
+	}
+	quotaLock.Lock()
+	usage := &StorageUsage{Quota: quota, Databases: []*DatabaseUsage{}}
+	for name, size := range sizes {
+		usage.Total += size
+		usage.Databases = append(usage.Databases, &DatabaseUsage{Name: name, Size: size, EstimatedSize: estimatedSizes[databasePath(dir, name)]})
+	}
+	quotaLock.Unlock()
+	for _, d := range usage.Databases {
+		d.Limit = databaseLimit(dir, d.Name, sizes)
+	}
+	sort.Slice(usage.Databases, func(i, j int) bool { return usage.Databases[i].Name < usage.Databases[j].Name })
+	return usage, nil
+}
+
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := dbDirForRequest(r)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	usage, err := UsageInDir(dir)
+	if err != nil {
+		writeInspectError(w, err)
+		return
+	}
+	writeInspectResp(w, usage)
+}
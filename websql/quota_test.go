@@ -0,0 +1,99 @@
+package websql
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 制限を超えるまで1KBずつINSERTし、INSERTできた数とエラーを返す
+func fillDatabase(t *testing.T, dbId uint32) (int, error) {
+	txId, err := BeginTransaction(dbId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Commit(txId)
+	Exec(txId, "CREATE TABLE IF NOT EXISTS data (value TEXT)", nil)
+	for i := 0; i < 1000; i++ {
+		if _, _, _, err := Exec(txId, "INSERT INTO data VALUES (?)", []interface{}{strings.Repeat("x", 1024)}); err != nil {
+			return i, err
+		}
+	}
+	return 1000, nil
+}
+
+func TestQuota(t *testing.T) {
+	SetBeginHook(QuotaBeginHook)
+	defer SetBeginHook(nil)
+	defer SetQuota(Quota{})
+
+	dir := t.TempDir()
+	if err := SetQuota(Quota{Database: 64 * 1024, EstimatedSize: true}); err != nil {
+		t.Fatal(err)
+	}
+	dbId, _, _ := OpenInDir(dir, "small", "", false)
+	defer Close(dbId)
+	setEstimatedSize(dir, "small", float64(32*1024))
+	n, err := fillDatabase(t, dbId)
+	if !isQuotaError(err) || n == 0 || n >= 32 {
+		t.Fatalf("inserted %v rows: %v", n, err)
+	}
+	if resp := makeErrorResp(err); resp["sqlerror"].(map[string]interface{})["code"] != WEBSQL_QUOTA_ERR {
+		t.Fatalf("unexpected error response %v", resp)
+	}
+
+	// estimatedSizeが無ければ、Databaseの制限になる
+	dbId2, _, _ := OpenInDir(dir, "large", "", false)
+	defer Close(dbId2)
+	if n, err := fillDatabase(t, dbId2); !isQuotaError(err) || n < 32 || n >= 64 {
+		t.Fatalf("inserted %v rows: %v", n, err)
+	}
+
+	usage, err := UsageInDir(dir)
+	if err != nil || len(usage.Databases) != 2 || usage.Databases[1].Name != "small" || usage.Databases[1].Limit != 32*1024 {
+		t.Fatalf("unexpected usage %+v %v", usage, err)
+	}
+
+	// 合計の制限は、他のdatabaseの分を除いた残り
+	SetQuota(Quota{Total: usage.Total + 8*1024})
+	if n, err := fillDatabase(t, dbId); !isQuotaError(err) || n >= 8 {
+		t.Fatalf("inserted %v rows: %v", n, err)
+	}
+}
+
+// フィクスチャの読み込みも、容量の制限を超えたらQUOTA_ERRになる
+func TestQuotaFixture(t *testing.T) {
+	SetBeginHook(QuotaBeginHook)
+	defer SetBeginHook(nil)
+	defer SetQuota(Quota{})
+	defer SetFixtureDir("")
+
+	rows := []map[string]interface{}{}
+	for i := 0; i < 64; i++ {
+		rows = append(rows, map[string]interface{}{"value": strings.Repeat("x", 1024)})
+	}
+	fixtures, _ := json.Marshal([]map[string]interface{}{
+		{"database": "large", "sql": []string{"schema.sql"}, "data": []interface{}{map[string]interface{}{"table": "data", "rows": rows}}},
+	})
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "fixtures.json"), fixtures, 0644)
+	_ = os.WriteFile(filepath.Join(dir, "schema.sql"), []byte("CREATE TABLE data (value TEXT);"), 0644)
+	if _, err := SetFixtureDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	SetQuota(Quota{Database: 32 * 1024})
+	dbDir := t.TempDir()
+	_, _, err := OpenInDir(dbDir, "large", "", false)
+	if resp := makeErrorResp(err); !isQuotaError(err) || resp["sqlerror"].(map[string]interface{})["code"] != WEBSQL_QUOTA_ERR {
+		t.Fatalf("unexpected error %v", err)
+	}
+	SetQuota(Quota{})
+	dbId, created, err := OpenInDir(dbDir, "large", "", false)
+	if err != nil || created {
+		t.Fatalf("OpenInDir() = %v, %v", created, err)
+	}
+	Close(dbId)
+}
@@ -0,0 +1,56 @@
+package websql
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadTransaction(t *testing.T) {
+	dbId, _, err := OpenInDir(t.TempDir(), "readonly", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(dbId)
+	txId, _ := BeginTransaction(dbId)
+	Exec(txId, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)", nil)
+	Exec(txId, "INSERT INTO items VALUES (1, 'a')", nil)
+	Commit(txId)
+
+	txId, err = BeginReadTransaction(dbId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, rows, err := Exec(txId, "SELECT * FROM items", nil); err != nil || len(rows) != 1 {
+		t.Fatalf("select: %v %v", rows, err)
+	}
+	for _, stmt := range []string{
+		"INSERT INTO items VALUES (2, 'b')",
+		"UPDATE items SET name = 'x'",
+		"DELETE FROM items",
+		"CREATE TABLE other (id INTEGER)",
+		"DROP TABLE items",
+	} {
+		_, _, _, err := Exec(txId, stmt, nil)
+		var sqlErr *SqlError
+		if !errors.As(err, &sqlErr) || sqlErr.Code != WEBSQL_SYNTAX_ERR || sqlErr.Message != "could not prepare statement (23 not authorized)" {
+			t.Fatalf("%v: unexpected error %v", stmt, err)
+		}
+	}
+	// 拒否された後も、読み出しはできる
+	if _, _, rows, err := Exec(txId, "SELECT COUNT(*) AS n FROM items", nil); err != nil || rows[0]["n"] != int64(1) {
+		t.Fatalf("select: %v %v", rows, err)
+	}
+	if err := Commit(txId); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ接続を使う次のtransactionでは、書き込みができる
+	txId, _ = BeginTransaction(dbId)
+	insertId, _, _, err := Exec(txId, "INSERT INTO items VALUES (2, 'b')", nil)
+	if err != nil || insertId != 2 {
+		t.Fatalf("insert: %v %v", insertId, err)
+	}
+	if err := Commit(txId); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/sstinc-jp/go-sqlite3"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -60,14 +61,21 @@ const (
 )
 
 var databases = map[uint32]*sql.DB{}
+var databaseDirs = map[uint32]string{}  // dbIdごとの、dbファイルのあるディレクトリ
+var databaseNames = map[uint32]string{} // dbIdごとの、databaseの名前
 var transactions = map[uint32]*TxWrapper{}
 var nextId uint32
 var lock sync.Mutex
 
+// dbファイルを操作する間、openさせないためのlock。Open中はRLockする。
+var fileLock sync.RWMutex
+
 type TxWrapper struct {
 	tx                 *sql.Tx
 	db                 *sql.DB
 	isLastActionInsert bool
+	readOnly           bool // readTransaction()。書き込みはauthorizerで拒否する
+	isLastActionDenied bool // 最後のExec()で、authorizerが書き込みを拒否した
 }
 
 // WebSQL仕様の、SQLError型に相当
@@ -104,27 +112,105 @@ func SetDBDir(dirName string) {
 	}
 }
 
-var beginHook func(db *sql.DB, log Logger) error
+// beginHookに渡す、transactionを開始したdatabase
+type BeginInfo struct {
+	Dir  string
+	Name string
+}
+
+var beginHook func(tx *sql.Tx, info *BeginInfo, log Logger) error
 
-// transactionのbegin時に呼び出すhookを登録する
-func SetBeginHook(hook func(db *sql.DB, log Logger) error) {
+// transactionのbegin時に呼び出すhookを登録する。
+// hookはbegin直後のtransactionで呼ばれるので、PRAGMA max_page_countなど接続ごとの設定はtxで行う。
+func SetBeginHook(hook func(tx *sql.Tx, info *BeginInfo, log Logger) error) {
 	beginHook = hook
 }
 
-// databaseをopenする。
-// databaseId, created, errorを返す。
-func Open(name string, version string, hasCreationCallback bool) (uint32, bool, error) {
+var dbDirFunc func(r *http.Request) (string, error)
+
+// リクエストごとにdbの保存ディレクトリを変える場合に、ディレクトリを返す関数を登録する。
+// 登録しなければ、SetDBDir()で設定したディレクトリが使われる。
+// fがエラーを返したリクエスト(存在しない端末など)は、404にしてdatabaseを開かせない。
+func SetDBDirFunc(f func(r *http.Request) (string, error)) {
+	dbDirFunc = f
+}
+
+// dbDirFuncがエラーを返した
+type dirNotFoundError struct {
+	err error
+}
+
+func (e *dirNotFoundError) Error() string {
+	return e.err.Error()
+}
+
+func dbDirForRequest(r *http.Request) (string, error) {
+	if dbDirFunc != nil {
+		dir, err := dbDirFunc(r)
+		if err != nil {
+			return "", &dirNotFoundError{err: err}
+		}
+		return dir, nil
+	}
+	return dbDir, nil
+}
 
-	websqlLog.Debugf(0x1, "Open. name=%v, ver=%v", name, version)
+// dbDirForRequest()のエラーを404で返す
+func writeDirNotFound(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	writeErrorResp(w, err)
+}
 
+// databaseの名前から、dbファイルのパスを作る。dirが""ならカレントディレクトリのファイル。
+func databasePath(dir string, name string) string {
 	// '$', '&', '+', ',', '/', ':', ';', '=', '?', '@' あたりをescapeしてくれる。
 	// '/'以外はescapeしなくても良いのだが、ファイルに記号が入るのは何となく気持ち悪いので。
-	name = url.QueryEscape(name) + "_" + hex.EncodeToString([]byte(name)) + ".db"
-	if dbDir != "" {
-		name = filepath.Join(dbDir, name)
+	file := url.QueryEscape(name) + "_" + hex.EncodeToString([]byte(name)) + ".db"
+	if dir != "" {
+		file = filepath.Join(dir, file)
+	}
+	return file
+}
+
+// dbファイル名から、databaseの名前を取り出す。databasePath()で作ったファイル名でなければfalseを返す。
+func databaseNameFromFile(file string) (string, bool) {
+	base := strings.TrimSuffix(file, ".db")
+	i := strings.LastIndex(base, "_")
+	if base == file || i < 0 {
+		return "", false
+	}
+	name, err := hex.DecodeString(base[i+1:])
+	if err != nil || url.QueryEscape(string(name)) != base[:i] {
+		return "", false
 	}
+	return string(name), true
+}
+
+// fileがdatabaseのファイルか。databaseのjournalなどのファイル(-journal,-wal,-shm)も含む。
+func IsDatabaseFile(file string) bool {
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		file = strings.TrimSuffix(file, suffix)
+	}
+	_, ok := databaseNameFromFile(file)
+	return ok
+}
+
+// databaseをopenする。
+// databaseId, created, errorを返す。
+func Open(name string, version string, hasCreationCallback bool) (uint32, bool, error) {
+	return OpenInDir(dbDir, name, version, hasCreationCallback)
+}
+
+// dirにあるdatabaseをopenする。dirが""ならカレントディレクトリが使われる。
+// databaseId, created, errorを返す。
+func OpenInDir(dir string, name string, version string, hasCreationCallback bool) (uint32, bool, error) {
+
+	websqlLog.Debugf(0x1, "Open. dir=%v, name=%v, ver=%v", dir, name, version)
+	fileLock.RLock()
+	defer fileLock.RUnlock()
 
-	db, err := sql.Open("sqlite3", name)
+	db, err := sql.Open("sqlite3", databasePath(dir, name))
 	if err != nil {
 		websqlLog.Debugf(0x1, "Open failed: %v", err)
 		return 0, false, err
@@ -168,25 +254,67 @@ func Open(name string, version string, hasCreationCallback bool) (uint32, bool,
 			websqlLog.Warningf("cannot set auto_vacuum=full. error=%v", err)
 		}
 
+		fixture, err := findFixture(name, version)
+		if err != nil {
+			websqlLog.Warningf("cannot load fixtures. error=%v", err)
+			db.Close()
+			return 0, false, err
+		}
+
+		// infoとversion、フィクスチャは1つのtransactionで作る。途中で失敗したら、次のopenでまた作り直す。
+		tx, err := db.Begin()
+		if err != nil {
+			db.Close()
+			return 0, false, err
+		}
+		// フィクスチャの読み込みにも、transactionと同じようにmax_page_countを設定する
+		if beginHook != nil {
+			if err := beginHook(tx, &BeginInfo{Dir: dir, Name: name}, websqlLog); err != nil {
+				websqlLog.Errorf("cannot set max_page_count: %v", err)
+			}
+		}
+
 		websqlLog.Debugf(0x1, "creating info")
-		err = createDatabaseInfo(db)
+		err = createDatabaseInfo(tx)
 		if err != nil {
 			websqlLog.Warningf("cannot create DB info. error=%v", err)
+			tx.Rollback()
 			db.Close()
 			return 0, false, err
 		}
 
 		// creationCallbackがあれば、versionは""にする (なぜ？？？)
 		// creationCallbackが無ければ、versionは引数で渡されたものを使う。
+		// フィクスチャを適用する場合は、フィクスチャのversionにする。
 		var ver string
-		if hasCreationCallback {
+		if fixture != nil {
+			ver = fixture.versionFor(version)
+		} else if hasCreationCallback {
 			ver = ""
 		} else {
 			ver = version
 		}
-		err = setDatabaseVersion(db, ver)
+		err = setDatabaseVersion(tx, ver)
 		if err != nil {
 			websqlLog.Warningf("cannot set DB version. err=%v", err)
+			tx.Rollback()
+			db.Close()
+			return 0, false, err
+		}
+
+		if fixture != nil {
+			websqlLog.Debugf(0x1, "applying fixture")
+			if err := fixture.apply(tx); err != nil {
+				websqlLog.Warningf("cannot apply fixture. err=%v", err)
+				tx.Rollback()
+				db.Close()
+				return 0, false, err
+			}
+			// フィクスチャのデータが入っているので、既にあったdatabaseとして扱う。(creationCallbackは呼ばせない)
+			exists = true
+		}
+
+		if err := tx.Commit(); err != nil {
 			db.Close()
 			return 0, false, err
 		}
@@ -195,6 +323,8 @@ func Open(name string, version string, hasCreationCallback bool) (uint32, bool,
 	dbId := atomic.AddUint32(&nextId, 1)
 	lock.Lock()
 	databases[dbId] = db
+	databaseDirs[dbId] = dir
+	databaseNames[dbId] = name
 	lock.Unlock()
 
 	return dbId, !exists, nil
@@ -230,10 +360,22 @@ func DatabaseVersion(dbId uint32) (string, error) {
 	return verStr, nil
 }
 
+// transaction()のtransactionを開始する。
 func BeginTransaction(dbId uint32) (uint32, error) {
+	return beginTransaction(dbId, false)
+}
+
+// readTransaction()のtransactionを開始する。
+// webkitと同様に、書き込みのSQLはSYNTAX_ERRの"could not prepare statement (23 not authorized)"になる。
+func BeginReadTransaction(dbId uint32) (uint32, error) {
+	return beginTransaction(dbId, true)
+}
+
+func beginTransaction(dbId uint32, readOnly bool) (uint32, error) {
 
 	lock.Lock()
 	db := databases[dbId]
+	info := &BeginInfo{Dir: databaseDirs[dbId], Name: databaseNames[dbId]}
 	lock.Unlock()
 	if db == nil {
 		return 0, &SqlError{
@@ -243,13 +385,6 @@ func BeginTransaction(dbId uint32) (uint32, error) {
 		}
 	}
 
-	if beginHook != nil {
-		err := beginHook(db, websqlLog)
-		if err != nil {
-			websqlLog.Errorf("cannot set max_page_count: %v", err)
-		}
-	}
-
 	tx, err := db.Begin()
 	if err != nil {
 		websqlLog.Debugf(0x1, "db.begin error: %v", err)
@@ -263,17 +398,37 @@ func BeginTransaction(dbId uint32) (uint32, error) {
 	txWrapper := TxWrapper{tx: tx, db: db, isLastActionInsert: false}
 	// Exec()内で、INSERTかそうじゃないかを判断するためにhookを登録する
 	// この値は、Exec()の最初にfalseにされる。
+	// 接続は使い回されるので、前のreadTransactionのauthorizerが残らないよう、beginHookより先に登録する。
 	conn := getConn(tx)
+	// (CloseConnectionsInDir()などはlockしたままrollbackするので、COMMIT、ROLLBACKではlockしない)
 	conn.RegisterAuthorizer(func(action int, arg1, arg2, arg3 string) int {
-		if action == sqlite3.SQLITE_INSERT {
+		if isWriteAction(action) {
 			lock.Lock()
-			txWrapper.isLastActionInsert = true
-			lock.Unlock()
+			defer lock.Unlock()
+			if txWrapper.readOnly {
+				websqlLog.Debugf(0x1, "action=%v denied in read transaction", action)
+				txWrapper.isLastActionDenied = true
+				return sqlite3.SQLITE_DENY
+			}
+			if action == sqlite3.SQLITE_INSERT {
+				txWrapper.isLastActionInsert = true
+			}
 		}
 		websqlLog.Debugf(0x1, "lastAction=%v", action)
 		return sqlite3.SQLITE_OK
 	})
 
+	// max_page_countの設定などは、readTransactionでも行う
+	if beginHook != nil {
+		err := beginHook(tx, info, websqlLog)
+		if err != nil {
+			websqlLog.Errorf("cannot set max_page_count: %v", err)
+		}
+	}
+	lock.Lock()
+	txWrapper.readOnly = readOnly
+	lock.Unlock()
+
 	txId := atomic.AddUint32(&nextId, 1)
 	lock.Lock()
 	transactions[txId] = &txWrapper
@@ -297,6 +452,27 @@ func BeginTransaction(dbId uint32) (uint32, error) {
 	return txId, nil
 }
 
+// readTransactionで拒否するauthorizerのaction。webkitのDatabaseAuthorizerと同様に、databaseを変更するもの。
+// PRAGMAは、table_info()などの読み出しと区別できないので拒否しない。
+// BEGIN、COMMITなど(SQLITE_TRANSACTION)は、transaction自体のcommit、rollbackで使うので拒否しない。
+func isWriteAction(action int) bool {
+	switch action {
+	case sqlite3.SQLITE_INSERT, sqlite3.SQLITE_UPDATE, sqlite3.SQLITE_DELETE,
+		sqlite3.SQLITE_CREATE_INDEX, sqlite3.SQLITE_CREATE_TABLE, sqlite3.SQLITE_CREATE_TRIGGER,
+		sqlite3.SQLITE_CREATE_VIEW, sqlite3.SQLITE_CREATE_VTABLE,
+		sqlite3.SQLITE_CREATE_TEMP_INDEX, sqlite3.SQLITE_CREATE_TEMP_TABLE,
+		sqlite3.SQLITE_CREATE_TEMP_TRIGGER, sqlite3.SQLITE_CREATE_TEMP_VIEW,
+		sqlite3.SQLITE_DROP_INDEX, sqlite3.SQLITE_DROP_TABLE, sqlite3.SQLITE_DROP_TRIGGER,
+		sqlite3.SQLITE_DROP_VIEW, sqlite3.SQLITE_DROP_VTABLE,
+		sqlite3.SQLITE_DROP_TEMP_INDEX, sqlite3.SQLITE_DROP_TEMP_TABLE,
+		sqlite3.SQLITE_DROP_TEMP_TRIGGER, sqlite3.SQLITE_DROP_TEMP_VIEW,
+		sqlite3.SQLITE_ALTER_TABLE, sqlite3.SQLITE_REINDEX, sqlite3.SQLITE_ANALYZE,
+		sqlite3.SQLITE_ATTACH, sqlite3.SQLITE_DETACH:
+		return true
+	}
+	return false
+}
+
 func getConn(tx *sql.Tx) *sqlite3.SQLiteConn {
 	a := reflect.ValueOf(tx).
 		Elem().
@@ -322,14 +498,35 @@ func Exec(txId uint32, statement string, args []interface{}) (int64, int64, []ma
 			Message: "tx missing (aborted?)",
 		}
 	}
+	lock.Lock()
 	tx.isLastActionInsert = false
+	tx.isLastActionDenied = false
+	lock.Unlock()
 
 	conn := getConn(tx.tx)
 	_, totalChanges1 := conn.GetInfo()
 
+	lock.Lock()
+	dir := txDirLocked(tx)
+	lock.Unlock()
+	statement, args = applyNow(dir, statement, args)
 	rows, err := tx.tx.Query(statement, args...)
 	if err != nil {
 		websqlLog.Debugf(0x1, "tx.Query error: %v", err)
+		if isQuotaError(err) {
+			return 0, 0, nil, err // makeErrorResp()でQUOTA_ERRにする
+		}
+		lock.Lock()
+		denied := tx.isLastActionDenied
+		lock.Unlock()
+		if denied {
+			// webkitのメッセージに合わせる。23はSQLITE_AUTH
+			return 0, 0, nil, &SqlError{
+				Code:    WEBSQL_SYNTAX_ERR,
+				Message: "could not prepare statement (23 not authorized)",
+				Err:     err,
+			}
+		}
 		return 0, 0, nil, &SqlError{
 			Code:    WEBSQL_SYNTAX_ERR,
 			Message: err.Error(),
@@ -381,7 +578,7 @@ func ChangeDbVersion(txId uint32, oldVer string, newVer string) error {
 		}
 	}
 
-	if err := setDatabaseVersionByTx(tx.tx, newVer); err != nil {
+	if err := setDatabaseVersion(tx.tx, newVer); err != nil {
 		return &SqlError{
 			Code:    WEBSQL_UNKNOWN_ERR,
 			Message: "tx missing (aborted?)",
@@ -407,6 +604,9 @@ func Commit(txId uint32) error {
 	if err != nil {
 		websqlLog.Debugf(0x1, "tx.commit error: %v", err)
 		_ = tx.tx.Rollback() // commitの失敗はどうしようもないので、rollbackする
+		if isQuotaError(err) {
+			return err
+		}
 		return &SqlError{
 			Code:    WEBSQL_DATABASE_ERR,
 			Message: err.Error(),
@@ -446,6 +646,8 @@ func Close(dbId uint32) error {
 	lock.Lock()
 	db := databases[dbId]
 	delete(databases, dbId)
+	delete(databaseDirs, dbId)
+	delete(databaseNames, dbId)
 	lock.Unlock()
 
 	websqlLog.Debugf(0x1, "Close dbId=%v", dbId)
@@ -478,6 +680,95 @@ func closeConnectionsLocked() {
 		db.Close()
 	}
 	databases = map[uint32]*sql.DB{}
+	databaseDirs = map[uint32]string{}
+	databaseNames = map[uint32]string{}
+}
+
+// dirにあるdatabaseの接続だけを閉じる。未commitのtransactionはrollbackする。
+// rollbackしたtransactionの数を返す。
+func CloseConnectionsInDir(dir string) int {
+	websqlLog.NoticeEventf("CloseConnectionsInDir dir=%v", dir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return closeConnectionsInDirLocked(dir)
+}
+
+func closeConnectionsInDirLocked(dir string) int {
+	rolledBack := 0
+	for txId, tx := range transactions {
+		if txInDirLocked(tx, dir) {
+			tx.tx.Rollback()
+			delete(transactions, txId)
+			rolledBack++
+		}
+	}
+	for dbId, db := range databases {
+		if databaseDirs[dbId] == dir {
+			db.Close()
+			delete(databases, dbId)
+			delete(databaseDirs, dbId)
+			delete(databaseNames, dbId)
+		}
+	}
+	return rolledBack
+}
+
+// txのdatabaseのあるディレクトリ。lockした状態で呼ぶこと
+func txDirLocked(tx *TxWrapper) string {
+	for dbId, db := range databases {
+		if db == tx.db {
+			return databaseDirs[dbId]
+		}
+	}
+	return ""
+}
+
+func txInDirLocked(tx *TxWrapper, dir string) bool {
+	for dbId, db := range databases {
+		if db == tx.db && databaseDirs[dbId] == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// dirにあるdatabaseの実行中のtransactionが全て終わるまで、最大timeoutだけ待つ。
+// 全て終わればtrueを返す。
+func WaitTransactionsInDir(dir string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock.Lock()
+		n := 0
+		for _, tx := range transactions {
+			if txInDirLocked(tx, dir) {
+				n++
+			}
+		}
+		lock.Unlock()
+		if n == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// dirにあるdatabaseの接続を閉じてから、fを実行する。fの実行中は、dirに限らずdatabaseをopenできない。
+// dbファイルのコピーなど、接続があると壊れてしまう操作のためのもの。
+// 実行中のtransactionは最大timeoutだけ待ち、終わらなければrollbackする。rollbackしたtransactionの数を返す。
+func WithConnectionsClosedInDir(dir string, timeout time.Duration, f func() error) (int, error) {
+	WaitTransactionsInDir(dir, timeout)
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	lock.Lock()
+	rolledBack := closeConnectionsInDirLocked(dir)
+	lock.Unlock()
+
+	return rolledBack, f()
 }
 
 func DeleteAllDatabases() {
@@ -485,21 +776,38 @@ func DeleteAllDatabases() {
 	defer lock.Unlock()
 
 	closeConnectionsLocked()
+	deleteDatabaseFilesLocked(dbDir)
+}
+
+// dirにあるdatabaseの接続を閉じ、ファイルを全て削除する
+func DeleteAllDatabasesInDir(dir string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	closeConnectionsInDirLocked(dir)
+	deleteDatabaseFilesLocked(dir)
+}
 
-	files, err := ioutil.ReadDir(dbDir)
+func deleteDatabaseFilesLocked(dir string) {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return
 	}
 	for _, f := range files {
 		if !f.IsDir() && strings.HasSuffix(f.Name(), ".db") {
-			path := filepath.Join(dbDir, f.Name())
+			path := filepath.Join(dir, f.Name())
 			os.Remove(path)
 			websqlLog.Debugf(0x1, "DeleteAllDatabases(). file=%v", path)
 		}
 	}
 }
 
-func createDatabaseInfo(db *sql.DB) error {
+// *sql.DBと*sql.Txのどちらでも実行できるようにする
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func createDatabaseInfo(db execer) error {
 	_, err := db.Exec(fmt.Sprintf(`
 CREATE TABLE %v (
 	id INTEGER PRIMARY KEY,
@@ -525,16 +833,11 @@ func doesDatabaseInfoExists(db *sql.DB) (bool, error) {
 	}
 }
 
-func setDatabaseVersion(db *sql.DB, version string) error {
+func setDatabaseVersion(db execer, version string) error {
 	_, err := db.Exec(fmt.Sprintf("REPLACE INTO %v ( id, version ) VALUES ( 0, ? );", databaseInfoTable), []interface{}{version}...)
 	return err
 }
 
-func setDatabaseVersionByTx(tx *sql.Tx, version string) error {
-	_, err := tx.Exec(fmt.Sprintf("REPLACE INTO %v ( id, version ) VALUES ( 0, ? );", databaseInfoTable), []interface{}{version}...)
-	return err
-}
-
 func getDatabaseVersion(db *sql.DB) (string, error) {
 	rows, err := db.Query(fmt.Sprintf("SELECT * from %v", databaseInfoTable))
 	if err != nil {
@@ -8,7 +8,8 @@ import (
 
 func TestWebSQL(t *testing.T) {
 
-	SetDBDir("./")
+	SetDBDir(t.TempDir())
+	defer SetDBDir("")
 
 	DeleteAllDatabases()
 	dbId, _, err := Open("mydb", "", false)